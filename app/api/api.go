@@ -0,0 +1,412 @@
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	bc "github.com/serj1c/blockchainio/app/blockchain"
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+// Lists are returned a page at a time, DefaultLimit items unless the limit
+// query parameter asks for another number up to MaxLimit.
+const (
+	DefaultLimit = 50
+	MaxLimit     = 500
+)
+
+var (
+	errBadRequest = errors.New("bad request")
+	errNotFound   = errors.New("not found")
+)
+
+// Page is one page of a list, starting at Offset.
+type Page struct {
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Total  int         `json:"total"`
+	Items  interface{} `json:"items"`
+}
+
+// BlockInfo is a block and whether it is on the main chain. Blocks of other
+// branches have no confirmations.
+type BlockInfo struct {
+	Block         *bc.Block
+	MainChain     bool
+	Confirmations int
+}
+
+// MarshalJSON adds mainchain and confirmations to the JSON form of the block.
+func (b BlockInfo) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(b.Block)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fields["mainchain"] = b.MainChain
+	fields["confirmations"] = b.Confirmations
+
+	return json.Marshal(fields)
+}
+
+// TransactionInfo is a transaction on the main chain and where it is.
+type TransactionInfo struct {
+	Transaction   *bc.Transaction `json:"transaction"`
+	BlockHash     string          `json:"blockhash"`
+	Height        int             `json:"height"`
+	Confirmations int             `json:"confirmations"`
+}
+
+// HistoryItem is a transaction of an address's history and what it did for
+// the address.
+type HistoryItem struct {
+	TransactionInfo
+	Received       int      `json:"received"`
+	Sent           int      `json:"sent"`
+	Counterparties []string `json:"counterparties"`
+}
+
+type UnspentOutput struct {
+	TxId   string      `json:"txid"`
+	Out    int         `json:"vout"`
+	Output bc.TxOutput `json:"output"`
+}
+
+// CoinSelection is the outputs a coin selector would spend to pay an amount
+// from an address, and the change that would be left.
+type CoinSelection struct {
+	Selector string          `json:"selector"`
+	Amount   int             `json:"amount"`
+	Inputs   []UnspentOutput `json:"inputs"`
+	Total    int             `json:"total"`
+	Change   int             `json:"change"`
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// Server is a read-only REST API over a chain, meant for block explorers:
+//
+//	GET /blocks/{hash}
+//	GET /blocks/height/{n}
+//	GET /tx/{id}
+//	GET /address/{address}/utxos
+//	GET /address/{address}/history
+//	GET /address/{address}/selectcoins?amount=N&selector=NAME
+//
+// Blocks, found on any branch by hash, say whether they are on the main
+// chain. The address lists take offset and limit query parameters. selectcoins
+// shows which outputs a new transaction would spend, using the default coin
+// selector unless another is named.
+type Server struct {
+	Chain *bc.BlockChain
+}
+
+func NewServer(chain *bc.BlockChain) *Server {
+	return &Server{Chain: chain}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	result, err := s.route(r)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) route(r *http.Request) (interface{}, error) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 2 && parts[0] == "blocks":
+		return s.block(parts[1])
+	case len(parts) == 3 && parts[0] == "blocks" && parts[1] == "height":
+		return s.blockByHeight(parts[2])
+	case len(parts) == 2 && parts[0] == "tx":
+		return s.transaction(parts[1])
+	case len(parts) == 3 && parts[0] == "address" && parts[2] == "utxos":
+		return s.unspent(parts[1], r)
+	case len(parts) == 3 && parts[0] == "address" && parts[2] == "history":
+		return s.history(parts[1], r)
+	case len(parts) == 3 && parts[0] == "address" && parts[2] == "selectcoins":
+		return s.selectCoins(parts[1], r)
+	}
+
+	return nil, fmt.Errorf("%w: %s", errNotFound, r.URL.Path)
+}
+
+func (s *Server) block(hashHex string) (interface{}, error) {
+	hash, err := decodeHex(hashHex)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := s.Chain.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	main, err := s.Chain.GetBlockByHeight(block.Height)
+	if err != nil && !errors.Is(err, bc.ErrBlockNotFound) {
+		return nil, err
+	}
+
+	return s.blockInfo(&block, err == nil && bytes.Equal(main.Hash, block.Hash))
+}
+
+func (s *Server) blockByHeight(heightStr string) (interface{}, error) {
+	height, err := strconv.Atoi(heightStr)
+	if err != nil || height < 0 {
+		return nil, fmt.Errorf("%w: height %q", errBadRequest, heightStr)
+	}
+
+	block, err := s.Chain.GetBlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.blockInfo(&block, true)
+}
+
+func (s *Server) blockInfo(block *bc.Block, mainChain bool) (BlockInfo, error) {
+	info := BlockInfo{Block: block, MainChain: mainChain}
+	if mainChain {
+		bestHeight, err := s.Chain.GetBestHeight()
+		if err != nil {
+			return BlockInfo{}, err
+		}
+		info.Confirmations = bestHeight - block.Height + 1
+	}
+
+	return info, nil
+}
+
+func (s *Server) transaction(idHex string) (interface{}, error) {
+	id, err := decodeHex(idHex)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := s.Chain.FindTransactionBlock(id)
+	if err != nil {
+		return nil, err
+	}
+	bestHeight, err := s.Chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range block.Transactions {
+		if bytes.Equal(tx.Id, id) {
+			return transactionInfo(tx, block.Hash, block.Height, bestHeight), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %x", bc.ErrTxNotFound, id)
+}
+
+func (s *Server) unspent(address string, r *http.Request) (interface{}, error) {
+	pubKeyHash, err := decodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	unspent, err := s.Chain.ListUnspent(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := window(len(unspent), offset, limit)
+	items := make([]UnspentOutput, 0, end-start)
+	for _, u := range unspent[start:end] {
+		items = append(items, UnspentOutput{
+			TxId:   hex.EncodeToString(u.TxId),
+			Out:    u.Index,
+			Output: u.Output,
+		})
+	}
+
+	return Page{Offset: offset, Limit: limit, Total: len(unspent), Items: items}, nil
+}
+
+func (s *Server) history(address string, r *http.Request) (interface{}, error) {
+	pubKeyHash, err := decodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	history, total, err := s.Chain.AddressHistory(pubKeyHash, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	bestHeight, err := s.Chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]HistoryItem, 0, len(history))
+	for _, entry := range history {
+		item := HistoryItem{
+			TransactionInfo: transactionInfo(entry.Transaction, entry.BlockHash, entry.Height, bestHeight),
+			Received:        entry.Received,
+			Sent:            entry.Sent,
+			Counterparties:  entry.Counterparties,
+		}
+		if item.Counterparties == nil {
+			item.Counterparties = []string{}
+		}
+		items = append(items, item)
+	}
+
+	return Page{Offset: offset, Limit: limit, Total: total, Items: items}, nil
+}
+
+func (s *Server) selectCoins(address string, r *http.Request) (interface{}, error) {
+	pubKeyHash, err := decodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	query := r.URL.Query()
+	amount, err := strconv.Atoi(query.Get("amount"))
+	if err != nil || amount < 1 {
+		return nil, fmt.Errorf("%w: amount %q, it must be a positive number", errBadRequest, query.Get("amount"))
+	}
+	selector := bc.DefaultCoinSelector
+	if name := query.Get("selector"); name != "" {
+		if selector, err = bc.CoinSelectorByName(name); err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+		}
+	}
+
+	coins, err := s.Chain.ListUnspent(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selector.Select(coins, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	selection := CoinSelection{Selector: selector.Name(), Amount: amount, Inputs: make([]UnspentOutput, 0, len(selected))}
+	for _, u := range selected {
+		selection.Inputs = append(selection.Inputs, UnspentOutput{
+			TxId:   hex.EncodeToString(u.TxId),
+			Out:    u.Index,
+			Output: u.Output,
+		})
+		selection.Total += u.Output.Value
+	}
+	selection.Change = selection.Total - amount
+
+	return selection, nil
+}
+
+func transactionInfo(tx *bc.Transaction, blockHash []byte, height, bestHeight int) TransactionInfo {
+	return TransactionInfo{
+		Transaction:   tx,
+		BlockHash:     hex.EncodeToString(blockHash),
+		Height:        height,
+		Confirmations: bestHeight - height + 1,
+	}
+}
+
+// pageParams reads the offset and limit query parameters.
+func pageParams(r *http.Request) (int, int, error) {
+	offset, limit := 0, DefaultLimit
+	query := r.URL.Query()
+
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("%w: offset %q", errBadRequest, v)
+		}
+		offset = n
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxLimit {
+			return 0, 0, fmt.Errorf("%w: limit %q, it must be between 1 and %d", errBadRequest, v, MaxLimit)
+		}
+		limit = n
+	}
+
+	return offset, limit, nil
+}
+
+// window returns the bounds of a page in a list of total items.
+func window(total, offset, limit int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	return offset, end
+}
+
+func decodeHex(s string) ([]byte, error) {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q is not hex", errBadRequest, s)
+	}
+	return data, nil
+}
+
+func decodeAddress(address string) ([]byte, error) {
+	pubKeyHash, err := wallet.DecodeAddress(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return pubKeyHash, nil
+}
+
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, errBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, errNotFound), errors.Is(err, bc.ErrBlockNotFound), errors.Is(err, bc.ErrTxNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, bc.ErrInsufficientFunds):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorBody{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
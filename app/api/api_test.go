@@ -0,0 +1,356 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	bc "github.com/serj1c/blockchainio/app/blockchain"
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+// fixture is a chain of four blocks where the first three each pay 10 from
+// miner to payee, and a block on a side branch, served by the REST API.
+type fixture struct {
+	server *httptest.Server
+	chain  *bc.BlockChain
+	miner  *wallet.Wallet
+	payee  *wallet.Wallet
+	txs    []*bc.Transaction
+	blocks []*bc.Block
+	side   *bc.Block
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+
+	miner, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payee, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := bc.InitBlockChain(string(miner.Address()), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+
+	f := &fixture{chain: chain, miner: miner, payee: payee}
+	for i := 0; i < 4; i++ {
+		var txs []*bc.Transaction
+		if i < 3 {
+			tx, err := bc.NewTransaction(miner, string(payee.Address()), 10, bc.Fee{Amount: 1}, nil, chain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			txs = append(txs, tx)
+			f.txs = append(f.txs, tx)
+		}
+		block, err := chain.MineBlock(string(miner.Address()), txs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.blocks = append(f.blocks, block)
+	}
+
+	genesis, err := chain.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := bc.CoinbaseTx(string(miner.Address()), "", chain.Reward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.side = bc.CreateBlock([]*bc.Transaction{coinbase}, genesis.Hash, 1, chain.NextDifficulty(&genesis))
+	if err := chain.AddBlock(f.side); err != nil {
+		t.Fatal(err)
+	}
+
+	f.server = httptest.NewServer(NewServer(chain))
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+// get requests path and decodes the JSON reply into v.
+func (f *fixture) get(t *testing.T, path string, v interface{}) int {
+	t.Helper()
+
+	resp, err := http.Get(f.server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: Content-Type %q", path, ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+
+	return resp.StatusCode
+}
+
+// getOK requests path, expects 200 and decodes the reply into v.
+func (f *fixture) getOK(t *testing.T, path string, v interface{}) {
+	t.Helper()
+
+	if status := f.get(t, path, v); status != http.StatusOK {
+		t.Fatalf("%s: status %d", path, status)
+	}
+}
+
+// blockReply is the JSON form of a block as a client reads it.
+type blockReply struct {
+	Hash          string `json:"hash"`
+	Height        int    `json:"height"`
+	PrevHash      string `json:"prevhash"`
+	MerkleRoot    string `json:"merkleroot"`
+	Timestamp     int64  `json:"timestamp"`
+	Difficulty    int    `json:"difficulty"`
+	MainChain     bool   `json:"mainchain"`
+	Confirmations int    `json:"confirmations"`
+	Transactions  []struct {
+		Id       string `json:"txid"`
+		Coinbase bool   `json:"coinbase"`
+	} `json:"tx"`
+}
+
+func TestBlocks(t *testing.T) {
+	f := newFixture(t)
+	block := f.blocks[0]
+
+	var byHash, byHeight blockReply
+	f.getOK(t, "/blocks/"+hex.EncodeToString(block.Hash), &byHash)
+	f.getOK(t, "/blocks/height/1", &byHeight)
+
+	for _, reply := range []blockReply{byHash, byHeight} {
+		if reply.Hash != hex.EncodeToString(block.Hash) || reply.Height != 1 || reply.PrevHash != hex.EncodeToString(block.PrevHash) {
+			t.Errorf("block %+v, want %x at height 1", reply, block.Hash)
+		}
+		if reply.MerkleRoot != hex.EncodeToString(block.MerkleRoot) || reply.Timestamp != block.Timestamp || reply.Difficulty != block.Difficulty {
+			t.Errorf("block %+v has the wrong header", reply)
+		}
+		if !reply.MainChain || reply.Confirmations != 4 {
+			t.Errorf("block on the main chain: mainchain %t with %d confirmations, want 4", reply.MainChain, reply.Confirmations)
+		}
+		if len(reply.Transactions) != 2 || !reply.Transactions[0].Coinbase || reply.Transactions[1].Id != hex.EncodeToString(f.txs[0].Id) {
+			t.Errorf("block transactions %+v, want coinbase and %x", reply.Transactions, f.txs[0].Id)
+		}
+	}
+
+	var side blockReply
+	f.getOK(t, "/blocks/"+hex.EncodeToString(f.side.Hash), &side)
+	if side.Hash != hex.EncodeToString(f.side.Hash) || side.MainChain || side.Confirmations != 0 {
+		t.Errorf("side block: %s, mainchain %t with %d confirmations, want none", side.Hash, side.MainChain, side.Confirmations)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	f := newFixture(t)
+
+	var reply struct {
+		Transaction struct {
+			Id      string `json:"txid"`
+			Outputs []struct {
+				Value   int    `json:"value"`
+				Address string `json:"address"`
+			} `json:"vout"`
+		} `json:"transaction"`
+		BlockHash     string `json:"blockhash"`
+		Height        int    `json:"height"`
+		Confirmations int    `json:"confirmations"`
+	}
+	f.getOK(t, "/tx/"+hex.EncodeToString(f.txs[1].Id), &reply)
+
+	if reply.Transaction.Id != hex.EncodeToString(f.txs[1].Id) || reply.BlockHash != hex.EncodeToString(f.blocks[1].Hash) {
+		t.Errorf("transaction %s in block %s, want %x in %x", reply.Transaction.Id, reply.BlockHash, f.txs[1].Id, f.blocks[1].Hash)
+	}
+	if reply.Height != 2 || reply.Confirmations != 3 {
+		t.Errorf("height %d with %d confirmations, want 2 with 3", reply.Height, reply.Confirmations)
+	}
+	if len(reply.Transaction.Outputs) == 0 || reply.Transaction.Outputs[0].Value != 10 || reply.Transaction.Outputs[0].Address != string(f.payee.Address()) {
+		t.Errorf("outputs %+v, want 10 to %s first", reply.Transaction.Outputs, f.payee.Address())
+	}
+}
+
+// TestPages checks that the address lists are paged alike.
+func TestPages(t *testing.T) {
+	f := newFixture(t)
+	payee := string(f.payee.Address())
+
+	tests := []struct {
+		query         string
+		offset, limit int
+		items         int
+	}{
+		{"", 0, DefaultLimit, 3},
+		{"?limit=2", 0, 2, 2},
+		{"?offset=2&limit=2", 2, 2, 1},
+		{"?offset=3", 3, DefaultLimit, 0},
+		{"?offset=10", 10, DefaultLimit, 0},
+	}
+
+	for _, list := range []string{"utxos", "history"} {
+		seen := make(map[string]bool)
+		for _, tt := range tests {
+			var page struct {
+				Offset int               `json:"offset"`
+				Limit  int               `json:"limit"`
+				Total  int               `json:"total"`
+				Items  []json.RawMessage `json:"items"`
+			}
+			path := fmt.Sprintf("/address/%s/%s%s", payee, list, tt.query)
+			f.getOK(t, path, &page)
+
+			if page.Offset != tt.offset || page.Limit != tt.limit || page.Total != 3 || len(page.Items) != tt.items {
+				t.Errorf("%s: offset %d, limit %d, total %d, %d items; want %d, %d, 3, %d",
+					path, page.Offset, page.Limit, page.Total, len(page.Items), tt.offset, tt.limit, tt.items)
+			}
+			if page.Items == nil {
+				t.Errorf("%s: items is null rather than a list", path)
+			}
+			if tt.query == "?limit=2" || tt.query == "?offset=2&limit=2" {
+				for _, item := range page.Items {
+					if seen[string(item)] {
+						t.Errorf("%s: %s is on two pages", path, item)
+					}
+					seen[string(item)] = true
+				}
+			}
+		}
+		if len(seen) != 3 {
+			t.Errorf("%s: the pages hold %d items, want 3", list, len(seen))
+		}
+	}
+}
+
+func TestUnspentAndHistoryItems(t *testing.T) {
+	f := newFixture(t)
+	payee := string(f.payee.Address())
+
+	var unspent struct {
+		Items []struct {
+			TxId   string `json:"txid"`
+			Out    int    `json:"vout"`
+			Output struct {
+				Value   int    `json:"value"`
+				Address string `json:"address"`
+			} `json:"output"`
+		} `json:"items"`
+	}
+	f.getOK(t, "/address/"+payee+"/utxos", &unspent)
+	txIds := make(map[string]bool)
+	for _, tx := range f.txs {
+		txIds[hex.EncodeToString(tx.Id)] = true
+	}
+	for _, u := range unspent.Items {
+		if !txIds[u.TxId] || u.Output.Value != 10 || u.Output.Address != payee {
+			t.Errorf("unspent output %+v, want 10 to %s from one of the payments", u, payee)
+		}
+	}
+
+	var history struct {
+		Items []struct {
+			Transaction struct {
+				Id string `json:"txid"`
+			} `json:"transaction"`
+			Height         int      `json:"height"`
+			Confirmations  int      `json:"confirmations"`
+			Received       int      `json:"received"`
+			Sent           int      `json:"sent"`
+			Counterparties []string `json:"counterparties"`
+		} `json:"items"`
+	}
+	f.getOK(t, "/address/"+payee+"/history", &history)
+	if len(history.Items) != 3 {
+		t.Fatalf("history has %d items, want 3", len(history.Items))
+	}
+	for _, item := range history.Items {
+		if !txIds[item.Transaction.Id] || item.Received != 10 || item.Sent != 0 || item.Confirmations != 4-item.Height+1 {
+			t.Errorf("history item %+v, want 10 received", item)
+		}
+		if len(item.Counterparties) != 1 || item.Counterparties[0] != string(f.miner.Address()) {
+			t.Errorf("counterparties %v, want %s", item.Counterparties, f.miner.Address())
+		}
+	}
+}
+
+func TestSelectCoins(t *testing.T) {
+	f := newFixture(t)
+	payee := string(f.payee.Address())
+
+	var selection CoinSelection
+	f.getOK(t, "/address/"+payee+"/selectcoins?amount=15&selector=largest-first", &selection)
+	if selection.Selector != "largest-first" || selection.Amount != 15 || len(selection.Inputs) != 2 {
+		t.Errorf("selection %+v, want two inputs from largest-first", selection)
+	}
+	if selection.Total != 20 || selection.Change != 5 {
+		t.Errorf("total %d and change %d, want 20 and 5", selection.Total, selection.Change)
+	}
+
+	f.getOK(t, "/address/"+payee+"/selectcoins?amount=5", &selection)
+	if selection.Selector != bc.DefaultCoinSelector.Name() || selection.Total < 5 || selection.Change != selection.Total-5 {
+		t.Errorf("selection %+v, want the default selector's", selection)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	f := newFixture(t)
+	payee := string(f.payee.Address())
+	unknown := strings.Repeat("ab", 32)
+	utxoKey := hex.EncodeToString(append([]byte("utxo-"), f.txs[0].Id...)) + "00000000"
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/blocks/" + unknown, http.StatusNotFound},
+		{"/blocks/" + hex.EncodeToString([]byte("lh")), http.StatusNotFound},
+		{"/blocks/" + utxoKey, http.StatusNotFound},
+		{"/blocks/" + hex.EncodeToString(append([]byte("tx-"), f.txs[0].Id...)), http.StatusNotFound},
+		{"/blocks/", http.StatusNotFound},
+		{"/blocks/zz", http.StatusBadRequest},
+		{"/blocks/height/5", http.StatusNotFound},
+		{"/blocks/height/-1", http.StatusBadRequest},
+		{"/blocks/height/one", http.StatusBadRequest},
+		{"/tx/" + unknown, http.StatusNotFound},
+		{"/tx/" + hex.EncodeToString(f.blocks[0].Hash), http.StatusNotFound},
+		{"/tx/xyz", http.StatusBadRequest},
+		{"/address/zz/utxos", http.StatusBadRequest},
+		{"/address/" + payee + "/history?limit=0", http.StatusBadRequest},
+		{"/address/" + payee + "/history?limit=" + fmt.Sprint(MaxLimit+1), http.StatusBadRequest},
+		{"/address/" + payee + "/utxos?offset=-1", http.StatusBadRequest},
+		{"/address/" + payee + "/selectcoins", http.StatusBadRequest},
+		{"/address/" + payee + "/selectcoins?amount=0", http.StatusBadRequest},
+		{"/address/" + payee + "/selectcoins?amount=5&selector=nosuch", http.StatusBadRequest},
+		{"/address/" + payee + "/selectcoins?amount=31", http.StatusUnprocessableEntity},
+		{"/address/" + payee + "/balance", http.StatusNotFound},
+		{"/nope", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		var reply errorBody
+		if status := f.get(t, tt.path, &reply); status != tt.status || reply.Error == "" {
+			t.Errorf("%s: status %d with error %q, want %d", tt.path, status, reply.Error, tt.status)
+		}
+	}
+
+	resp, err := http.Post(f.server.URL+"/blocks/height/0", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodGet {
+		t.Errorf("POST: status %d, Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
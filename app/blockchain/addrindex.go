@@ -0,0 +1,274 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+// The address index has a key for every transaction on the main chain that
+// pays to or spends from a public key or script hash:
+// addrPrefix + hash + big-endian height + big-endian position in the block ->
+// amount received + amount sent, 8 bytes each, + block hash.
+// It is kept up to date with the UTXO set once addrIndexKey marks it built.
+const (
+	addrPrefix   = "addr-"
+	addrIndexKey = "addrindex"
+	heightLength = 4
+	amountLength = 8
+)
+
+var ErrBadAddressIndex = errors.New("address index entry is malformed")
+
+func addrKey(pubKeyHash []byte, height, position int) []byte {
+	key := append([]byte(addrPrefix), pubKeyHash...)
+	key = append(key, make([]byte, heightLength+indexLength)...)
+	binary.BigEndian.PutUint32(key[len(key)-heightLength-indexLength:], uint32(height))
+	binary.BigEndian.PutUint32(key[len(key)-indexLength:], uint32(position))
+
+	return key
+}
+
+func parseAddrKey(key []byte) (int, int) {
+	height := binary.BigEndian.Uint32(key[len(key)-heightLength-indexLength:])
+	position := binary.BigEndian.Uint32(key[len(key)-indexLength:])
+
+	return int(height), int(position)
+}
+
+// addrEntries returns the index entries of a block on the main chain, given
+// the outputs it spent.
+func addrEntries(block *Block, undo []TxOutput) map[string][]byte {
+	entries := make(map[string][]byte)
+	spent := 0
+
+	for position, tx := range block.Transactions {
+		received := make(map[string]int)
+		sent := make(map[string]int)
+
+		for _, out := range tx.Outputs {
+			if hash, ok := out.ScriptPubKey.Hash(); ok {
+				received[string(hash)] += out.Value
+			}
+		}
+		if !tx.IsCoinbase() {
+			for range tx.Inputs {
+				if spent < len(undo) {
+					if hash, ok := undo[spent].ScriptPubKey.Hash(); ok {
+						sent[string(hash)] += undo[spent].Value
+					}
+				}
+				spent++
+			}
+		}
+
+		for hash := range sent {
+			if _, ok := received[hash]; !ok {
+				received[hash] = 0
+			}
+		}
+		for hash, value := range received {
+			entry := make([]byte, 2*amountLength, 2*amountLength+len(block.Hash))
+			binary.BigEndian.PutUint64(entry, uint64(value))
+			binary.BigEndian.PutUint64(entry[amountLength:], uint64(sent[hash]))
+			entries[string(addrKey([]byte(hash), block.Height, position))] = append(entry, block.Hash...)
+		}
+	}
+
+	return entries
+}
+
+// indexAddresses adds a block connected to the main chain to the index.
+func indexAddresses(txn *badger.Txn, block *Block, undo []TxOutput) error {
+	for key, entry := range addrEntries(block, undo) {
+		if err := txn.Set([]byte(key), entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexAddresses removes a block disconnected from the main chain.
+func unindexAddresses(txn *badger.Txn, block *Block, undo []TxOutput) error {
+	for key := range addrEntries(block, undo) {
+		if err := txn.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indexAllAddresses builds the address index. What each block spent comes
+// from its undo data, so it is read before the block is indexed.
+func (ch *BlockChain) indexAllAddresses() error {
+	return ch.buildIndex(addrIndexKey, addrPrefix, func(block *Block) error {
+		undo, err := ch.undoData(block)
+		if err != nil {
+			return err
+		}
+
+		return ch.Database.Update(func(txn *badger.Txn) error {
+			return indexAddresses(txn, block, undo)
+		})
+	})
+}
+
+// UsedPubKeyHashes returns every public key or script hash that has an entry
+// in the address index, as hex strings: each has been paid on the main chain.
+func (ch *BlockChain) UsedPubKeyHashes() (map[string]bool, error) {
+	used := make(map[string]bool)
+
+	err := ch.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(addrPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().Key()
+			if len(key) <= len(prefix)+heightLength+indexLength {
+				continue
+			}
+			used[hex.EncodeToString(key[len(prefix):len(key)-heightLength-indexLength])] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return used, nil
+}
+
+// HistoryEntry is a transaction on the main chain that pays to or spends from
+// an address, with what it did for the address.
+type HistoryEntry struct {
+	Transaction *Transaction
+	BlockHash   []byte
+	Height      int
+	Received    int
+	Sent        int
+	// Counterparties are the addresses paid by a transaction that spends
+	// from the address, or else those that paid the address.
+	Counterparties []string
+}
+
+// AddressHistory returns up to limit transactions that credit or debit
+// pubKeyHash, newest first, skipping the first offset of them, along with how
+// many there are in all.
+func (ch *BlockChain) AddressHistory(pubKeyHash []byte, offset, limit int) ([]HistoryEntry, int, error) {
+	type indexed struct {
+		height, position int
+		entry            []byte
+	}
+	var page []indexed
+	total := 0
+
+	err := ch.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := append([]byte(addrPrefix), pubKeyHash...)
+		for it.Seek(append(append([]byte{}, prefix...), 0xff)); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if len(item.Key()) != len(prefix)+heightLength+indexLength {
+				continue
+			}
+			if total >= offset && len(page) < limit {
+				entry, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				height, position := parseAddrKey(item.Key())
+				page = append(page, indexed{height, position, entry})
+			}
+			total++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	history := make([]HistoryEntry, 0, len(page))
+	blocks := make(map[string]*Block)
+	for _, p := range page {
+		if len(p.entry) < 2*amountLength {
+			return nil, 0, ErrBadAddressIndex
+		}
+		blockHash := p.entry[2*amountLength:]
+
+		block, ok := blocks[string(blockHash)]
+		if !ok {
+			b, err := ch.GetBlock(blockHash)
+			if err != nil {
+				return nil, 0, err
+			}
+			block = &b
+			blocks[string(blockHash)] = block
+		}
+		if p.position >= len(block.Transactions) {
+			return nil, 0, fmt.Errorf("%w: block %x has no transaction %d", ErrBadAddressIndex, blockHash, p.position)
+		}
+
+		entry := HistoryEntry{
+			Transaction: block.Transactions[p.position],
+			BlockHash:   blockHash,
+			Height:      p.height,
+			Received:    int(binary.BigEndian.Uint64(p.entry)),
+			Sent:        int(binary.BigEndian.Uint64(p.entry[amountLength:])),
+		}
+		entry.Counterparties = counterparties(entry.Transaction, pubKeyHash, entry.Sent > 0)
+		history = append(history, entry)
+	}
+
+	return history, total, nil
+}
+
+// counterparties returns the addresses other than pubKeyHash that a
+// transaction pays if sending, or else the addresses its inputs spend from.
+func counterparties(tx *Transaction, pubKeyHash []byte, sending bool) []string {
+	var addresses []string
+	seen := make(map[string]bool)
+	add := func(address []byte) {
+		if !seen[string(address)] {
+			seen[string(address)] = true
+			addresses = append(addresses, string(address))
+		}
+	}
+
+	if sending {
+		for _, out := range tx.Outputs {
+			if out.IsLockedWithKey(pubKeyHash) {
+				continue
+			}
+			if address, ok := out.ScriptPubKey.Address(); ok {
+				add(address)
+			}
+		}
+		return addresses
+	}
+
+	if tx.IsCoinbase() {
+		return addresses
+	}
+	for _, in := range tx.Inputs {
+		if in.UsesKey(pubKeyHash) {
+			continue
+		}
+		if address, ok := in.Address(); ok {
+			add(address)
+		}
+	}
+
+	return addresses
+}
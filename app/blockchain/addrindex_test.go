@@ -0,0 +1,49 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+// TestUsedPubKeyHashes checks that the hashes read from the address index
+// are those the main chain pays to, before and after the index is rebuilt.
+func TestUsedPubKeyHashes(t *testing.T) {
+	owner := newTestWallet(t)
+	payee := newTestWallet(t)
+	chain := newTestChain(t, owner, 1)
+
+	tx, err := NewTransaction(owner, string(payee.Address()), 30, Fee{}, nil, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.MineBlock(string(owner.Address()), []*Transaction{tx}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{
+		hex.EncodeToString(wallet.PublicKeyHash(owner.PublicKey)): true,
+		hex.EncodeToString(wallet.PublicKeyHash(payee.PublicKey)): true,
+	}
+
+	used, err := chain.UsedPubKeyHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(used, want) {
+		t.Errorf("UsedPubKeyHashes = %v, want %v", used, want)
+	}
+
+	if err := chain.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	used, err = chain.UsedPubKeyHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(used, want) {
+		t.Errorf("after Reindex, UsedPubKeyHashes = %v, want %v", used, want)
+	}
+}
@@ -2,26 +2,41 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"os"
-	"runtime"
+	"sync"
 
 	"github.com/dgraph-io/badger"
+	"github.com/serj1c/blockchainio/app/merkle"
 )
 
-const (
-	dbPath      = "./tmp/blocks"
-	dbFile      = "./tmp/blocks/MANIFEST"
-	genesisData = "First Transaction from Genesis"
+const genesisData = "First Transaction from Genesis"
+
+var (
+	ErrChainExists   = errors.New("blockchain already exists")
+	ErrChainNotFound = errors.New("no existing blockchain found")
+	ErrBlockNotFound = errors.New("block is not found")
+	ErrTxNotFound    = errors.New("transaction does not exist")
 )
 
 type BlockChain struct {
 	LastHash []byte
 	Database *badger.DB
+	// Reward is the subsidy a mined block's coinbase may claim on top of fees.
+	Reward int
+	// Miner does the proof of work for MineBlock and MineBlockContext.
+	Miner Miner
+	// OnReorg, if set, is called after the tip has moved to another branch
+	// with the blocks taken off the old branch and those put on in their
+	// place, both oldest first.
+	OnReorg func(disconnected, connected []*Block)
+
+	mu sync.Mutex
 }
 
 type Iterator struct {
@@ -29,238 +44,580 @@ type Iterator struct {
 	Database    *badger.DB
 }
 
-func InitBlockChain(address string) *BlockChain {
-	var lastHash []byte
+// InitBlockChain creates a new chain in the directory path with a genesis
+// block paying to address. It fails with ErrChainExists if there already is
+// a chain in path.
+func InitBlockChain(address, path string) (*BlockChain, error) {
+	if DbExists(path) {
+		return nil, fmt.Errorf("%w in %s", ErrChainExists, path)
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
 
-	if DbExists() {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+	db, err := openDB(path)
+	if err != nil {
+		return nil, err
 	}
 
-	opts := badger.DefaultOptions(dbPath)
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
+	chain := &BlockChain{Database: db, Reward: DefaultReward}
 
-	db, err := badger.Open(opts)
+	cbtx, err := CoinbaseTx(address, genesisData, chain.Reward)
 	if err != nil {
-		log.Panic(err)
+		db.Close()
+		return nil, err
 	}
+	firstBlock := FirstBlock(cbtx)
 
 	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData)
-		firstBlock := FirstBlock(cbtx)
-		fmt.Println("First block created")
-		err = txn.Set(firstBlock.Hash, firstBlock.Serialize())
+		err := chain.storeBlock(txn, firstBlock, blockWork(&firstBlock.BlockHeader))
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
 		err = txn.Set([]byte("lh"), firstBlock.Hash)
-		lastHash = firstBlock.Hash
-		return err
+		if err != nil {
+			return err
+		}
+
+		err = txn.Set([]byte(addrIndexKey), []byte{1})
+		if err != nil {
+			return err
+		}
 
+		err = txn.Set([]byte(txIndexKey), []byte{1})
+		if err != nil {
+			return err
+		}
+
+		err = txn.Set([]byte(ownerIndexKey), []byte{1})
+		if err != nil {
+			return err
+		}
+
+		return chain.updateUTxO(txn, firstBlock)
 	})
 	if err != nil {
-		log.Panic(err)
+		db.Close()
+		return nil, err
 	}
 
-	return &BlockChain{
-		LastHash: lastHash,
-		Database: db,
-	}
+	chain.LastHash = firstBlock.Hash
+
+	return chain, nil
 }
 
-func ContinueBlockChain(address string) *BlockChain {
-	if DbExists() == false {
-		fmt.Println("No existing blockchain found")
-		runtime.Goexit()
+// ContinueBlockChain opens the chain in the directory path. It fails with
+// ErrChainNotFound if there is none. Only the proof of work of the tip is
+// checked: the blocks were validated as they were added, and indexes missing
+// from an older database are built from them as they are. ValidateChain, the
+// validatechain command, checks a stored chain in full, and Reindex runs it
+// before rebuilding anything.
+func ContinueBlockChain(path string) (*BlockChain, error) {
+	if DbExists(path) == false {
+		return nil, fmt.Errorf("%w in %s", ErrChainNotFound, path)
 	}
 
 	var lastHash []byte
 
-	opts := badger.DefaultOptions(dbPath)
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
-
-	db, err := badger.Open(opts)
+	db, err := openDB(path)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	err = db.Update(func(txn *badger.Txn) error {
+	err = db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
 		if err != nil {
-			log.Panic(err)
+			return fmt.Errorf("reading the tip: %w", err)
 		}
 		lastHash, err = item.ValueCopy(lastHash)
 
 		return err
 	})
 	if err != nil {
-		log.Panic(err)
+		db.Close()
+		return nil, err
 	}
 
-	chain := BlockChain{
+	chain := &BlockChain{
 		LastHash: lastHash,
 		Database: db,
+		Reward:   DefaultReward,
 	}
-	return &chain
+
+	tip, err := chain.GetBlock(lastHash)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if !NewProof(&tip.BlockHeader).Validate() {
+		db.Close()
+		return nil, &BlockError{Hash: tip.Hash, Err: ErrInvalidPoW}
+	}
+	if err := chain.indexWork(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := chain.indexAllOwners(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := chain.indexAllAddresses(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := chain.indexAllTransactions(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return chain, nil
 }
 
-func (ch *BlockChain) FindUnspentTransactions(pubKeyHash []byte) []Transaction {
-	var unspentTxs []Transaction
+func openDB(path string) (*badger.DB, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Dir = path
+	opts.ValueDir = path
 
-	spentTxOs := make(map[string][]int)
+	return badger.Open(opts)
+}
 
-	iter := ch.Iterator()
+// MineBlock mines a new block with the given transactions on top of the
+// current tip and stores it. The block starts with a coinbase paying the
+// reward and the collected fees to minerAddress.
+func (ch *BlockChain) MineBlock(minerAddress string, transactions []*Transaction) (*Block, error) {
+	return ch.MineBlockContext(context.Background(), minerAddress, transactions)
+}
 
-	for {
-		block := iter.Next()
+// MineBlockContext is MineBlock using ch.Miner for the proof of work. It
+// gives up with ctx.Err() when ctx is done first, for instance because a
+// competing block has arrived.
+func (ch *BlockChain) MineBlockContext(ctx context.Context, minerAddress string, transactions []*Transaction) (*Block, error) {
+	for _, tx := range transactions {
+		if tx.IsCoinbase() {
+			return nil, &BlockError{TxId: tx.Id, Err: ErrMultipleCoinbase}
+		}
+		if ch.VerifyTransaction(tx) != true {
+			return nil, &BlockError{TxId: tx.Id, Err: ErrInvalidSignature}
+		}
+	}
 
-		for _, tx := range block.Transactions {
-			txId := hex.EncodeToString(tx.Id)
-
-		Outputs:
-			for outIdx, out := range tx.Outputs {
-				if spentTxOs[txId] != nil {
-					for _, spentOut := range spentTxOs[txId] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
-				}
-				if out.IsLockedWithKey(pubKeyHash) {
-					unspentTxs = append(unspentTxs, *tx)
-				}
+	lastHash := ch.Tip()
+
+	lastBlock, err := ch.GetBlock(lastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	fees, err := ch.BlockFees(lastHash, transactions)
+	if err != nil {
+		return nil, err
+	}
+	cbTx, err := CoinbaseTx(minerAddress, "", ch.Reward+fees)
+	if err != nil {
+		return nil, err
+	}
+	transactions = append([]*Transaction{cbTx}, transactions...)
+
+	difficulty := ch.NextDifficulty(&lastBlock)
+	newBlock := newBlockTemplate(transactions, lastHash, lastBlock.Height+1, difficulty)
+
+	nonce, hash, err := ch.Miner.Run(ctx, NewProof(&newBlock.BlockHeader))
+	if err != nil {
+		return nil, err
+	}
+	newBlock.Nonce = nonce
+	newBlock.Hash = hash
+
+	if err := ch.AddBlock(newBlock); err != nil {
+		return nil, err
+	}
+
+	return newBlock, nil
+}
+
+// AddBlock validates and stores a block received from elsewhere; invalid
+// blocks are refused with a *BlockError. Blocks on top of the tip are checked
+// in full and extend the chain. Blocks on another branch only get their header
+// and Merkle root checked and are kept until their branch has more work than
+// the current one, at which point the chain reorganizes onto it.
+func (ch *BlockChain) AddBlock(block *Block) error {
+	ch.mu.Lock()
+	disconnected, connected, err := ch.addBlock(block)
+	ch.mu.Unlock()
+
+	if len(connected) > 0 && ch.OnReorg != nil {
+		ch.OnReorg(disconnected, connected)
+	}
+
+	return err
+}
+
+func (ch *BlockChain) addBlock(block *Block) ([]*Block, []*Block, error) {
+	if ch.HasBlock(block.Hash) {
+		return nil, nil, nil
+	}
+
+	if bytes.Equal(block.PrevHash, ch.LastHash) {
+		if err := ch.ValidateBlock(block); err != nil {
+			return nil, nil, err
+		}
+
+		work, err := ch.ChainWork(block.PrevHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		work.Add(work, blockWork(&block.BlockHeader))
+
+		err = ch.Database.Update(func(txn *badger.Txn) error {
+			if err := ch.storeBlock(txn, block, work); err != nil {
+				return err
 			}
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Inputs {
-					if in.UsesKey(pubKeyHash) {
-						inTxId := hex.EncodeToString(in.Id)
-						spentTxOs[inTxId] = append(spentTxOs[inTxId], in.Out)
-					}
-				}
+			if err := txn.Set([]byte("lh"), block.Hash); err != nil {
+				return err
 			}
+			return ch.updateUTxO(txn, block)
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		ch.LastHash = block.Hash
+
+		return nil, nil, nil
+	}
+
+	var parent *Block
+	if len(block.PrevHash) > 0 {
+		if parent = ch.parentOf(block); parent == nil {
+			return nil, nil, &BlockError{Hash: block.Hash, Err: ErrUnknownParent}
 		}
+	}
+	if err := ch.validateStructure(block, parent); err != nil {
+		return nil, nil, &BlockError{Hash: block.Hash, Err: err}
+	}
+
+	work, err := ch.ChainWork(block.PrevHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	work.Add(work, blockWork(&block.BlockHeader))
+
+	err = ch.Database.Update(func(txn *badger.Txn) error {
+		return ch.storeBlock(txn, block, work)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tipWork, err := ch.ChainWork(ch.LastHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if work.Cmp(tipWork) <= 0 {
+		return nil, nil, nil
+	}
+
+	return ch.reorganize(block)
+}
+
+func (ch *BlockChain) HasBlock(blockHash []byte) bool {
+	if len(blockHash) != sha256.Size {
+		return false
+	}
+
+	err := ch.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(blockHash)
+		return err
+	})
+
+	return err == nil
+}
+
+// GetBlock returns the stored block with the given hash, whether it is on the
+// main chain or not. Anything other than a block hash gives ErrBlockNotFound.
+func (ch *BlockChain) GetBlock(blockHash []byte) (Block, error) {
+	var block Block
+
+	// Blocks are stored under their hash, next to keys of other lengths
+	// such as "lh" or those of the indexes.
+	if len(blockHash) != sha256.Size {
+		return block, fmt.Errorf("%w: %x", ErrBlockNotFound, blockHash)
+	}
+
+	err := ch.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(blockHash)
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("%w: %x", ErrBlockNotFound, blockHash)
+		}
+		if err != nil {
+			return err
+		}
+		blockData, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		decoded, err := Deserialize(blockData)
+		if err != nil {
+			return err
+		}
+		block = *decoded
+
+		return nil
+	})
+
+	return block, err
+}
+
+// GetBlockHashes returns the hashes of all blocks in the chain, from the tip
+// back to the genesis block.
+func (ch *BlockChain) GetBlockHashes() ([][]byte, error) {
+	var blocks [][]byte
+
+	iter := ch.Iterator()
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, block.Hash)
+
 		if len(block.PrevHash) == 0 {
 			break
 		}
 	}
-	return unspentTxs
+
+	return blocks, nil
 }
 
-func (ch *BlockChain) FindUTxO(pubKeyHash []byte) []TxOutput {
-	var UTXOs []TxOutput
-	unspentTransactions := ch.FindUnspentTransactions(pubKeyHash)
+// BlockLocator describes the chain ending at blockHash to a peer, for it to
+// find the last block its main chain shares with that chain: the hashes of the
+// ten newest blocks, then of blocks ever further apart, down to the genesis
+// block.
+func (ch *BlockChain) BlockLocator(blockHash []byte) ([][]byte, error) {
+	var locator [][]byte
+
+	iter := &Iterator{CurrentHash: blockHash, Database: ch.Database}
+	step, skip := 1, 0
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 
-	for _, tx := range unspentTransactions {
-		for _, out := range tx.Outputs {
-			if out.IsLockedWithKey(pubKeyHash) {
-				UTXOs = append(UTXOs, out)
+		if skip == 0 || len(block.PrevHash) == 0 {
+			locator = append(locator, block.Hash)
+			if len(locator) >= 10 {
+				step *= 2
 			}
+			skip = step
+		}
+		skip--
+
+		if len(block.PrevHash) == 0 {
+			break
 		}
 	}
-	return UTXOs
-}
 
-func (ch *BlockChain) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOuts := make(map[string][]int)
-	unspentTxs := ch.FindUnspentTransactions(pubKeyHash)
-	accumulated := 0
+	return locator, nil
+}
 
-Work:
-	for _, tx := range unspentTxs {
-		txId := hex.EncodeToString(tx.Id)
+// BlocksAfter returns the hashes of at most limit blocks of the main chain
+// following the first block of the locator that is on it, or following no
+// block at all, starting from genesis, if none is. Like GetBlockHashes it
+// lists them newest first.
+func (ch *BlockChain) BlocksAfter(locator [][]byte, limit int) ([][]byte, error) {
+	hashes, err := ch.GetBlockHashes()
+	if err != nil {
+		return nil, err
+	}
 
-		for outIdx, out := range tx.Outputs {
-			if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-				accumulated += out.Value
-				unspentOuts[txId] = append(unspentOuts[txId], outIdx)
+	position := make(map[string]int, len(hashes))
+	for i, hash := range hashes {
+		position[string(hash)] = i
+	}
 
-				if accumulated >= amount {
-					break Work
-				}
-			}
+	start := len(hashes)
+	for _, hash := range locator {
+		if i, ok := position[string(hash)]; ok {
+			start = i
+			break
 		}
 	}
+	end := start - limit
+	if end < 0 {
+		end = 0
+	}
 
-	return accumulated, unspentOuts
+	return hashes[end:start], nil
 }
 
-func (ch *BlockChain) AddBlock(transactions []*Transaction) {
+func (ch *BlockChain) GetBestHeight() (int, error) {
 	var lastHash []byte
 
 	err := ch.Database.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		lastHash, err = item.ValueCopy(lastHash)
+		lastHash, err = item.ValueCopy(nil)
+
 		return err
 	})
 	if err != nil {
-		log.Panic(err)
+		return 0, err
 	}
 
-	newBlock := CreateBlock(transactions, lastHash)
+	lastBlock, err := ch.GetBlock(lastHash)
+	if err != nil {
+		return 0, err
+	}
 
-	err = ch.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		if err != nil {
-			log.Panic(err)
-		}
-		err = txn.Set([]byte("lh"), newBlock.Hash)
+	return lastBlock.Height, nil
+}
 
-		ch.LastHash = newBlock.Hash
+// GetBlockByHeight returns the block at the given height on the main chain.
+func (ch *BlockChain) GetBlockByHeight(height int) (Block, error) {
+	iter := ch.Iterator()
 
-		return err
-	})
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return Block{}, err
+		}
 
-	if err != nil {
-		log.Panic(err)
+		if block.Height == height {
+			return *block, nil
+		}
+		if block.Height < height || len(block.PrevHash) == 0 {
+			return Block{}, fmt.Errorf("%w at height %d", ErrBlockNotFound, height)
+		}
 	}
 }
 
-func DbExists() bool {
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+func DbExists(path string) bool {
+	if _, err := os.Stat(path + "/MANIFEST"); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
+// Tip returns the hash of the last block of the main chain. Other goroutines
+// than the one adding blocks must use it rather than read LastHash.
+func (ch *BlockChain) Tip() []byte {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.LastHash
+}
+
+// Iterator walks the main chain from the tip down. It takes the lock to read
+// the tip, so it must not be used while adding a block.
 func (ch *BlockChain) Iterator() *Iterator {
 	return &Iterator{
-		CurrentHash: ch.LastHash,
+		CurrentHash: ch.Tip(),
 		Database:    ch.Database,
 	}
 }
 
-func (it *Iterator) Next() *Block {
+// Next returns the current block and moves on to its parent. Check the
+// returned block's PrevHash to stop at the genesis block.
+func (it *Iterator) Next() (*Block, error) {
 	var block *Block
 
 	err := it.Database.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(it.CurrentHash)
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("%w: %x", ErrBlockNotFound, it.CurrentHash)
+		}
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 		encodedBlock, err := item.ValueCopy(nil)
-		block = Deserialize(encodedBlock)
+		if err != nil {
+			return err
+		}
+		block, err = Deserialize(encodedBlock)
 		return err
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
 	it.CurrentHash = block.PrevHash
 
-	return block
+	return block, nil
+}
+
+// FindTransactionBlock returns the block on the main chain that holds the
+// transaction with the given id.
+func (ch *BlockChain) FindTransactionBlock(Id []byte) (*Block, error) {
+	blockHash, _, err := ch.TransactionLocation(Id)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ch.GetBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &block, nil
+}
+
+// TransactionProof returns the header of the block holding a transaction and
+// the Merkle proof that the transaction is in it.
+func (ch *BlockChain) TransactionProof(Id []byte) (*BlockHeader, *merkle.Proof, error) {
+	block, err := ch.FindTransactionBlock(Id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proof, err := block.MerkleProof(Id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &block.BlockHeader, proof, nil
 }
 
+// FindTransaction looks up a transaction on the main chain in the
+// transaction index.
 func (ch *BlockChain) FindTransaction(Id []byte) (Transaction, error) {
-	iterator := ch.Iterator()
+	blockHash, position, err := ch.TransactionLocation(Id)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	block, err := ch.GetBlock(blockHash)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if position >= len(block.Transactions) || !bytes.Equal(block.Transactions[position].Id, Id) {
+		return Transaction{}, fmt.Errorf("%w: %x", ErrBadTxIndex, Id)
+	}
+
+	return *block.Transactions[position], nil
+}
+
+// findTransactionFrom looks for a transaction in the chain ending at the
+// block with the given hash, using the index if that is the main chain.
+func (ch *BlockChain) findTransactionFrom(blockHash, Id []byte) (Transaction, error) {
+	if len(blockHash) == 0 {
+		return Transaction{}, fmt.Errorf("%w: %x", ErrTxNotFound, Id)
+	}
+	if bytes.Equal(blockHash, ch.LastHash) {
+		return ch.FindTransaction(Id)
+	}
+	iterator := &Iterator{CurrentHash: blockHash, Database: ch.Database}
 
 	for {
-		block := iterator.Next()
+		block, err := iterator.Next()
+		if err != nil {
+			return Transaction{}, err
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.Id, Id) == 0 {
@@ -272,30 +629,34 @@ func (ch *BlockChain) FindTransaction(Id []byte) (Transaction, error) {
 			break
 		}
 	}
-	return Transaction{}, errors.New("transaction does not exist")
+	return Transaction{}, fmt.Errorf("%w: %x", ErrTxNotFound, Id)
 }
 
-func (ch *BlockChain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
+func (ch *BlockChain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) error {
 	prevTxs := make(map[string]Transaction)
 
 	for _, input := range tx.Inputs {
 		prevTx, err := ch.FindTransaction(input.Id)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 		prevTxs[hex.EncodeToString(prevTx.Id)] = prevTx
 	}
 
-	tx.Sign(privateKey, prevTxs)
+	return tx.Sign(privateKey, prevTxs)
 }
 
 func (ch *BlockChain) VerifyTransaction(tx *Transaction) bool {
+	if tx.IsCoinbase() {
+		return true
+	}
+
 	prevTxs := make(map[string]Transaction)
 
 	for _, input := range tx.Inputs {
 		prevTx, err := ch.FindTransaction(input.Id)
 		if err != nil {
-			log.Panic(err)
+			return false
 		}
 		prevTxs[hex.EncodeToString(prevTx.Id)] = prevTx
 	}
@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBlockLocator(t *testing.T) {
+	owner := newTestWallet(t)
+	chain := newTestChain(t, owner, 24)
+
+	hashes, err := chain.GetBlockHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	locator, err := chain.BlockLocator(chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Heights 24 to 15 one by one, then 13, 9, 1 and the genesis block.
+	var want [][]byte
+	for _, height := range []int{24, 23, 22, 21, 20, 19, 18, 17, 16, 15, 13, 9, 1, 0} {
+		want = append(want, hashes[len(hashes)-1-height])
+	}
+	if len(locator) != len(want) {
+		t.Fatalf("locator has %d hashes, want %d", len(locator), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(locator[i], want[i]) {
+			t.Errorf("locator entry %d is %x, want %x", i, locator[i], want[i])
+		}
+	}
+}
+
+func TestBlocksAfter(t *testing.T) {
+	owner := newTestWallet(t)
+	chain := newTestChain(t, owner, 6)
+
+	hashes, err := chain.GetBlockHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(height int) []byte {
+		return hashes[len(hashes)-1-height]
+	}
+	genesis, err := chain.GetBlock(at(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	side := blockOn(t, chain, &genesis, string(owner.Address()))
+	addBlock(t, chain, side)
+
+	tests := []struct {
+		name    string
+		locator [][]byte
+		limit   int
+		from    int
+		to      int
+	}{
+		{"from a main chain block", [][]byte{at(2)}, 10, 3, 6},
+		{"limited", [][]byte{at(2)}, 2, 3, 4},
+		{"first known hash counts", [][]byte{[]byte("unknown"), side.Hash, at(4), at(1)}, 10, 5, 6},
+		{"side branch only", [][]byte{side.Hash}, 10, 0, 6},
+		{"empty locator", nil, 3, 0, 2},
+		{"at the tip", [][]byte{at(6)}, 10, 7, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := chain.BlocksAfter(tt.locator, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want [][]byte
+			for height := tt.to; height >= tt.from; height-- {
+				want = append(want, at(height))
+			}
+			if len(got) != len(want) {
+				t.Fatalf("got %d hashes, want heights %d to %d", len(got), tt.from, tt.to)
+			}
+			for i := range want {
+				if !bytes.Equal(got[i], want[i]) {
+					t.Errorf("hash %d is %x, want %x", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
@@ -4,25 +4,43 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/gob"
-	"log"
+	"fmt"
+	"time"
+
+	"github.com/serj1c/blockchainio/app/merkle"
 )
 
+// BlockVersion is the header version of the blocks this code creates.
+const BlockVersion = 1
+
+// MaxBlockSize is the most bytes the transactions of a block may take, each
+// counted by its Size.
+const MaxBlockSize = 1 << 20
+
+// BlockHeader is the part of a block the proof of work is computed over. It
+// commits to the transactions through MerkleRoot, so a header can be checked
+// on its own without the transaction list.
+type BlockHeader struct {
+	Version    int32
+	PrevHash   []byte
+	MerkleRoot []byte
+	Timestamp  int64
+	// Difficulty is the number of leading zero bits the block hash needs.
+	Difficulty int
+	Nonce      int
+	Height     int
+}
+
 type Block struct {
+	BlockHeader
 	Hash         []byte
 	Transactions []*Transaction
-	PrevHash     []byte
-	Nonce        int
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte) *Block {
-	block := &Block{
-		Hash:         []byte{},
-		Transactions: txs,
-		PrevHash:     prevHash,
-		Nonce:        0,
-	}
+func CreateBlock(txs []*Transaction, prevHash []byte, height, difficulty int) *Block {
+	block := newBlockTemplate(txs, prevHash, height, difficulty)
 
-	pow := NewProof(block)
+	pow := NewProof(&block.BlockHeader)
 	nonce, hash := pow.Run()
 
 	block.Hash = hash[:]
@@ -31,41 +49,95 @@ func CreateBlock(txs []*Transaction, prevHash []byte) *Block {
 	return block
 }
 
+// newBlockTemplate assembles a block that still needs its proof of work.
+func newBlockTemplate(txs []*Transaction, prevHash []byte, height, difficulty int) *Block {
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:    BlockVersion,
+			PrevHash:   prevHash,
+			Timestamp:  time.Now().Unix(),
+			Difficulty: difficulty,
+			Nonce:      0,
+			Height:     height,
+		},
+		Hash:         []byte{},
+		Transactions: txs,
+	}
+	block.MerkleRoot = block.HashTransactions()
+
+	return block
+}
+
 func FirstBlock(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{})
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, InitialDifficulty)
 }
 
+// Hash returns the hash of the header, which is the hash of the block.
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(NewProof(h).InitData(h.Nonce))
+
+	return hash[:]
+}
+
+// HashTransactions returns the root of the Merkle tree over the ids of the
+// block's transactions.
 func (b *Block) HashTransactions() []byte {
+	return b.merkleTree().Root()
+}
+
+// MerkleProof returns the proof that the transaction with the given id is in
+// the block.
+func (b *Block) MerkleProof(txId []byte) (*merkle.Proof, error) {
+	for i, tx := range b.Transactions {
+		if bytes.Equal(tx.Id, txId) {
+			return b.merkleTree().Proof(i)
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %x is not in the block", ErrTxNotFound, txId)
+}
+
+func (b *Block) merkleTree() *merkle.Tree {
 	var txHashes [][]byte
-	var txHash [32]byte
 
 	for _, tx := range b.Transactions {
 		txHashes = append(txHashes, tx.Id)
 	}
 
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
-
-	return txHash[:]
+	return merkle.NewTree(txHashes)
 }
 
-func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
+// VerifyTransactionProof checks with nothing but a block header that the
+// transaction with the given id is part of that block.
+func VerifyTransactionProof(header *BlockHeader, txId []byte, proof *merkle.Proof) bool {
+	if !NewProof(header).Validate() {
+		return false
+	}
+
+	return merkle.Verify(header.MerkleRoot, txId, proof)
+}
 
-	if err := encoder.Encode(b); err != nil {
-		log.Panic(err)
+// TxSize adds up the sizes of the transactions of the block.
+func (b *Block) TxSize() int {
+	size := 0
+	for _, tx := range b.Transactions {
+		size += tx.Size()
 	}
 
-	return res.Bytes()
+	return size
+}
+
+func (b *Block) Serialize() []byte {
+	return encode(b)
 }
 
-func Deserialize(data []byte) *Block {
+func Deserialize(data []byte) (*Block, error) {
 	var block Block
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 
 	if err := decoder.Decode(&block); err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("decoding block: %w", err)
 	}
 
-	return &block
+	return &block, nil
 }
@@ -0,0 +1,232 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrUnknownCoinSelector = errors.New("unknown coin selector")
+
+// CoinSelector picks which unspent outputs a new transaction spends. Select
+// returns coins worth at least target, or fails with ErrInsufficientFunds.
+type CoinSelector interface {
+	Name() string
+	Select(coins []UnspentOutput, target int) ([]UnspentOutput, error)
+}
+
+var (
+	LargestFirst  CoinSelector = largestFirst{}
+	SmallestFirst CoinSelector = smallestFirst{}
+	// RandomImprove picks coins at random and then adds more while that
+	// brings the change closer to the amount paid, so that the change is
+	// about the size of a typical payment.
+	RandomImprove CoinSelector = &randomImprove{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	// BranchAndBound looks for coins adding up to exactly the target so that
+	// no change is needed, and falls back to RandomImprove.
+	BranchAndBound CoinSelector = branchAndBound{maxTries: 100000, fallback: RandomImprove}
+
+	// DefaultCoinSelector is used when no other is asked for.
+	DefaultCoinSelector = BranchAndBound
+)
+
+var coinSelectors = map[string]CoinSelector{}
+
+func init() {
+	RegisterCoinSelector(LargestFirst)
+	RegisterCoinSelector(SmallestFirst)
+	RegisterCoinSelector(RandomImprove)
+	RegisterCoinSelector(BranchAndBound)
+}
+
+// RegisterCoinSelector makes a coin selector available by its name.
+func RegisterCoinSelector(selector CoinSelector) {
+	coinSelectors[selector.Name()] = selector
+}
+
+// CoinSelectorByName returns the registered coin selector called name.
+func CoinSelectorByName(name string) (CoinSelector, error) {
+	selector, ok := coinSelectors[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s, use one of %v", ErrUnknownCoinSelector, name, CoinSelectorNames())
+	}
+
+	return selector, nil
+}
+
+// CoinSelectorNames returns the names of the registered coin selectors.
+func CoinSelectorNames() []string {
+	names := make([]string, 0, len(coinSelectors))
+	for name := range coinSelectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func coinsValue(coins []UnspentOutput) int {
+	value := 0
+	for _, coin := range coins {
+		value += coin.Output.Value
+	}
+
+	return value
+}
+
+func insufficient(coins []UnspentOutput, target int) error {
+	return fmt.Errorf("%w: have %d, need %d", ErrInsufficientFunds, coinsValue(coins), target)
+}
+
+// sortedCoins returns a copy of coins ordered by value, largest first if
+// descending is set.
+func sortedCoins(coins []UnspentOutput, descending bool) []UnspentOutput {
+	sorted := append([]UnspentOutput(nil), coins...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if descending {
+			return sorted[i].Output.Value > sorted[j].Output.Value
+		}
+		return sorted[i].Output.Value < sorted[j].Output.Value
+	})
+
+	return sorted
+}
+
+// takeUntil returns the first coins that together reach target.
+func takeUntil(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	total := 0
+	for i, coin := range coins {
+		total += coin.Output.Value
+		if total >= target {
+			return coins[:i+1], nil
+		}
+	}
+
+	return nil, insufficient(coins, target)
+}
+
+type largestFirst struct{}
+
+func (largestFirst) Name() string { return "largest-first" }
+
+// Select spends as few coins as possible.
+func (largestFirst) Select(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	return takeUntil(sortedCoins(coins, true), target)
+}
+
+type smallestFirst struct{}
+
+func (smallestFirst) Name() string { return "smallest-first" }
+
+// Select spends the small coins first, consolidating the wallet.
+func (smallestFirst) Select(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	return takeUntil(sortedCoins(coins, false), target)
+}
+
+type branchAndBound struct {
+	maxTries int
+	fallback CoinSelector
+}
+
+func (branchAndBound) Name() string { return "branch-and-bound" }
+
+// Select searches the subsets of the coins, largest coins first, cutting off
+// branches that overshoot the target or can no longer reach it. It gives up
+// after maxTries steps.
+func (s branchAndBound) Select(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	sorted := sortedCoins(coins, true)
+
+	// remaining[i] is the value of the coins from i on.
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Output.Value
+	}
+	if remaining[0] < target {
+		return nil, insufficient(coins, target)
+	}
+
+	var chosen []int
+	tries := 0
+
+	var search func(i, total int) bool
+	search = func(i, total int) bool {
+		tries++
+		if total == target {
+			return true
+		}
+		if total > target || i == len(sorted) || total+remaining[i] < target || tries > s.maxTries {
+			return false
+		}
+
+		chosen = append(chosen, i)
+		if search(i+1, total+sorted[i].Output.Value) {
+			return true
+		}
+		chosen = chosen[:len(chosen)-1]
+
+		return search(i+1, total)
+	}
+
+	if target > 0 && search(0, 0) {
+		selected := make([]UnspentOutput, 0, len(chosen))
+		for _, i := range chosen {
+			selected = append(selected, sorted[i])
+		}
+		return selected, nil
+	}
+
+	return s.fallback.Select(coins, target)
+}
+
+type randomImprove struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func (*randomImprove) Name() string { return "random-improve" }
+
+// Select takes random coins until the target is reached. It then goes on
+// adding random coins as long as each brings the total closer to twice the
+// target without going over three times the target.
+func (s *randomImprove) Select(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	if coinsValue(coins) < target {
+		return nil, insufficient(coins, target)
+	}
+
+	shuffled := append([]UnspentOutput(nil), coins...)
+	s.mu.Lock()
+	s.rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	s.mu.Unlock()
+
+	taken, err := takeUntil(shuffled, target)
+	if err != nil {
+		return nil, err
+	}
+	selected := append([]UnspentOutput(nil), taken...)
+	total := coinsValue(selected)
+
+	ideal, limit := 2*target, 3*target
+	for _, coin := range shuffled[len(selected):] {
+		next := total + coin.Output.Value
+		if next > limit || distance(next, ideal) >= distance(total, ideal) {
+			continue
+		}
+		selected = append(selected, coin)
+		total = next
+	}
+
+	return selected, nil
+}
+
+func distance(a, b int) int {
+	if a > b {
+		return a - b
+	}
+
+	return b - a
+}
@@ -0,0 +1,170 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+func testCoins(values ...int) []UnspentOutput {
+	coins := make([]UnspentOutput, len(values))
+	for i, value := range values {
+		coins[i] = UnspentOutput{TxId: []byte(fmt.Sprintf("tx%d", i)), Index: i, Output: TxOutput{Value: value}}
+	}
+
+	return coins
+}
+
+func TestCoinSelectors(t *testing.T) {
+	// A fixed seed keeps the picks of random-improve the same on every run.
+	random := &randomImprove{rand: rand.New(rand.NewSource(1))}
+	seeded := branchAndBound{maxTries: 100000, fallback: random}
+
+	coins := testCoins(5, 50, 20, 10, 30)
+
+	tests := []struct {
+		name     string
+		selector CoinSelector
+		coins    []UnspentOutput
+		target   int
+		inputs   int
+		change   int
+	}{
+		{"largest-first takes the big coins", LargestFirst, coins, 60, 2, 20},
+		{"largest-first exact match", LargestFirst, coins, 80, 2, 0},
+		{"largest-first everything", LargestFirst, coins, 115, 5, 0},
+		{"smallest-first takes the small coins", SmallestFirst, coins, 60, 4, 5},
+		{"smallest-first exact match", SmallestFirst, coins, 35, 3, 0},
+		{"smallest-first everything", SmallestFirst, coins, 115, 5, 0},
+		{"branch-and-bound exact match", seeded, coins, 60, 2, 0},
+		{"branch-and-bound exact match of small coins", seeded, coins, 15, 2, 0},
+		{"branch-and-bound everything", seeded, coins, 115, 5, 0},
+		{"branch-and-bound falls back without a match", seeded, testCoins(50, 30), 60, 2, 20},
+		{"random-improve everything", random, coins, 115, 5, 0},
+		{"random-improve single coin", random, testCoins(50), 20, 1, 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected, err := tt.selector.Select(tt.coins, tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(selected) != tt.inputs {
+				t.Errorf("selected %d coins, want %d", len(selected), tt.inputs)
+			}
+			if change := coinsValue(selected) - tt.target; change != tt.change {
+				t.Errorf("change is %d, want %d", change, tt.change)
+			}
+		})
+	}
+}
+
+// TestRandomImprove checks that whatever order random-improve draws the coins
+// in, it reaches the target without taking a coin twice.
+func TestRandomImprove(t *testing.T) {
+	coins := testCoins(5, 50, 20, 10, 30, 1, 2, 3, 40, 60)
+
+	for seed := int64(0); seed < 50; seed++ {
+		selector := &randomImprove{rand: rand.New(rand.NewSource(seed))}
+		for _, target := range []int{1, 15, 60, 100, 221} {
+			selected, err := selector.Select(coins, target)
+			if err != nil {
+				t.Fatalf("seed %d, target %d: %s", seed, target, err)
+			}
+
+			seen := make(map[string]bool)
+			for _, coin := range selected {
+				if seen[string(coin.TxId)] {
+					t.Fatalf("seed %d, target %d: coin %s taken twice", seed, target, coin.TxId)
+				}
+				seen[string(coin.TxId)] = true
+			}
+
+			if total := coinsValue(selected); total < target {
+				t.Errorf("seed %d: selected %d for a target of %d", seed, total, target)
+			}
+		}
+	}
+}
+
+func TestCoinSelectorsInsufficientFunds(t *testing.T) {
+	coins := testCoins(5, 50, 20, 10, 30)
+
+	for _, selector := range []CoinSelector{LargestFirst, SmallestFirst, RandomImprove, BranchAndBound} {
+		for _, coins := range [][]UnspentOutput{coins, nil} {
+			if _, err := selector.Select(coins, 116); !errors.Is(err, ErrInsufficientFunds) {
+				t.Errorf("%s with %d coins: Select = %v, want %v", selector.Name(), len(coins), err, ErrInsufficientFunds)
+			}
+		}
+	}
+}
+
+// TestNewTransactionCoinSelection checks that the inputs a selector picks and
+// the change left over end up in the transaction.
+func TestNewTransactionCoinSelection(t *testing.T) {
+	owner := newTestWallet(t)
+	payee := newTestWallet(t)
+	// Three outputs of chain.Reward each.
+	chain := newTestChain(t, owner, 2)
+	reward := chain.Reward
+
+	tests := []struct {
+		selector CoinSelector
+		amount   int
+		fee      int
+		inputs   int
+		change   int
+	}{
+		{LargestFirst, reward + 1, 0, 2, reward - 1},
+		{SmallestFirst, reward + 1, 2, 2, reward - 3},
+		{BranchAndBound, reward + 1, 0, 2, reward - 1},
+		{RandomImprove, reward + 1, 0, 2, reward - 1},
+		{LargestFirst, 2*reward - 5, 5, 2, 0},
+		{SmallestFirst, 2 * reward, 0, 2, 0},
+		{BranchAndBound, 2*reward - 5, 5, 2, 0},
+		// With an exact match random-improve adds a coin to get closer to
+		// twice the target.
+		{RandomImprove, 2 * reward, 0, 3, reward},
+		{LargestFirst, 3 * reward, 0, 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d+%d", tt.selector.Name(), tt.amount, tt.fee), func(t *testing.T) {
+			tx, err := NewTransaction(owner, string(payee.Address()), tt.amount, Fee{Amount: tt.fee}, tt.selector, chain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(tx.Inputs) != tt.inputs {
+				t.Errorf("transaction has %d inputs, want %d", len(tx.Inputs), tt.inputs)
+			}
+			if tx.Outputs[0].Value != tt.amount {
+				t.Errorf("payment is %d, want %d", tx.Outputs[0].Value, tt.amount)
+			}
+
+			change := 0
+			switch len(tx.Outputs) {
+			case 1:
+			case 2:
+				change = tx.Outputs[1].Value
+				if !tx.Outputs[1].IsLockedWithKey(wallet.PublicKeyHash(owner.PublicKey)) {
+					t.Error("change does not go back to the sender")
+				}
+			default:
+				t.Fatalf("transaction has %d outputs", len(tx.Outputs))
+			}
+			if change != tt.change {
+				t.Errorf("change is %d, want %d", change, tt.change)
+			}
+		})
+	}
+
+	if _, err := NewTransaction(owner, string(payee.Address()), 3*reward, Fee{Amount: 1}, LargestFirst, chain); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("NewTransaction = %v, want %v", err, ErrInsufficientFunds)
+	}
+}
@@ -0,0 +1,149 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// InitialDifficulty is the difficulty of the genesis block and of every
+	// block until the first retarget.
+	InitialDifficulty = 12
+	MinDifficulty     = 1
+	MaxDifficulty     = 255
+
+	// Every RetargetInterval blocks the difficulty is adjusted so that blocks
+	// come TargetBlockTime seconds apart. A single retarget moves the
+	// difficulty by at most maxRetargetStep bits, i.e. a factor of four.
+	RetargetInterval = 10
+	TargetBlockTime  = 10
+	maxRetargetStep  = 2
+
+	// medianTimeSpan is the number of blocks whose median timestamp a new
+	// block must not precede; maxFutureBlockTime bounds how far ahead of the
+	// local clock it may be.
+	medianTimeSpan     = 11
+	maxFutureBlockTime = 2 * time.Hour
+)
+
+var (
+	ErrBadDifficulty = errors.New("block difficulty does not match the expected difficulty")
+	ErrTimeTooOld    = errors.New("block timestamp is before the median time of previous blocks")
+	ErrTimeTooNew    = errors.New("block timestamp is too far in the future")
+)
+
+// validDifficulty tells whether a difficulty is one a block may have at all.
+func validDifficulty(difficulty int) bool {
+	return difficulty >= MinDifficulty && difficulty <= MaxDifficulty
+}
+
+// checkDifficultyRange rejects a header whose difficulty no block can have,
+// before anything computes a target or work from it.
+func checkDifficultyRange(header *BlockHeader) error {
+	if !validDifficulty(header.Difficulty) {
+		return fmt.Errorf("%w: %d is not between %d and %d", ErrBadDifficulty, header.Difficulty, MinDifficulty, MaxDifficulty)
+	}
+
+	return nil
+}
+
+// NextDifficulty returns the difficulty expected of a block mined on top of
+// parent, or InitialDifficulty for a genesis block.
+func (ch *BlockChain) NextDifficulty(parent *Block) int {
+	if parent == nil {
+		return InitialDifficulty
+	}
+
+	height := parent.Height + 1
+	if height%RetargetInterval != 0 {
+		return parent.Difficulty
+	}
+
+	first := ch.ancestor(parent, height-RetargetInterval)
+	if first == nil {
+		return parent.Difficulty
+	}
+
+	actual := parent.Timestamp - first.Timestamp
+	expected := int64(TargetBlockTime * (parent.Height - first.Height))
+
+	return retarget(parent.Difficulty, actual, expected)
+}
+
+// retarget raises the difficulty by one bit for every halving of the expected
+// time the blocks actually took, and lowers it for every doubling.
+func retarget(difficulty int, actual, expected int64) int {
+	if actual < 1 {
+		actual = 1
+	}
+
+	for i := 0; i < maxRetargetStep && actual*2 <= expected; i++ {
+		difficulty++
+		actual *= 2
+	}
+	for i := 0; i < maxRetargetStep && actual >= expected*2; i++ {
+		difficulty--
+		actual /= 2
+	}
+
+	if difficulty < MinDifficulty {
+		return MinDifficulty
+	}
+	if difficulty > MaxDifficulty {
+		return MaxDifficulty
+	}
+	return difficulty
+}
+
+// medianTime returns the median timestamp of block and the blocks before it,
+// looking at no more than medianTimeSpan blocks.
+func (ch *BlockChain) medianTime(block *Block) int64 {
+	var timestamps []int64
+
+	for i := 0; i < medianTimeSpan && block != nil; i++ {
+		timestamps = append(timestamps, block.Timestamp)
+		block = ch.parentOf(block)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+
+	return timestamps[len(timestamps)/2]
+}
+
+// checkTimestamp makes sure a header is not older than the median time of its
+// ancestors and not too far ahead of the local clock.
+func (ch *BlockChain) checkTimestamp(header *BlockHeader, parent *Block) error {
+	if header.Timestamp > time.Now().Add(maxFutureBlockTime).Unix() {
+		return ErrTimeTooNew
+	}
+	if parent != nil && header.Timestamp < ch.medianTime(parent) {
+		return ErrTimeTooOld
+	}
+	return nil
+}
+
+// ancestor walks back from block to its ancestor at the given height.
+func (ch *BlockChain) ancestor(block *Block, height int) *Block {
+	for block != nil && block.Height > height {
+		block = ch.parentOf(block)
+	}
+	if block == nil || block.Height != height {
+		return nil
+	}
+	return block
+}
+
+func (ch *BlockChain) parentOf(block *Block) *Block {
+	if len(block.PrevHash) == 0 {
+		return nil
+	}
+
+	parent, err := ch.GetBlock(block.PrevHash)
+	if err != nil {
+		return nil
+	}
+	return &parent
+}
@@ -0,0 +1,418 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Every stored block has its cumulative work under workPrefix + hash, and
+// every block on the main chain the outputs it spent under undoPrefix + hash.
+const (
+	workPrefix = "work-"
+	undoPrefix = "undo-"
+)
+
+var ErrMissingUndo = errors.New("undo data of the block is missing")
+
+func workKey(blockHash []byte) []byte {
+	return append([]byte(workPrefix), blockHash...)
+}
+
+func undoKey(blockHash []byte) []byte {
+	return append([]byte(undoPrefix), blockHash...)
+}
+
+// serializeUndo encodes the outputs spent by a block in the order its inputs
+// spend them.
+func serializeUndo(outs []TxOutput) []byte {
+	return encode(outs)
+}
+
+func deserializeUndo(data []byte) ([]TxOutput, error) {
+	var outs []TxOutput
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&outs); err != nil {
+		return nil, fmt.Errorf("decoding undo data: %w", err)
+	}
+
+	return outs, nil
+}
+
+// blockWork is the number of hashes a block takes to mine on average, or
+// zero if its difficulty is out of range.
+func blockWork(header *BlockHeader) *big.Int {
+	if !validDifficulty(header.Difficulty) {
+		return new(big.Int)
+	}
+	return new(big.Int).Lsh(big.NewInt(1), uint(header.Difficulty))
+}
+
+// storeBlock saves a block together with the cumulative work of the chain
+// ending at it.
+func (ch *BlockChain) storeBlock(txn *badger.Txn, block *Block, work *big.Int) error {
+	if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+		return err
+	}
+	return txn.Set(workKey(block.Hash), work.Bytes())
+}
+
+// ChainWork returns the total work of the chain ending at the given block, or
+// zero for an empty hash. Blocks stored without their work have it computed
+// from their ancestors.
+func (ch *BlockChain) ChainWork(blockHash []byte) (*big.Int, error) {
+	work := new(big.Int)
+
+	for len(blockHash) > 0 {
+		var stored []byte
+
+		err := ch.Database.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(workKey(blockHash))
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			stored, err = item.ValueCopy(nil)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if stored != nil {
+			return work.Add(work, new(big.Int).SetBytes(stored)), nil
+		}
+
+		block, err := ch.GetBlock(blockHash)
+		if err != nil {
+			return nil, err
+		}
+		work.Add(work, blockWork(&block.BlockHeader))
+		blockHash = block.PrevHash
+	}
+
+	return work, nil
+}
+
+// indexWork stores the cumulative work of every block on the main chain if
+// the tip does not have it yet, as with databases written before blocks
+// carried their work.
+func (ch *BlockChain) indexWork() error {
+	err := ch.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(workKey(ch.LastHash))
+		return err
+	})
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	hashes, err := ch.GetBlockHashes()
+	if err != nil {
+		return err
+	}
+	work := new(big.Int)
+
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := ch.GetBlock(hashes[i])
+		if err != nil {
+			return err
+		}
+		work.Add(work, blockWork(&block.BlockHeader))
+
+		err = ch.Database.Update(func(txn *badger.Txn) error {
+			return txn.Set(workKey(block.Hash), work.Bytes())
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// undoData returns the outputs a block on the main chain spent. Blocks
+// connected before undo data was kept have them looked up in their ancestors.
+func (ch *BlockChain) undoData(block *Block) ([]TxOutput, error) {
+	var data []byte
+
+	err := ch.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(undoKey(block.Hash))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		return deserializeUndo(data)
+	}
+
+	var undo []TxOutput
+	created := make(map[string]TxOutput)
+
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				out, ok := created[outpoint(in.Id, in.Out)]
+				if !ok {
+					prevTx, err := ch.findTransactionFrom(block.PrevHash, in.Id)
+					if err != nil && !errors.Is(err, ErrTxNotFound) {
+						return nil, err
+					}
+					if err != nil || in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+						return nil, &BlockError{Hash: block.Hash, TxId: tx.Id, Err: ErrMissingUndo}
+					}
+					out = prevTx.Outputs[in.Out]
+				}
+				undo = append(undo, out)
+			}
+		}
+		for outIdx, out := range tx.Outputs {
+			created[outpoint(tx.Id, outIdx)] = out
+		}
+	}
+
+	return undo, nil
+}
+
+// utxoView holds changes to the UTXO set that are not written yet; a nil
+// entry is an output that has been spent.
+type utxoView struct {
+	chain   *BlockChain
+	changes map[string]*TxOutput
+}
+
+func newUTxOView(chain *BlockChain) *utxoView {
+	return &utxoView{chain: chain, changes: make(map[string]*TxOutput)}
+}
+
+func (v *utxoView) get(txId []byte, outIdx int) (TxOutput, error) {
+	if out, ok := v.changes[string(utxoKey(txId, outIdx))]; ok {
+		if out == nil {
+			return TxOutput{}, fmt.Errorf("%w: %s", ErrOutputNotFound, outpoint(txId, outIdx))
+		}
+		return *out, nil
+	}
+	return v.chain.FindOutput(txId, outIdx)
+}
+
+func (v *utxoView) set(txId []byte, outIdx int, out *TxOutput) {
+	v.changes[string(utxoKey(txId, outIdx))] = out
+}
+
+// connect applies a validated block and returns its undo data.
+func (v *utxoView) connect(block *Block) ([]TxOutput, error) {
+	var undo []TxOutput
+
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				out, err := v.get(in.Id, in.Out)
+				if err != nil {
+					return nil, err
+				}
+				undo = append(undo, out)
+				v.set(in.Id, in.Out, nil)
+			}
+		}
+		for outIdx := range tx.Outputs {
+			v.set(tx.Id, outIdx, &tx.Outputs[outIdx])
+		}
+	}
+
+	return undo, nil
+}
+
+// disconnect reverts a block: going through its transactions backwards, their
+// outputs are removed and the outputs they spent are restored from undo.
+func (v *utxoView) disconnect(block *Block, undo []TxOutput) {
+	i := len(undo)
+
+	for t := len(block.Transactions) - 1; t >= 0; t-- {
+		tx := block.Transactions[t]
+
+		for outIdx := range tx.Outputs {
+			v.set(tx.Id, outIdx, nil)
+		}
+		if tx.IsCoinbase() {
+			continue
+		}
+		for j := len(tx.Inputs) - 1; j >= 0; j-- {
+			i--
+			v.set(tx.Inputs[j].Id, tx.Inputs[j].Out, &undo[i])
+		}
+	}
+}
+
+// write stores the changes in txn. A spent output is looked up first so that
+// it can be removed from the index by owner as well.
+func (v *utxoView) write(txn *badger.Txn) error {
+	for key, out := range v.changes {
+		txId, outIdx := parseUTxOKey([]byte(key))
+		if out != nil {
+			if err := setUTxO(txn, txId, outIdx, out); err != nil {
+				return err
+			}
+			continue
+		}
+
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		spent, err := DeserializeOutput(data)
+		if err != nil {
+			return err
+		}
+		if err := deleteUTxO(txn, txId, outIdx, &spent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reorganize moves the tip to newTip, a stored block on a branch with more
+// work than the main chain. Blocks of the main chain back to the fork point
+// are disconnected and those of the new branch validated and connected in
+// order. Nothing changes unless every block of the new branch is valid; an
+// invalid block is dropped along with its descendants up to newTip.
+func (ch *BlockChain) reorganize(newTip *Block) ([]*Block, []*Block, error) {
+	oldTip, err := ch.GetBlock(ch.LastHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Both lists are newest first until they are reversed below.
+	var detach, attach []*Block
+	a, b := &oldTip, newTip
+	for !sameBlock(a, b) {
+		if b == nil || (a != nil && a.Height >= b.Height) {
+			detach = append(detach, a)
+			a = ch.parentOf(a)
+		} else {
+			attach = append(attach, b)
+			b = ch.parentOf(b)
+		}
+	}
+	fork := a
+
+	view := newUTxOView(ch)
+	detachUndos := make([][]TxOutput, len(detach))
+	for i, block := range detach {
+		undo, err := ch.undoData(block)
+		if err != nil {
+			return nil, nil, err
+		}
+		view.disconnect(block, undo)
+		detachUndos[i] = undo
+	}
+
+	undos := make([][]TxOutput, len(attach))
+	parent := fork
+	for i := len(attach) - 1; i >= 0; i-- {
+		block := attach[i]
+		ctx := blockContext{
+			parent:    parent,
+			spendable: view.get,
+			prevTx: func(txId []byte) (Transaction, error) {
+				return ch.findTransactionFrom(block.PrevHash, txId)
+			},
+		}
+
+		if err := ch.validateBlock(block, ctx); err != nil {
+			if discardErr := ch.discardBlocks(attach[:i+1]); discardErr != nil {
+				return nil, nil, discardErr
+			}
+			return nil, nil, err
+		}
+		if undos[i], err = view.connect(block); err != nil {
+			return nil, nil, err
+		}
+		parent = block
+	}
+
+	err = ch.Database.Update(func(txn *badger.Txn) error {
+		if err := view.write(txn); err != nil {
+			return err
+		}
+		for i, block := range detach {
+			if err := txn.Delete(undoKey(block.Hash)); err != nil {
+				return err
+			}
+			if err := unindexAddresses(txn, block, detachUndos[i]); err != nil {
+				return err
+			}
+			if err := unindexTransactions(txn, block); err != nil {
+				return err
+			}
+		}
+		for i, block := range attach {
+			if err := txn.Set(undoKey(block.Hash), serializeUndo(undos[i])); err != nil {
+				return err
+			}
+			if err := indexAddresses(txn, block, undos[i]); err != nil {
+				return err
+			}
+			if err := indexTransactions(txn, block); err != nil {
+				return err
+			}
+		}
+		return txn.Set([]byte("lh"), newTip.Hash)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	ch.LastHash = newTip.Hash
+
+	reverseBlocks(detach)
+	reverseBlocks(attach)
+
+	return detach, attach, nil
+}
+
+// discardBlocks deletes blocks of a branch that turned out to be invalid.
+func (ch *BlockChain) discardBlocks(blocks []*Block) error {
+	return ch.Database.Update(func(txn *badger.Txn) error {
+		for _, block := range blocks {
+			if err := txn.Delete(block.Hash); err != nil {
+				return err
+			}
+			if err := txn.Delete(workKey(block.Hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func sameBlock(a, b *Block) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return bytes.Equal(a.Hash, b.Hash)
+}
+
+func reverseBlocks(blocks []*Block) {
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+}
@@ -0,0 +1,261 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+// pickCoin spends the first output of a given transaction, to build
+// transactions that spend exactly the outputs a test needs.
+type pickCoin struct {
+	txId []byte
+}
+
+func (pickCoin) Name() string { return "pick" }
+
+func (p pickCoin) Select(coins []UnspentOutput, target int) ([]UnspentOutput, error) {
+	for _, coin := range coins {
+		if bytes.Equal(coin.TxId, p.txId) && coin.Output.Value >= target {
+			return []UnspentOutput{coin}, nil
+		}
+	}
+
+	return nil, insufficient(nil, target)
+}
+
+func addBlock(t *testing.T, chain *BlockChain, block *Block) {
+	t.Helper()
+
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkTip(t *testing.T, chain *BlockChain, want *Block) {
+	t.Helper()
+
+	if !bytes.Equal(chain.Tip(), want.Hash) {
+		t.Fatalf("tip is %x, want %x at height %d", chain.Tip(), want.Hash, want.Height)
+	}
+}
+
+// checkUTxO checks that the UTXO set and its index by owner are those of the
+// chain ending at the tip, worked out again from its blocks.
+func checkUTxO(t *testing.T, chain *BlockChain) {
+	t.Helper()
+
+	replayed, err := chain.findAllUTxOFrom(chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	UTXO := scanUTxO(t, chain)
+	for txId, outs := range replayed {
+		for outIdx, out := range outs {
+			want++
+			op := fmt.Sprintf("%s:%d", txId, outIdx)
+			got, ok := UTXO[op]
+			if !ok || got.Value != out.Value || !bytes.Equal(got.ScriptPubKey, out.ScriptPubKey) {
+				t.Errorf("UTXO set lacks %s", op)
+			}
+		}
+	}
+	if len(UTXO) != want {
+		t.Errorf("UTXO set has %d outputs, the chain leaves %d", len(UTXO), want)
+	}
+
+	checkOwnerIndex(t, chain)
+}
+
+func checkLocated(t *testing.T, chain *BlockChain, tx *Transaction, block *Block) {
+	t.Helper()
+
+	blockHash, _, err := chain.TransactionLocation(tx.Id)
+	if block == nil {
+		if !errors.Is(err, ErrTxNotFound) {
+			t.Errorf("transaction %x: TransactionLocation = %x, %v, want %v", tx.Id, blockHash, err, ErrTxNotFound)
+		}
+		return
+	}
+	if err != nil || !bytes.Equal(blockHash, block.Hash) {
+		t.Errorf("transaction %x: TransactionLocation = %x, %v, want block %x", tx.Id, blockHash, err, block.Hash)
+	}
+}
+
+func checkHistory(t *testing.T, chain *BlockChain, w *wallet.Wallet, want ...*Transaction) {
+	t.Helper()
+
+	history, total, err := chain.AddressHistory(wallet.PublicKeyHash(w.PublicKey), 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != len(want) || len(history) != len(want) {
+		t.Fatalf("%s has %d transactions in its history, want %d", w.Address(), total, len(want))
+	}
+	for i, tx := range want {
+		if !bytes.Equal(history[i].Transaction.Id, tx.Id) {
+			t.Errorf("history entry %d is %x, want %x", i, history[i].Transaction.Id, tx.Id)
+		}
+	}
+}
+
+// TestReorganize builds a main chain and a branch with more work that spends
+// one of the same outputs to someone else, and checks that switching to the
+// branch and back leaves the UTXO set, the indexes and the mempool as if only
+// the winning chain had ever been seen.
+func TestReorganize(t *testing.T) {
+	owner := newTestWallet(t)
+	miner := string(newTestWallet(t).Address())
+	payeeA, payeeB, payeeK := newTestWallet(t), newTestWallet(t), newTestWallet(t)
+	chain := newTestChain(t, owner, 1)
+
+	pool := NewMemPool(chain, DefaultMemPoolSize)
+	chain.OnReorg = pool.Reorganize
+
+	fork := tipBlock(t, chain)
+	genesis, err := chain.GetBlock(fork.PrevHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend := func(coin *Transaction, to *wallet.Wallet, amount int) *Transaction {
+		tx, err := NewTransaction(owner, string(to.Address()), amount, Fee{}, pickCoin{coin.Id}, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	// txA and txB spend the same output, txKeep one only the main chain
+	// spends.
+	txA := spend(genesis.Transactions[0], payeeA, 50)
+	txB := spend(genesis.Transactions[0], payeeB, 60)
+	txKeep := spend(fork.Transactions[0], payeeK, 40)
+
+	main2 := blockOn(t, chain, fork, miner, txA, txKeep)
+	addBlock(t, chain, main2)
+	checkTip(t, chain, main2)
+
+	side2 := blockOn(t, chain, fork, miner, txB)
+	addBlock(t, chain, side2)
+	// As much work as the main chain is not enough to switch.
+	checkTip(t, chain, main2)
+	checkLocated(t, chain, txB, nil)
+
+	side3 := blockOn(t, chain, side2, miner)
+	addBlock(t, chain, side3)
+	checkTip(t, chain, side3)
+	if !bytes.Equal(chain.LastHash, side3.Hash) {
+		t.Fatalf("LastHash is %x, want %x", chain.LastHash, side3.Hash)
+	}
+
+	checkUTxO(t, chain)
+	checkLocated(t, chain, txA, nil)
+	checkLocated(t, chain, txKeep, nil)
+	checkLocated(t, chain, main2.Transactions[0], nil)
+	checkLocated(t, chain, txB, side2)
+	checkHistory(t, chain, payeeA)
+	checkHistory(t, chain, payeeK)
+	checkHistory(t, chain, payeeB, txB)
+	if balance := balanceOf(t, chain, payeeB.PublicKey); balance != 60 {
+		t.Errorf("payee B has %d, want 60", balance)
+	}
+
+	// txKeep is still valid and waits to be mined again; txA spends what
+	// txB spent.
+	if !pool.Has(txKeep.Id) {
+		t.Error("the orphaned transaction did not go back to the mempool")
+	}
+	if pool.Has(txA.Id) || pool.Has(txB.Id) {
+		t.Error("the mempool holds a transaction conflicting with the chain")
+	}
+
+	// The main chain gets ahead again and the chain switches back.
+	main3 := blockOn(t, chain, main2, miner)
+	addBlock(t, chain, main3)
+	checkTip(t, chain, side3)
+	main4 := blockOn(t, chain, main3, miner)
+	addBlock(t, chain, main4)
+	checkTip(t, chain, main4)
+
+	checkUTxO(t, chain)
+	checkLocated(t, chain, txA, main2)
+	checkLocated(t, chain, txKeep, main2)
+	checkLocated(t, chain, txB, nil)
+	checkLocated(t, chain, side3.Transactions[0], nil)
+	checkHistory(t, chain, payeeA, txA)
+	checkHistory(t, chain, payeeB)
+	if pool.Size() != 0 {
+		t.Errorf("mempool has %d transactions, want none", pool.Size())
+	}
+}
+
+// TestLighterBranchIsStored checks that a block on a branch with less work is
+// kept without touching the main chain.
+func TestLighterBranchIsStored(t *testing.T) {
+	owner := newTestWallet(t)
+	chain := newTestChain(t, owner, 2)
+	tip := tipBlock(t, chain)
+	before := scanUTxO(t, chain)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	side := blockOn(t, chain, &genesis, string(owner.Address()))
+	addBlock(t, chain, side)
+
+	checkTip(t, chain, tip)
+	if !chain.HasBlock(side.Hash) {
+		t.Error("the block of the lighter branch was not stored")
+	}
+	if len(scanUTxO(t, chain)) != len(before) {
+		t.Error("the UTXO set changed")
+	}
+	checkUTxO(t, chain)
+	checkLocated(t, chain, side.Transactions[0], nil)
+}
+
+// TestInvalidBranchIsDiscarded checks that a branch with more work is dropped
+// when one of its blocks turns out to be invalid once its turn comes to be
+// connected, and that the main chain stays as it was.
+func TestInvalidBranchIsDiscarded(t *testing.T) {
+	owner := newTestWallet(t)
+	chain := newTestChain(t, owner, 1)
+	tip := tipBlock(t, chain)
+
+	genesis, err := chain.GetBlock(tip.PrevHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The signature no longer matches once the output is changed, though the
+	// id does.
+	tx, err := NewTransaction(owner, string(newTestWallet(t).Address()), 10, Fee{}, pickCoin{genesis.Transactions[0].Id}, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Outputs[0].Value++
+	tx.Id = tx.unsignedHash()
+
+	// Only the header and Merkle root of a block off the main chain are
+	// checked, so the invalid block is stored until its branch gets ahead.
+	bad := blockOn(t, chain, &genesis, string(owner.Address()), tx)
+	addBlock(t, chain, bad)
+	next := blockOn(t, chain, bad, string(owner.Address()))
+	if err := chain.AddBlock(next); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("AddBlock = %v, want %v", err, ErrInvalidSignature)
+	}
+
+	checkTip(t, chain, tip)
+	if chain.HasBlock(bad.Hash) || chain.HasBlock(next.Hash) {
+		t.Error("the blocks of the invalid branch were kept")
+	}
+	checkUTxO(t, chain)
+	checkLocated(t, chain, tx, nil)
+
+	// The main chain still grows.
+	addBlock(t, chain, blockOn(t, chain, tip, string(owner.Address())))
+	checkUTxO(t, chain)
+}
@@ -0,0 +1,194 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+// The JSON forms of blocks and transactions are part of the API and should
+// only ever gain fields. Byte fields are hex strings.
+
+// hexBytes is a byte slice that is a hex string in JSON.
+type hexBytes []byte
+
+func (b hexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+func (b *hexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+
+	return nil
+}
+
+// txInputJSON carries the ScriptSig both as hex and disassembled. The
+// signature and public key of a pay-to-pubkey-hash spend are also given on
+// their own. Only scriptsig is read when decoding.
+type txInputJSON struct {
+	TxId         hexBytes `json:"txid"`
+	Out          int      `json:"vout"`
+	ScriptSig    hexBytes `json:"scriptsig"`
+	ScriptSigAsm string   `json:"scriptsig_asm,omitempty"`
+	Signature    hexBytes `json:"signature,omitempty"`
+	PubKey       hexBytes `json:"pubkey,omitempty"`
+}
+
+func (in TxInput) MarshalJSON() ([]byte, error) {
+	v := txInputJSON{
+		TxId:         in.Id,
+		Out:          in.Out,
+		ScriptSig:    hexBytes(in.ScriptSig),
+		ScriptSigAsm: in.ScriptSig.String(),
+	}
+	if items, ok := in.ScriptSig.pushes(); ok && len(items) == 2 {
+		if _, ok := wallet.SchemeOf(items[1]); ok {
+			v.Signature, v.PubKey = items[0], items[1]
+		}
+	}
+
+	return json.Marshal(v)
+}
+
+func (in *TxInput) UnmarshalJSON(data []byte) error {
+	var v txInputJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*in = TxInput{v.TxId, v.Out, Script(v.ScriptSig)}
+
+	return nil
+}
+
+// txOutputJSON also carries the disassembled script, the hash and the
+// address a standard script pays to. They are only there for the reader and
+// ignored when decoding.
+type txOutputJSON struct {
+	Value           int      `json:"value"`
+	ScriptPubKey    hexBytes `json:"scriptpubkey"`
+	ScriptPubKeyAsm string   `json:"scriptpubkey_asm,omitempty"`
+	PubKeyHash      hexBytes `json:"pubkeyhash,omitempty"`
+	Address         string   `json:"address,omitempty"`
+}
+
+func (out TxOutput) MarshalJSON() ([]byte, error) {
+	v := txOutputJSON{
+		Value:           out.Value,
+		ScriptPubKey:    hexBytes(out.ScriptPubKey),
+		ScriptPubKeyAsm: out.ScriptPubKey.String(),
+	}
+	if hash, ok := out.ScriptPubKey.Hash(); ok {
+		v.PubKeyHash = hash
+	}
+	if address, ok := out.ScriptPubKey.Address(); ok {
+		v.Address = string(address)
+	}
+
+	return json.Marshal(v)
+}
+
+func (out *TxOutput) UnmarshalJSON(data []byte) error {
+	var v txOutputJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*out = TxOutput{v.Value, Script(v.ScriptPubKey)}
+
+	return nil
+}
+
+type transactionJSON struct {
+	Id       hexBytes   `json:"txid"`
+	Coinbase bool       `json:"coinbase"`
+	Inputs   []TxInput  `json:"vin"`
+	Outputs  []TxOutput `json:"vout"`
+}
+
+func (tx Transaction) MarshalJSON() ([]byte, error) {
+	v := transactionJSON{
+		Id:       tx.Id,
+		Coinbase: tx.IsCoinbase(),
+		Inputs:   tx.Inputs,
+		Outputs:  tx.Outputs,
+	}
+	if v.Inputs == nil {
+		v.Inputs = []TxInput{}
+	}
+	if v.Outputs == nil {
+		v.Outputs = []TxOutput{}
+	}
+
+	return json.Marshal(v)
+}
+
+func (tx *Transaction) UnmarshalJSON(data []byte) error {
+	var v transactionJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*tx = Transaction{v.Id, v.Inputs, v.Outputs}
+
+	return nil
+}
+
+type blockJSON struct {
+	Hash         hexBytes       `json:"hash"`
+	Version      int32          `json:"version"`
+	Height       int            `json:"height"`
+	PrevHash     hexBytes       `json:"prevhash"`
+	MerkleRoot   hexBytes       `json:"merkleroot"`
+	Timestamp    int64          `json:"timestamp"`
+	Difficulty   int            `json:"difficulty"`
+	Nonce        int            `json:"nonce"`
+	Transactions []*Transaction `json:"tx"`
+}
+
+func (b Block) MarshalJSON() ([]byte, error) {
+	v := blockJSON{
+		Hash:         b.Hash,
+		Version:      b.Version,
+		Height:       b.Height,
+		PrevHash:     b.PrevHash,
+		MerkleRoot:   b.MerkleRoot,
+		Timestamp:    b.Timestamp,
+		Difficulty:   b.Difficulty,
+		Nonce:        b.Nonce,
+		Transactions: b.Transactions,
+	}
+	if v.Transactions == nil {
+		v.Transactions = []*Transaction{}
+	}
+
+	return json.Marshal(v)
+}
+
+func (b *Block) UnmarshalJSON(data []byte) error {
+	var v blockJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*b = Block{
+		BlockHeader: BlockHeader{
+			Version:    v.Version,
+			PrevHash:   v.PrevHash,
+			MerkleRoot: v.MerkleRoot,
+			Timestamp:  v.Timestamp,
+			Difficulty: v.Difficulty,
+			Nonce:      v.Nonce,
+			Height:     v.Height,
+		},
+		Hash:         v.Hash,
+		Transactions: v.Transactions,
+	}
+
+	return nil
+}
@@ -0,0 +1,304 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultMemPoolSize = 5000
+
+// templateReserve is the room a block template leaves for the coinbase.
+const templateReserve = 4096
+
+var (
+	ErrTxExists     = errors.New("transaction is already in the mempool")
+	ErrMemPoolFull  = errors.New("mempool is full")
+	ErrCoinbaseTx   = errors.New("coinbase transactions are not accepted in the mempool")
+	ErrDoubleSpend  = errors.New("output is already spent")
+	ErrInvalidTx    = errors.New("transaction is invalid")
+	ErrInsufficient = errors.New("transaction spends more than its inputs")
+)
+
+type poolEntry struct {
+	tx    *Transaction
+	added time.Time
+	fee   int
+	size  int
+}
+
+// betterFeeRate tells whether e pays more per byte than other, the older one
+// coming first when they pay the same.
+func (e poolEntry) betterFeeRate(other poolEntry) bool {
+	a, b := e.fee*other.size, other.fee*e.size
+	if a != b {
+		return a > b
+	}
+
+	return e.added.Before(other.added)
+}
+
+// MemPool holds validated transactions waiting to be mined. Every input of a
+// pooled transaction refers to an output in the UTXO set that no other pooled
+// transaction spends.
+type MemPool struct {
+	chain   *BlockChain
+	maxSize int
+
+	mu    sync.RWMutex
+	txs   map[string]poolEntry
+	spent map[string]string
+}
+
+func NewMemPool(chain *BlockChain, maxSize int) *MemPool {
+	return &MemPool{
+		chain:   chain,
+		maxSize: maxSize,
+		txs:     make(map[string]poolEntry),
+		spent:   make(map[string]string),
+	}
+}
+
+func outpoint(txId []byte, outIdx int) string {
+	return fmt.Sprintf("%x:%d", txId, outIdx)
+}
+
+// Add validates a transaction against the chain and the pending transactions
+// and puts it into the pool. It runs the checks a block runs on each of its
+// transactions, so that a pooled transaction never makes a mined block
+// invalid.
+func (mp *MemPool) Add(tx *Transaction) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	txId := hex.EncodeToString(tx.Id)
+
+	if _, ok := mp.txs[txId]; ok {
+		return ErrTxExists
+	}
+	if len(mp.txs) >= mp.maxSize {
+		return ErrMemPoolFull
+	}
+	if tx.IsCoinbase() {
+		return ErrCoinbaseTx
+	}
+	outputs, err := checkTransaction(tx)
+	if err != nil {
+		return err
+	}
+
+	inputs := 0
+	seen := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		point := outpoint(in.Id, in.Out)
+
+		if seen[point] {
+			return fmt.Errorf("%w: %s is spent twice in %s", ErrDoubleSpend, point, txId)
+		}
+		seen[point] = true
+
+		if other, ok := mp.spent[point]; ok {
+			return fmt.Errorf("%w: %s is spent by pending %s", ErrDoubleSpend, point, other)
+		}
+
+		out, err := mp.chain.FindOutput(in.Id, in.Out)
+		if errors.Is(err, ErrOutputNotFound) {
+			return fmt.Errorf("%w: %s is not in the UTXO set", ErrDoubleSpend, point)
+		}
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if inputs, ok = addMoney(inputs, out.Value); !ok {
+			return ErrMoneyOverflow
+		}
+	}
+
+	if outputs > inputs {
+		return ErrInsufficient
+	}
+
+	if !mp.chain.VerifyTransaction(tx) {
+		return ErrInvalidTx
+	}
+
+	mp.txs[txId] = poolEntry{tx, time.Now(), inputs - outputs, tx.Size()}
+	for point := range seen {
+		mp.spent[point] = txId
+	}
+
+	return nil
+}
+
+func (mp *MemPool) Get(txId []byte) (*Transaction, bool) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	entry, ok := mp.txs[hex.EncodeToString(txId)]
+
+	return entry.tx, ok
+}
+
+func (mp *MemPool) Has(txId []byte) bool {
+	_, ok := mp.Get(txId)
+
+	return ok
+}
+
+// List returns the pending transactions in the order they were accepted.
+func (mp *MemPool) List() []*Transaction {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	entries := make([]poolEntry, 0, len(mp.txs))
+	for _, entry := range mp.txs {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].added.Before(entries[j].added)
+	})
+
+	txs := make([]*Transaction, 0, len(entries))
+	for _, entry := range entries {
+		txs = append(txs, entry.tx)
+	}
+
+	return txs
+}
+
+// Select returns up to limit pending transactions, oldest first, for a miner to
+// put into a block. A limit of zero or less returns all of them.
+func (mp *MemPool) Select(limit int) []*Transaction {
+	txs := mp.List()
+	if limit > 0 && len(txs) > limit {
+		txs = txs[:limit]
+	}
+
+	return txs
+}
+
+// BlockTemplate picks the pending transactions for a new block by fee rate,
+// highest first, for as long as they fit into a block. Every pooled
+// transaction spends outputs of the chain only, so any subset of them is
+// valid together. MineBlock then credits their fees to the coinbase.
+func (mp *MemPool) BlockTemplate() []*Transaction {
+	return mp.selectByFeeRate(MaxBlockSize - templateReserve)
+}
+
+// selectByFeeRate picks transactions by fee rate whose sizes add up to at most
+// maxSize. One that does not fit is skipped in favour of smaller ones after
+// it.
+func (mp *MemPool) selectByFeeRate(maxSize int) []*Transaction {
+	mp.mu.RLock()
+	entries := make([]poolEntry, 0, len(mp.txs))
+	for _, entry := range mp.txs {
+		entries = append(entries, entry)
+	}
+	mp.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].betterFeeRate(entries[j])
+	})
+
+	var txs []*Transaction
+	size := 0
+	for _, entry := range entries {
+		if size+entry.size > maxSize {
+			continue
+		}
+		txs = append(txs, entry.tx)
+		size += entry.size
+	}
+
+	return txs
+}
+
+func (mp *MemPool) Size() int {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	return len(mp.txs)
+}
+
+func (mp *MemPool) MaxSize() int {
+	return mp.maxSize
+}
+
+func (mp *MemPool) Remove(txId []byte) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.remove(hex.EncodeToString(txId))
+}
+
+// RemoveBlockTxs evicts the transactions included in a block together with
+// any pending transaction that spends an output the block has spent.
+func (mp *MemPool) RemoveBlockTxs(block *Block) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for _, tx := range block.Transactions {
+		mp.remove(hex.EncodeToString(tx.Id))
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if other, ok := mp.spent[outpoint(in.Id, in.Out)]; ok {
+				mp.remove(other)
+			}
+		}
+	}
+}
+
+// Reorganize brings the pool in line with a chain reorganization: the
+// transactions of the connected blocks and anything conflicting with them are
+// evicted, and those of the disconnected blocks are offered again. Orphaned
+// transactions that are no longer valid are dropped. It fits
+// BlockChain.OnReorg.
+func (mp *MemPool) Reorganize(disconnected, connected []*Block) {
+	for _, block := range connected {
+		mp.RemoveBlockTxs(block)
+	}
+
+	for _, block := range disconnected {
+		for _, tx := range block.Transactions {
+			if !tx.IsCoinbase() {
+				mp.Add(tx)
+			}
+		}
+	}
+}
+
+// Expire evicts transactions that have been waiting longer than maxAge and
+// returns how many were removed.
+func (mp *MemPool) Expire(maxAge time.Duration) int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	removed := 0
+	deadline := time.Now().Add(-maxAge)
+	for txId, entry := range mp.txs {
+		if entry.added.Before(deadline) {
+			mp.remove(txId)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+func (mp *MemPool) remove(txId string) {
+	entry, ok := mp.txs[txId]
+	if !ok {
+		return
+	}
+
+	for _, in := range entry.tx.Inputs {
+		delete(mp.spent, outpoint(in.Id, in.Out))
+	}
+	delete(mp.txs, txId)
+}
@@ -0,0 +1,115 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Workers add to the shared hash counter and check for cancellation
+	// once every hashBatch nonces.
+	hashBatch        = 1 << 12
+	hashRateInterval = time.Second
+)
+
+// Miner searches for proofs of work by splitting the nonce space between
+// several goroutines: worker i tries nonces i, i+n, i+2n, ...
+type Miner struct {
+	// Workers is the number of goroutines to use, one per CPU when zero.
+	Workers int
+	// OnHashRate, if set, is called about once a second with the number of
+	// hashes per second computed since the previous call.
+	OnHashRate func(hashesPerSecond float64)
+}
+
+// Run looks for a nonce that brings the header hash below the target. It
+// returns ctx.Err() if ctx is done before a nonce is found.
+func (m Miner) Run(ctx context.Context, pow *ProofOfWork) (int, []byte, error) {
+	type result struct {
+		nonce int
+		hash  []byte
+	}
+
+	workers := m.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	search, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan result, workers)
+	done := make(chan struct{})
+	var hashes uint64
+	var wg sync.WaitGroup
+
+	head, tail := pow.dataParts()
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func(start int) {
+			defer wg.Done()
+
+			var intHash big.Int
+			data := make([]byte, len(head)+8+len(tail))
+			copy(data, head)
+			copy(data[len(head)+8:], tail)
+
+			for nonce, n := start, 1; nonce >= 0 && nonce < math.MaxInt64; nonce, n = nonce+workers, n+1 {
+				if n%hashBatch == 0 {
+					atomic.AddUint64(&hashes, hashBatch)
+					if search.Err() != nil {
+						return
+					}
+				}
+
+				binary.BigEndian.PutUint64(data[len(head):], uint64(nonce))
+				hash := sha256.Sum256(data)
+				intHash.SetBytes(hash[:])
+
+				if intHash.Cmp(pow.Target) == -1 {
+					found <- result{nonce, hash[:]}
+					cancel()
+					return
+				}
+			}
+		}(w)
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(hashRateInterval)
+	defer ticker.Stop()
+	last := time.Now()
+
+	for {
+		select {
+		case r := <-found:
+			return r.nonce, r.hash, nil
+		case <-done:
+			select {
+			case r := <-found:
+				return r.nonce, r.hash, nil
+			default:
+				return 0, nil, ctx.Err()
+			}
+		case now := <-ticker.C:
+			count := atomic.SwapUint64(&hashes, 0)
+			if m.OnHashRate != nil {
+				m.OnHashRate(float64(count) / now.Sub(last).Seconds())
+			}
+			last = now
+		}
+	}
+}
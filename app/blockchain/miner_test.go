@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"math/big"
+	"runtime"
+	"testing"
+)
+
+const benchDifficulty = 16
+
+// runSingle is the search ProofOfWork.Run did before there was a Miner: one
+// goroutine building the header data afresh for every nonce.
+func runSingle(pow *ProofOfWork) (int, []byte) {
+	var intHash big.Int
+	var hash [32]byte
+
+	nonce := 0
+	for nonce < math.MaxInt64 {
+		hash = sha256.Sum256(pow.InitData(nonce))
+		intHash.SetBytes(hash[:])
+
+		if intHash.Cmp(pow.Target) == -1 {
+			break
+		}
+		nonce++
+	}
+
+	return nonce, hash[:]
+}
+
+// benchHeaders returns headers that only differ in their timestamp, so that
+// every search starts over on a new nonce.
+func benchHeaders(n int) []*BlockHeader {
+	headers := make([]*BlockHeader, n)
+	for i := range headers {
+		headers[i] = &BlockHeader{
+			Version:    BlockVersion,
+			PrevHash:   make([]byte, 32),
+			MerkleRoot: make([]byte, 32),
+			Timestamp:  int64(i),
+			Difficulty: benchDifficulty,
+			Height:     1,
+		}
+	}
+
+	return headers
+}
+
+func BenchmarkMiner(b *testing.B) {
+	run := func(b *testing.B, search func(pow *ProofOfWork) (int, []byte, error)) {
+		headers := benchHeaders(b.N)
+		b.ResetTimer()
+
+		for _, header := range headers {
+			pow := NewProof(header)
+			nonce, _, err := search(pow)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			header.Nonce = nonce
+			if !pow.Validate() {
+				b.Fatalf("nonce %d does not meet the target", nonce)
+			}
+		}
+	}
+
+	b.Run("single-threaded", func(b *testing.B) {
+		run(b, func(pow *ProofOfWork) (int, []byte, error) {
+			nonce, hash := runSingle(pow)
+			return nonce, hash, nil
+		})
+	})
+
+	workers := []int{1, runtime.NumCPU()}
+	if workers[1] == 1 {
+		workers = workers[:1]
+	}
+	for _, n := range workers {
+		miner := Miner{Workers: n}
+		b.Run(fmt.Sprintf("miner-%d", n), func(b *testing.B) {
+			run(b, func(pow *ProofOfWork) (int, []byte, error) {
+				return miner.Run(context.Background(), pow)
+			})
+		})
+	}
+}
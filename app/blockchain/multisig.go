@@ -0,0 +1,237 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+var (
+	ErrInvalidMultiSig = errors.New("multisig script is not valid")
+	ErrKeyNotInScript  = errors.New("key is not one of the multisig keys")
+	ErrIncomplete      = errors.New("transaction does not have enough signatures")
+)
+
+// maxOutputIndex is one past the highest output index a spent transaction
+// could have: each of its outputs takes at least 12 bytes of a block.
+const maxOutputIndex = MaxBlockSize / 12
+
+// PartialInput is what the signers of an input spending a multisig output
+// need besides the transaction, and the signatures gathered so far.
+type PartialInput struct {
+	PrevOutput   TxOutput
+	RedeemScript Script
+	// Signatures has a slot for each key of the redeem script, in order.
+	Signatures [][]byte
+}
+
+type partialInputJSON struct {
+	PrevOutput   TxOutput   `json:"prevout"`
+	RedeemScript hexBytes   `json:"redeemscript"`
+	Signatures   []hexBytes `json:"signatures"`
+}
+
+func (in PartialInput) MarshalJSON() ([]byte, error) {
+	v := partialInputJSON{
+		PrevOutput:   in.PrevOutput,
+		RedeemScript: hexBytes(in.RedeemScript),
+		Signatures:   make([]hexBytes, len(in.Signatures)),
+	}
+	for i, signature := range in.Signatures {
+		v.Signatures[i] = signature
+	}
+
+	return json.Marshal(v)
+}
+
+func (in *PartialInput) UnmarshalJSON(data []byte) error {
+	var v partialInputJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*in = PartialInput{v.PrevOutput, Script(v.RedeemScript), make([][]byte, len(v.Signatures))}
+	for i, signature := range v.Signatures {
+		in.Signatures[i] = signature
+	}
+
+	return nil
+}
+
+// PartialTx is a transaction spending multisig outputs. It is passed between
+// the holders of the keys as JSON, each adding their signatures, until there
+// are enough to finalize it.
+type PartialTx struct {
+	Tx     Transaction    `json:"tx"`
+	Inputs []PartialInput `json:"inputs"`
+}
+
+// NewMultiSigTransaction builds an unsigned transaction paying amount from
+// the pay-to-script-hash address of a multisig redeem script to the address
+// to and fee to the miner, with any change going back to the multisig
+// address. The outputs spent are picked by selector as in NewTransaction.
+func NewMultiSigTransaction(redeemScript Script, to string, amount, fee int, selector CoinSelector, chain *BlockChain) (*PartialTx, error) {
+	_, pubKeys, ok := redeemScript.multiSig()
+	if !ok {
+		return nil, ErrInvalidMultiSig
+	}
+
+	from := string(ScriptAddress(redeemScript))
+	tx, err := newUnsignedTransaction(from, wallet.Hash160(redeemScript), []Payment{{to, amount}}, fee, selector, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	ptx := &PartialTx{Tx: *tx}
+	for _, in := range tx.Inputs {
+		prevOut, err := chain.FindOutput(in.Id, in.Out)
+		if err != nil {
+			return nil, err
+		}
+		ptx.Inputs = append(ptx.Inputs, PartialInput{
+			PrevOutput:   prevOut,
+			RedeemScript: redeemScript,
+			Signatures:   make([][]byte, len(pubKeys)),
+		})
+	}
+
+	return ptx, nil
+}
+
+// Sign adds the signatures of w to every input it holds a key of. It returns
+// how many signatures were added and fails with ErrKeyNotInScript if w holds
+// none of the keys.
+func (ptx *PartialTx) Sign(w *wallet.Wallet) (int, error) {
+	if len(ptx.Inputs) != len(ptx.Tx.Inputs) {
+		return 0, fmt.Errorf("%w: %d inputs but %d to sign", ErrInvalidMultiSig, len(ptx.Tx.Inputs), len(ptx.Inputs))
+	}
+
+	txCopy := ptx.Tx.TrimmedCopy()
+	added, found := 0, false
+
+	for i := range ptx.Inputs {
+		in := &ptx.Inputs[i]
+		_, pubKeys, ok := in.RedeemScript.multiSig()
+		if !ok || len(in.Signatures) != len(pubKeys) {
+			return added, ErrInvalidMultiSig
+		}
+
+		for k, pubKey := range pubKeys {
+			if !bytes.Equal(pubKey, w.PublicKey) {
+				continue
+			}
+			found = true
+			if len(in.Signatures[k]) > 0 {
+				continue
+			}
+
+			signature, err := wallet.Sign(&w.PrivateKey, sigHash(&txCopy, i, in.PrevOutput))
+			if err != nil {
+				return added, err
+			}
+			in.Signatures[k] = signature
+			added++
+		}
+	}
+
+	if !found {
+		return 0, fmt.Errorf("%w: %s", ErrKeyNotInScript, w.Address())
+	}
+
+	return added, nil
+}
+
+// PubKeys returns the keys of the redeem scripts of all inputs, each once.
+func (ptx *PartialTx) PubKeys() [][]byte {
+	var pubKeys [][]byte
+	seen := make(map[string]bool)
+
+	for _, in := range ptx.Inputs {
+		_, keys, _ := in.RedeemScript.multiSig()
+		for _, pubKey := range keys {
+			if !seen[string(pubKey)] {
+				seen[string(pubKey)] = true
+				pubKeys = append(pubKeys, pubKey)
+			}
+		}
+	}
+
+	return pubKeys
+}
+
+// Missing returns how many more signatures are needed, counting the input
+// that needs the most.
+func (ptx *PartialTx) Missing() int {
+	missing := 0
+	for _, in := range ptx.Inputs {
+		m, _, _ := in.RedeemScript.multiSig()
+		have := 0
+		for _, signature := range in.Signatures {
+			if len(signature) > 0 {
+				have++
+			}
+		}
+		if m-have > missing {
+			missing = m - have
+		}
+	}
+
+	return missing
+}
+
+// Finalize sets the ScriptSigs of the inputs to the first m signatures and
+// the redeem script and returns the transaction, which must then pass Verify.
+// It fails with ErrIncomplete if an input lacks signatures.
+func (ptx *PartialTx) Finalize() (*Transaction, error) {
+	if len(ptx.Inputs) != len(ptx.Tx.Inputs) {
+		return nil, fmt.Errorf("%w: %d inputs but %d signed", ErrInvalidMultiSig, len(ptx.Tx.Inputs), len(ptx.Inputs))
+	}
+	for i, in := range ptx.Tx.Inputs {
+		if in.Out < 0 || in.Out >= maxOutputIndex {
+			return nil, fmt.Errorf("%w: input %d spends output %d", ErrInvalidMultiSig, i, in.Out)
+		}
+	}
+	if missing := ptx.Missing(); missing > 0 {
+		return nil, fmt.Errorf("%w: %d more needed", ErrIncomplete, missing)
+	}
+
+	tx := ptx.Tx
+	tx.Inputs = make([]TxInput, len(ptx.Tx.Inputs))
+	prevTxs := make(map[string]Transaction)
+
+	for i, in := range ptx.Inputs {
+		m, _, _ := in.RedeemScript.multiSig()
+
+		scriptSig := Script{}
+		for _, signature := range in.Signatures {
+			if len(signature) > 0 && m > 0 {
+				scriptSig = scriptSig.AddData(signature)
+				m--
+			}
+		}
+		tx.Inputs[i] = ptx.Tx.Inputs[i]
+		tx.Inputs[i].ScriptSig = scriptSig.AddData(in.RedeemScript)
+
+		// Verify looks up spent outputs by transaction; one holding just
+		// the spent output at its index is enough.
+		prevId := hex.EncodeToString(tx.Inputs[i].Id)
+		prevTx, ok := prevTxs[prevId]
+		if !ok {
+			prevTx = Transaction{Id: tx.Inputs[i].Id}
+		}
+		for len(prevTx.Outputs) <= tx.Inputs[i].Out {
+			prevTx.Outputs = append(prevTx.Outputs, TxOutput{})
+		}
+		prevTx.Outputs[tx.Inputs[i].Out] = in.PrevOutput
+		prevTxs[prevId] = prevTx
+	}
+
+	if !tx.Verify(prevTxs) {
+		return nil, ErrInvalidSignature
+	}
+
+	return &tx, nil
+}
@@ -0,0 +1,170 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+// TestFinalizeBadInputs checks that a partial transaction passed around by
+// its signers cannot make Finalize index out of range or allocate for an
+// output index no transaction could have.
+func TestFinalizeBadInputs(t *testing.T) {
+	spending := func(outs ...int) Transaction {
+		tx := Transaction{Id: []byte("tx")}
+		for _, out := range outs {
+			tx.Inputs = append(tx.Inputs, TxInput{Id: []byte("prev"), Out: out})
+		}
+		return tx
+	}
+
+	tests := []struct {
+		name string
+		ptx  PartialTx
+	}{
+		{"negative output", PartialTx{spending(-1), make([]PartialInput, 1)}},
+		{"huge output", PartialTx{spending(1 << 40), make([]PartialInput, 1)}},
+		{"past the outputs that fit in a block", PartialTx{spending(0, maxOutputIndex), make([]PartialInput, 2)}},
+		{"more partial inputs than inputs", PartialTx{spending(0), make([]PartialInput, 2)}},
+		{"fewer partial inputs than inputs", PartialTx{spending(0, 1), make([]PartialInput, 1)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.ptx.Finalize(); !errors.Is(err, ErrInvalidMultiSig) {
+				t.Errorf("Finalize = %v, want %v", err, ErrInvalidMultiSig)
+			}
+		})
+	}
+}
+
+func newSchemeWallet(t *testing.T, scheme wallet.Scheme) *wallet.Wallet {
+	t.Helper()
+
+	private, public, err := wallet.NewKeyPair(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &wallet.Wallet{PrivateKey: private, PublicKey: public}
+}
+
+// spendMultiSig funds an m-of-n multisig address of the scheme and spends
+// from it with the signatures of the first m holders, the partial transaction
+// going between them as JSON, then checks the block holding the spend.
+func spendMultiSig(t *testing.T, scheme wallet.Scheme, m, n int) {
+	funder := newTestWallet(t)
+	payee := newTestWallet(t)
+	chain := newTestChain(t, funder, 0)
+
+	holders := make([]*wallet.Wallet, n)
+	pubKeys := make([][]byte, n)
+	for i := range holders {
+		holders[i] = newSchemeWallet(t, scheme)
+		pubKeys[i] = holders[i].PublicKey
+	}
+	redeemScript, err := MultiSigScript(m, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	funding, err := NewTransaction(funder, string(ScriptAddress(redeemScript)), 60, Fee{}, nil, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.MineBlock(string(funder.Address()), []*Transaction{funding}); err != nil {
+		t.Fatal(err)
+	}
+
+	ptx, err := NewMultiSigTransaction(redeemScript, string(payee.Address()), 50, 1, nil, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, holder := range holders[:m] {
+		if _, err := ptx.Finalize(); !errors.Is(err, ErrIncomplete) {
+			t.Fatalf("Finalize with %d signatures = %v, want %v", i, err, ErrIncomplete)
+		}
+
+		data, err := json.Marshal(ptx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptx = &PartialTx{}
+		if err := json.Unmarshal(data, ptx); err != nil {
+			t.Fatal(err)
+		}
+
+		if added, err := ptx.Sign(holder); err != nil || added != 1 {
+			t.Fatalf("holder %d added %d signatures: %v", i, added, err)
+		}
+	}
+	if ptx.Missing() != 0 {
+		t.Fatalf("%d signatures missing", ptx.Missing())
+	}
+
+	tx, err := ptx.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chain.VerifyTransaction(tx) {
+		t.Fatal("VerifyTransaction rejected the finalized transaction")
+	}
+
+	block := blockOn(t, chain, tipBlock(t, chain), string(funder.Address()), tx)
+	if err := chain.ValidateBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	if balance := balanceOf(t, chain, payee.PublicKey); balance != 50 {
+		t.Errorf("payee has %d, want 50", balance)
+	}
+}
+
+func TestMultiSigSpend(t *testing.T) {
+	tests := []struct {
+		scheme wallet.Scheme
+		m, n   int
+	}{
+		{wallet.Secp256k1, 2, 3},
+		{wallet.Secp256k1, 1, 1},
+		{wallet.Secp256k1, 2, 14},
+		{wallet.P256, 2, 3},
+		{wallet.P256, 3, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d-of-%d", tt.scheme.Name(), tt.m, tt.n), func(t *testing.T) {
+			spendMultiSig(t, tt.scheme, tt.m, tt.n)
+		})
+	}
+}
+
+// TestMultiSigScriptTooLarge checks that no address is made for a redeem
+// script too large to ever be pushed by the ScriptSig spending it.
+func TestMultiSigScriptTooLarge(t *testing.T) {
+	tests := []struct {
+		scheme wallet.Scheme
+		n      int
+	}{
+		{wallet.Secp256k1, 15},
+		{wallet.Secp256k1, 16},
+		{wallet.P256, 8},
+		{wallet.P256, 16},
+	}
+
+	for _, tt := range tests {
+		pubKeys := make([][]byte, tt.n)
+		for i := range pubKeys {
+			pubKeys[i] = newSchemeWallet(t, tt.scheme).PublicKey
+		}
+		if _, err := MultiSigScript(2, pubKeys); !errors.Is(err, ErrInvalidMultiSig) {
+			t.Errorf("%s with %d keys: MultiSigScript = %v, want %v", tt.scheme.Name(), tt.n, err, ErrInvalidMultiSig)
+		}
+	}
+}
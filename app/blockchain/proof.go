@@ -2,76 +2,72 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
-	"fmt"
-	"math"
 	"math/big"
 )
 
-// Take the data from the block
+// Take the data from the block header
 // Create a counter (nonce) which starts at 0
 // Create a hash of the data plus the counter
 // Check the hash to see if it meets a set of requirements
 // Requirements:
-// The first n bytes must contain 0s
-
-const Difficulty = 12 // in a real blockchain this has to be incremented with time
+// The first n bits must contain 0s, where n is the difficulty of the block
 
 type ProofOfWork struct {
-	Block  *Block
+	Header *BlockHeader
 	Target *big.Int
 }
 
-func NewProof(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
+// NewProof sets up the proof of work of a header. A difficulty out of range
+// gets a target of zero, which no hash meets.
+func NewProof(h *BlockHeader) *ProofOfWork {
+	target := big.NewInt(0)
+	if validDifficulty(h.Difficulty) {
+		target.Lsh(big.NewInt(1), uint(256-h.Difficulty))
+	}
 	return &ProofOfWork{
-		Block:  b,
+		Header: h,
 		Target: target,
 	}
 }
 func (pow *ProofOfWork) InitData(nonce int) []byte {
-	data := bytes.Join(
+	head, tail := pow.dataParts()
+
+	return bytes.Join([][]byte{head, ToHex(int64(nonce)), tail}, []byte{})
+}
+
+// dataParts returns the header data that comes before and after the nonce,
+// so that miners can vary the nonce without rebuilding the rest.
+func (pow *ProofOfWork) dataParts() ([]byte, []byte) {
+	head := bytes.Join(
 		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
-			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
+			ToHex(int64(pow.Header.Version)),
+			pow.Header.PrevHash,
+			pow.Header.MerkleRoot,
+			ToHex(pow.Header.Timestamp),
+			ToHex(int64(pow.Header.Difficulty)),
 		},
 		[]byte{},
 	)
+	tail := ToHex(int64(pow.Header.Height))
 
-	return data
+	return head, tail
 }
 
+// Run searches for the proof on every CPU and cannot be interrupted; use a
+// Miner to control the search.
 func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
-
-	nonce := 0
-
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)
-		hash = sha256.Sum256(data)
-
-		fmt.Printf("\r%x", hash)
-		intHash.SetBytes(hash[:])
-
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
-		}
-	}
-	fmt.Println() // new line for spacing
+	// Without a deadline the search only returns once it has found a nonce.
+	nonce, hash, _ := Miner{}.Run(context.Background(), pow)
 
-	return nonce, hash[:]
+	return nonce, hash
 }
 
 func (pow *ProofOfWork) Validate() bool {
 	var intHash big.Int
 
-	data := pow.InitData(pow.Block.Nonce)
+	data := pow.InitData(pow.Header.Nonce)
 	hash := sha256.Sum256(data)
 	intHash.SetBytes(hash[:])
 
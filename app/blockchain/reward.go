@@ -0,0 +1,95 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultReward is the amount a coinbase may create on top of the fees
+// collected from the transactions in its block.
+const DefaultReward = 100
+
+// MaxMoney bounds every amount the chain deals with: the value of an output
+// and the sums of the inputs, the outputs or the fees of a transaction or
+// block. Two amounts within it cannot overflow an int when added.
+//
+// Amounts are ints and MaxMoney takes 51 bits, so the package only builds
+// where int has 64 bits; elsewhere this declaration fails to compile.
+const MaxMoney int = 21000000 * 100000000
+
+var (
+	ErrMissingCoinbase  = errors.New("block does not start with a coinbase transaction")
+	ErrMultipleCoinbase = errors.New("block has more than one coinbase transaction")
+	ErrCoinbaseOverpays = errors.New("coinbase pays more than the block reward and fees")
+	ErrUnknownInput     = errors.New("input refers to an unknown output")
+)
+
+// inputValue resolves the value of the output an input spends. Outputs
+// created earlier in the same block are checked first, then the UTXO set and
+// finally the chain ending at prevHash.
+func (ch *BlockChain) inputValue(in TxInput, prevHash []byte, created map[string]TxOutput) (int, error) {
+	point := outpoint(in.Id, in.Out)
+
+	if out, ok := created[point]; ok {
+		return out.Value, nil
+	}
+	out, err := ch.FindOutput(in.Id, in.Out)
+	if err == nil {
+		return out.Value, nil
+	}
+	if !errors.Is(err, ErrOutputNotFound) {
+		return 0, err
+	}
+
+	prevTx, err := ch.findTransactionFrom(prevHash, in.Id)
+	if err != nil && !errors.Is(err, ErrTxNotFound) {
+		return 0, err
+	}
+	if err != nil || in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownInput, point)
+	}
+
+	return prevTx.Outputs[in.Out].Value, nil
+}
+
+// BlockFees sums what the non-coinbase transactions of a block on top of
+// prevHash leave unclaimed, that is the value of their inputs minus the value
+// of their outputs.
+func (ch *BlockChain) BlockFees(prevHash []byte, txs []*Transaction) (int, error) {
+	fees := 0
+	created := make(map[string]TxOutput)
+
+	for _, tx := range txs {
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, in := range tx.Inputs {
+			value, err := ch.inputValue(in, prevHash, created)
+			if err != nil {
+				return 0, err
+			}
+			fees += value
+		}
+		for outIdx, out := range tx.Outputs {
+			fees -= out.Value
+			created[outpoint(tx.Id, outIdx)] = out
+		}
+	}
+
+	return fees, nil
+}
+
+func validAmount(value int) bool {
+	return value >= 0 && value <= MaxMoney
+}
+
+// addMoney adds value to sum, which must both be valid amounts, and tells
+// whether the total still is one.
+func addMoney(sum, value int) (int, bool) {
+	if !validAmount(sum) || !validAmount(value) || sum+value > MaxMoney {
+		return 0, false
+	}
+
+	return sum + value, true
+}
@@ -0,0 +1,636 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+// Script is a program in a small stack language after Bitcoin's. An output is
+// locked by its ScriptPubKey. An input spends it with a ScriptSig that only
+// pushes data, and is valid if running the ScriptPubKey on those items leaves
+// true on top of the stack.
+type Script []byte
+
+// Opcodes. The bytes 0x01 to 0x4b push that many bytes that follow them.
+const (
+	Op0              = 0x00 // pushes an empty item, which is false
+	OpPushData1      = 0x4c // the next byte is the length of the item to push
+	OpPushData2      = 0x4d // the next two bytes, little endian, are the length
+	Op1              = 0x51 // Op1 to Op16 push the numbers 1 to 16
+	Op16             = 0x60
+	OpVerify         = 0x69
+	OpReturn         = 0x6a
+	OpDrop           = 0x75
+	OpDup            = 0x76
+	OpEqual          = 0x87
+	OpEqualVerify    = 0x88
+	OpHash160        = 0xa9
+	OpCheckSig       = 0xac
+	OpCheckSigVerify = 0xad
+	// OpCheckMultiSig pops n, n public keys, m and m signatures, and pushes
+	// whether every signature is by a different key, in the order of the
+	// keys.
+	OpCheckMultiSig       = 0xae
+	OpCheckMultiSigVerify = 0xaf
+	// OpKeyVersion pushes the address version of the scheme of the public
+	// key on top of the stack, leaving the key there.
+	OpKeyVersion = 0xc0
+)
+
+const (
+	maxScriptSize = 10000
+	maxItemSize   = 520
+	maxStackSize  = 1000
+	// MaxMultiSigKeys is the most keys a multisig script can have, as n is
+	// pushed with one of Op1 to Op16.
+	MaxMultiSigKeys = 16
+)
+
+var (
+	ErrMalformedScript   = errors.New("script is malformed")
+	ErrScriptFailed      = errors.New("script failed")
+	ErrNonStandardScript = errors.New("script is not a standard one")
+)
+
+var opNames = map[byte]string{
+	Op0:                   "OP_0",
+	OpVerify:              "OP_VERIFY",
+	OpReturn:              "OP_RETURN",
+	OpDrop:                "OP_DROP",
+	OpDup:                 "OP_DUP",
+	OpEqual:               "OP_EQUAL",
+	OpEqualVerify:         "OP_EQUALVERIFY",
+	OpHash160:             "OP_HASH160",
+	OpCheckSig:            "OP_CHECKSIG",
+	OpCheckSigVerify:      "OP_CHECKSIGVERIFY",
+	OpCheckMultiSig:       "OP_CHECKMULTISIG",
+	OpCheckMultiSigVerify: "OP_CHECKMULTISIGVERIFY",
+	OpKeyVersion:          "OP_KEYVERSION",
+}
+
+// AddOp returns the script with an opcode appended.
+func (s Script) AddOp(op byte) Script {
+	return append(s, op)
+}
+
+// AddData returns the script with a push of data appended, using the
+// shortest encoding.
+func (s Script) AddData(data []byte) Script {
+	switch {
+	case len(data) == 0:
+		return append(s, Op0)
+	case len(data) < OpPushData1:
+		s = append(s, byte(len(data)))
+	case len(data) <= 0xff:
+		s = append(s, OpPushData1, byte(len(data)))
+	default:
+		var length [2]byte
+		binary.LittleEndian.PutUint16(length[:], uint16(len(data)))
+		s = append(append(s, OpPushData2), length[:]...)
+	}
+
+	return append(s, data...)
+}
+
+// instruction is an opcode along with the data it pushes, if any.
+type instruction struct {
+	op   byte
+	data []byte
+}
+
+func (s Script) parse() ([]instruction, error) {
+	if len(s) > maxScriptSize {
+		return nil, fmt.Errorf("%w: %d bytes is too long", ErrMalformedScript, len(s))
+	}
+
+	var instructions []instruction
+	for i := 0; i < len(s); {
+		op := s[i]
+		i++
+
+		length := 0
+		switch {
+		case op > Op0 && op < OpPushData1:
+			length = int(op)
+		case op == OpPushData1:
+			if i+1 > len(s) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA1", ErrMalformedScript)
+			}
+			length = int(s[i])
+			i++
+		case op == OpPushData2:
+			if i+2 > len(s) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA2", ErrMalformedScript)
+			}
+			length = int(binary.LittleEndian.Uint16(s[i:]))
+			i += 2
+		}
+
+		if i+length > len(s) {
+			return nil, fmt.Errorf("%w: push of %d bytes runs past the end", ErrMalformedScript, length)
+		}
+
+		var data []byte
+		if op < OpPushData1 || op == OpPushData1 || op == OpPushData2 {
+			data = s[i : i+length]
+		}
+		instructions = append(instructions, instruction{op, data})
+		i += length
+	}
+
+	return instructions, nil
+}
+
+func isPush(op byte) bool {
+	return op <= OpPushData2 || (op >= Op1 && op <= Op16)
+}
+
+// pushes returns the items a push-only script puts on the stack.
+func (s Script) pushes() ([][]byte, bool) {
+	instructions, err := s.parse()
+	if err != nil {
+		return nil, false
+	}
+
+	var items [][]byte
+	for _, in := range instructions {
+		if !isPush(in.op) {
+			return nil, false
+		}
+		items = append(items, pushedItem(in))
+	}
+
+	return items, true
+}
+
+func pushedItem(in instruction) []byte {
+	if in.op >= Op1 && in.op <= Op16 {
+		return []byte{in.op - Op1 + 1}
+	}
+
+	return in.data
+}
+
+func (s Script) String() string {
+	instructions, err := s.parse()
+	if err != nil {
+		return fmt.Sprintf("[malformed %x]", []byte(s))
+	}
+
+	words := make([]string, 0, len(instructions))
+	for _, in := range instructions {
+		switch {
+		case in.op >= Op1 && in.op <= Op16:
+			words = append(words, fmt.Sprintf("OP_%d", in.op-Op1+1))
+		case in.op != Op0 && isPush(in.op):
+			words = append(words, hex.EncodeToString(in.data))
+		case opNames[in.op] != "":
+			words = append(words, opNames[in.op])
+		default:
+			words = append(words, fmt.Sprintf("OP_UNKNOWN_%#x", in.op))
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+// PayToPubKeyHash is the standard script locking an output to a key of the
+// scheme with the version:
+//
+//	OP_KEYVERSION <version> OP_EQUALVERIFY OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+//
+// It is spent with <signature> <pubKey>.
+func PayToPubKeyHash(version byte, pubKeyHash []byte) Script {
+	return Script{}.
+		AddOp(OpKeyVersion).AddData([]byte{version}).AddOp(OpEqualVerify).
+		AddOp(OpDup).AddOp(OpHash160).AddData(pubKeyHash).AddOp(OpEqualVerify).
+		AddOp(OpCheckSig)
+}
+
+// PayToScriptHash is the standard script locking an output to the hash of a
+// redeem script:
+//
+//	OP_HASH160 <scriptHash> OP_EQUAL
+//
+// It is spent with the items the redeem script needs followed by the redeem
+// script itself, which is then run on those items.
+func PayToScriptHash(scriptHash []byte) Script {
+	return Script{}.AddOp(OpHash160).AddData(scriptHash).AddOp(OpEqual)
+}
+
+// MultiSigScript returns the redeem script needing m signatures by the keys:
+//
+//	OP_m <pubKey>... OP_n OP_CHECKMULTISIG
+//
+// It is spent with the signatures in the order of their keys. It fails with
+// ErrInvalidMultiSig unless 1 <= m <= n <= MaxMultiSigKeys, every key is of a
+// known scheme and the script fits in a single stack item, as it has to be
+// pushed by the ScriptSig spending it. That allows 14 secp256k1 keys but
+// only 7 P-256 ones.
+func MultiSigScript(m int, pubKeys [][]byte) (Script, error) {
+	n := len(pubKeys)
+	if m < 1 || m > n || n > MaxMultiSigKeys {
+		return nil, fmt.Errorf("%w: %d of %d keys", ErrInvalidMultiSig, m, n)
+	}
+
+	script := Script{}.AddOp(byte(Op1 + m - 1))
+	for _, pubKey := range pubKeys {
+		if _, ok := wallet.SchemeOf(pubKey); !ok {
+			return nil, fmt.Errorf("%w: %x is not a public key", ErrInvalidMultiSig, pubKey)
+		}
+		script = script.AddData(pubKey)
+	}
+
+	script = script.AddOp(byte(Op1 + n - 1)).AddOp(OpCheckMultiSig)
+	if len(script) > maxItemSize {
+		return nil, fmt.Errorf("%w: %d keys make a script of %d bytes, more than %d", ErrInvalidMultiSig, n, len(script), maxItemSize)
+	}
+
+	return script, nil
+}
+
+// multiSig returns m and the keys of a multisig redeem script.
+func (s Script) multiSig() (int, [][]byte, bool) {
+	instructions, err := s.parse()
+	if err != nil || len(instructions) < 4 {
+		return 0, nil, false
+	}
+
+	first, last := instructions[0], instructions[len(instructions)-2]
+	if instructions[len(instructions)-1].op != OpCheckMultiSig ||
+		first.op < Op1 || first.op > Op16 || last.op < Op1 || last.op > Op16 {
+		return 0, nil, false
+	}
+	m, n := int(first.op-Op1+1), int(last.op-Op1+1)
+
+	keys := instructions[1 : len(instructions)-2]
+	if len(keys) != n || m > n {
+		return 0, nil, false
+	}
+	pubKeys := make([][]byte, 0, n)
+	for _, key := range keys {
+		if key.op == Op0 || key.op > OpPushData2 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, key.data)
+	}
+
+	return m, pubKeys, true
+}
+
+// ScriptAddress returns the pay-to-script-hash address of a redeem script.
+func ScriptAddress(redeemScript Script) []byte {
+	return wallet.ScriptHashAddress(redeemScript)
+}
+
+// LockingScript returns the standard script paying to an address.
+func LockingScript(address string) (Script, error) {
+	version, hash, err := wallet.ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if version == wallet.VersionScriptHash {
+		return PayToScriptHash(hash), nil
+	}
+
+	return PayToPubKeyHash(version, hash), nil
+}
+
+// payToPubKeyHash returns the key version and hash of a pay-to-pubkey-hash
+// script.
+func (s Script) payToPubKeyHash() (byte, []byte, bool) {
+	instructions, err := s.parse()
+	if err != nil || len(instructions) != 8 {
+		return 0, nil, false
+	}
+
+	ops := []byte{OpKeyVersion, 1, OpEqualVerify, OpDup, OpHash160, 20, OpEqualVerify, OpCheckSig}
+	for i, op := range ops {
+		if instructions[i].op != op {
+			return 0, nil, false
+		}
+	}
+
+	return instructions[1].data[0], instructions[5].data, true
+}
+
+// payToScriptHash returns the script hash of a pay-to-script-hash script.
+func (s Script) payToScriptHash() ([]byte, bool) {
+	if len(s) != 23 || s[0] != OpHash160 || s[1] != 20 || s[22] != OpEqual {
+		return nil, false
+	}
+
+	return s[2:22], true
+}
+
+// Hash returns the public key or script hash a standard script pays to.
+func (s Script) Hash() ([]byte, bool) {
+	if _, hash, ok := s.payToPubKeyHash(); ok {
+		return hash, true
+	}
+
+	return s.payToScriptHash()
+}
+
+// Address returns the address a standard script pays to.
+func (s Script) Address() ([]byte, bool) {
+	if version, hash, ok := s.payToPubKeyHash(); ok {
+		return wallet.HashToAddress(version, hash), true
+	}
+	if hash, ok := s.payToScriptHash(); ok {
+		return wallet.HashToAddress(wallet.VersionScriptHash, hash), true
+	}
+
+	return nil, false
+}
+
+// sigChecker tells whether signature is a valid signature of the input being
+// run by the key pubKey.
+type sigChecker func(signature, pubKey []byte) bool
+
+type stack [][]byte
+
+func (st *stack) push(item []byte) error {
+	if len(item) > maxItemSize {
+		return fmt.Errorf("%w: item of %d bytes is too large", ErrScriptFailed, len(item))
+	}
+	if len(*st) >= maxStackSize {
+		return fmt.Errorf("%w: stack is too large", ErrScriptFailed)
+	}
+	*st = append(*st, item)
+
+	return nil
+}
+
+func (st *stack) pop() ([]byte, error) {
+	if len(*st) == 0 {
+		return nil, fmt.Errorf("%w: stack is empty", ErrScriptFailed)
+	}
+	item := (*st)[len(*st)-1]
+	*st = (*st)[:len(*st)-1]
+
+	return item, nil
+}
+
+func (st *stack) peek() ([]byte, error) {
+	if len(*st) == 0 {
+		return nil, fmt.Errorf("%w: stack is empty", ErrScriptFailed)
+	}
+
+	return (*st)[len(*st)-1], nil
+}
+
+func (st *stack) popBool() (bool, error) {
+	item, err := st.pop()
+	if err != nil {
+		return false, err
+	}
+
+	return isTrue(item), nil
+}
+
+// isTrue tells whether an item counts as true: any non-zero byte makes it so.
+func isTrue(item []byte) bool {
+	for _, b := range item {
+		if b != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// smallInt reads a number from 0 to 16 as pushed by Op0 and Op1 to Op16.
+func smallInt(item []byte) (int, error) {
+	if len(item) > 1 || (len(item) == 1 && item[0] > 16) {
+		return 0, fmt.Errorf("%w: %x is not a small number", ErrScriptFailed, item)
+	}
+	if len(item) == 0 {
+		return 0, nil
+	}
+
+	return int(item[0]), nil
+}
+
+func (st *stack) popSmallInt() (int, error) {
+	item, err := st.pop()
+	if err != nil {
+		return 0, err
+	}
+
+	return smallInt(item)
+}
+
+func boolItem(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+
+	return nil
+}
+
+// execute runs a script on the stack.
+func execute(script Script, st *stack, check sigChecker) error {
+	instructions, err := script.parse()
+	if err != nil {
+		return err
+	}
+
+	for _, in := range instructions {
+		if err := step(in, st, check); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func step(in instruction, st *stack, check sigChecker) error {
+	if isPush(in.op) {
+		return st.push(pushedItem(in))
+	}
+
+	switch in.op {
+	case OpVerify:
+		ok, err := st.popBool()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: OP_VERIFY", ErrScriptFailed)
+		}
+
+	case OpReturn:
+		return fmt.Errorf("%w: OP_RETURN", ErrScriptFailed)
+
+	case OpDrop:
+		_, err := st.pop()
+		return err
+
+	case OpDup:
+		item, err := st.peek()
+		if err != nil {
+			return err
+		}
+		return st.push(item)
+
+	case OpEqual, OpEqualVerify:
+		a, err := st.pop()
+		if err != nil {
+			return err
+		}
+		b, err := st.pop()
+		if err != nil {
+			return err
+		}
+		equal := bytes.Equal(a, b)
+		if in.op == OpEqualVerify {
+			if !equal {
+				return fmt.Errorf("%w: OP_EQUALVERIFY", ErrScriptFailed)
+			}
+			return nil
+		}
+		return st.push(boolItem(equal))
+
+	case OpHash160:
+		item, err := st.pop()
+		if err != nil {
+			return err
+		}
+		return st.push(wallet.Hash160(item))
+
+	case OpCheckSig, OpCheckSigVerify:
+		pubKey, err := st.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := st.pop()
+		if err != nil {
+			return err
+		}
+		valid := check(signature, pubKey)
+		if in.op == OpCheckSigVerify {
+			if !valid {
+				return fmt.Errorf("%w: OP_CHECKSIGVERIFY", ErrScriptFailed)
+			}
+			return nil
+		}
+		return st.push(boolItem(valid))
+
+	case OpCheckMultiSig, OpCheckMultiSigVerify:
+		valid, err := checkMultiSig(st, check)
+		if err != nil {
+			return err
+		}
+		if in.op == OpCheckMultiSigVerify {
+			if !valid {
+				return fmt.Errorf("%w: OP_CHECKMULTISIGVERIFY", ErrScriptFailed)
+			}
+			return nil
+		}
+		return st.push(boolItem(valid))
+
+	case OpKeyVersion:
+		pubKey, err := st.peek()
+		if err != nil {
+			return err
+		}
+		scheme, ok := wallet.SchemeOf(pubKey)
+		if !ok {
+			return fmt.Errorf("%w: OP_KEYVERSION of a key of no known scheme", ErrScriptFailed)
+		}
+		return st.push([]byte{scheme.Version()})
+
+	default:
+		return fmt.Errorf("%w: unknown opcode %#x", ErrScriptFailed, in.op)
+	}
+
+	return nil
+}
+
+// checkMultiSig pops the operands of OpCheckMultiSig and tells whether the
+// signatures match the keys. Each signature is tried against the keys after
+// the one the previous signature matched.
+func checkMultiSig(st *stack, check sigChecker) (bool, error) {
+	n, err := st.popSmallInt()
+	if err != nil {
+		return false, err
+	}
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = st.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := st.popSmallInt()
+	if err != nil {
+		return false, err
+	}
+	if m > n {
+		return false, fmt.Errorf("%w: %d of %d keys", ErrScriptFailed, m, n)
+	}
+	signatures := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if signatures[i], err = st.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	key := 0
+	for _, signature := range signatures {
+		for key < n && !check(signature, pubKeys[key]) {
+			key++
+		}
+		if key == n {
+			return false, nil
+		}
+		key++
+	}
+
+	return true, nil
+}
+
+// verifyScript runs scriptSig and then scriptPubKey on the items it pushed.
+// For pay-to-script-hash the redeem script, the last item of scriptSig, is
+// then run on the items before it.
+func verifyScript(scriptSig, scriptPubKey Script, check sigChecker) error {
+	items, ok := scriptSig.pushes()
+	if !ok {
+		return fmt.Errorf("%w: ScriptSig does not only push data", ErrScriptFailed)
+	}
+
+	st := stack{}
+	for _, item := range items {
+		if err := st.push(item); err != nil {
+			return err
+		}
+	}
+	if err := execute(scriptPubKey, &st, check); err != nil {
+		return err
+	}
+	if ok, err := st.popBool(); err != nil || !ok {
+		return fmt.Errorf("%w: ScriptPubKey did not end with true", ErrScriptFailed)
+	}
+
+	if _, ok := scriptPubKey.payToScriptHash(); !ok {
+		return nil
+	}
+
+	redeemScript := Script(items[len(items)-1])
+	st = append(stack{}, items[:len(items)-1]...)
+	if err := execute(redeemScript, &st, check); err != nil {
+		return err
+	}
+	if ok, err := st.popBool(); err != nil || !ok {
+		return fmt.Errorf("%w: redeem script did not end with true", ErrScriptFailed)
+	}
+
+	return nil
+}
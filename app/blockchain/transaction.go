@@ -3,75 +3,205 @@ package blockchain
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/serj1c/blockchainio/app/wallet"
-	"log"
-	"math/big"
 	"strings"
 )
 
+var (
+	ErrInsufficientFunds = errors.New("not enough funds")
+	ErrNegativeFee       = errors.New("fee is negative")
+	ErrNoPayments        = errors.New("transaction pays no one")
+	ErrInvalidAmount     = errors.New("amount must be positive and at most MaxMoney")
+)
+
 type Transaction struct {
 	Id      []byte
 	Inputs  []TxInput
 	Outputs []TxOutput
 }
 
-func NewTransaction(from, to string, amount int, chain *BlockChain) *Transaction {
+// Fee is what a new transaction leaves to the miner: Amount, or if Rate is
+// set, Rate for every 1000 bytes of the signed transaction, whichever is more.
+type Fee struct {
+	Amount int
+	Rate   int
+}
+
+// For returns the fee of a transaction of size bytes.
+func (f Fee) For(size int) int {
+	fee := (f.Rate*size + 999) / 1000
+	if fee < f.Amount {
+		return f.Amount
+	}
+
+	return fee
+}
+
+// Payment is an amount to pay to an address.
+type Payment struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
+// NewTransaction builds and signs a transaction paying amount from the
+// wallet to the address to and fee to the miner, with any change going back
+// to the wallet. The outputs spent are picked by selector, DefaultCoinSelector
+// if nil. It fails with ErrInsufficientFunds if the wallet cannot cover both
+// and with wallet.ErrInvalidAddress if to is not a valid address.
+func NewTransaction(w *wallet.Wallet, to string, amount int, fee Fee, selector CoinSelector, chain *BlockChain) (*Transaction, error) {
+	return NewBatchTransaction(w, []Payment{{to, amount}}, fee, selector, chain)
+}
+
+// NewBatchTransaction is NewTransaction making one output for each payment.
+// Every address is checked before any output is picked to spend.
+func NewBatchTransaction(w *wallet.Wallet, payments []Payment, fee Fee, selector CoinSelector, chain *BlockChain) (*Transaction, error) {
+	from := fmt.Sprintf("%s", w.Address())
+
+	// The size, and with it a fee by rate, is only known once signed. Each
+	// round pays at least what the previous one needed, until it is enough.
+	paid := fee.Amount
+	for {
+		tx, err := newUnsignedTransaction(from, wallet.PublicKeyHash(w.PublicKey), payments, paid, selector, chain)
+		if err != nil {
+			return nil, err
+		}
+		if err := chain.SignTransaction(tx, w.PrivateKey); err != nil {
+			return nil, err
+		}
+
+		needed := fee.For(tx.Size())
+		if needed <= paid {
+			return tx, nil
+		}
+		paid = needed
+	}
+}
+
+// newUnsignedTransaction spends outputs paying to pubKeyHash, the hash of the
+// address from, to make the payments and pay fee to the miner. Change goes
+// back to from.
+func newUnsignedTransaction(from string, pubKeyHash []byte, payments []Payment, fee int, selector CoinSelector, chain *BlockChain) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
-	wallets, err := wallet.CreateWallets()
-	if err != nil {
-		log.Panic(err)
+	if len(payments) == 0 {
+		return nil, ErrNoPayments
 	}
-	w := wallets.GetWallet(from)
-	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-
-	acc, validOutputs := chain.FindSpendableOutputs(pubKeyHash, amount)
-	if acc < amount {
-		log.Panic("Error: not enough funds")
+	for _, payment := range payments {
+		if err := wallet.ValidateAddress(payment.Address); err != nil {
+			return nil, err
+		}
+		if payment.Amount <= 0 || payment.Amount > MaxMoney {
+			return nil, fmt.Errorf("%w: %d to %s", ErrInvalidAmount, payment.Amount, payment.Address)
+		}
 	}
 
-	for id, outs := range validOutputs {
-		txID, err := hex.DecodeString(id)
+	amount := 0
+	for _, payment := range payments {
+		out, err := NewTxOutput(payment.Amount, payment.Address)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
-
-		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
-			inputs = append(inputs, input)
+		outputs = append(outputs, *out)
+		var ok bool
+		if amount, ok = addMoney(amount, payment.Amount); !ok {
+			return nil, fmt.Errorf("%w: the payments", ErrMoneyOverflow)
 		}
 	}
 
-	outputs = append(outputs, *NewTxOutput(amount, to))
+	if fee < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrNegativeFee, fee)
+	}
+	target, ok := addMoney(amount, fee)
+	if !ok {
+		return nil, fmt.Errorf("%w: the payments and the fee", ErrMoneyOverflow)
+	}
 
-	if acc > amount {
-		outputs = append(outputs, *NewTxOutput(acc-amount, from))
+	if selector == nil {
+		selector = DefaultCoinSelector
+	}
+
+	coins, err := chain.ListUnspent(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selector.Select(coins, target)
+	if err != nil {
+		return nil, err
+	}
+
+	acc := 0
+	for _, coin := range selected {
+		inputs = append(inputs, TxInput{coin.TxId, coin.Index, nil})
+		if acc, ok = addMoney(acc, coin.Output.Value); !ok {
+			return nil, fmt.Errorf("%w: the outputs spent", ErrMoneyOverflow)
+		}
+	}
+
+	if acc > target {
+		change, err := NewTxOutput(acc-target, from)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *change)
 	}
 
 	tx := Transaction{nil, inputs, outputs}
 	tx.Id = tx.Hash()
-	chain.SignTransaction(&tx, w.PrivateKey)
 
-	return &tx
+	return &tx, nil
 }
 
+// Serialize encodes the transaction for the database and the network.
 func (tx *Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
+	return encode(tx)
+}
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
+// canonical is the encoding ids, signature digests and sizes are computed
+// from. Gob output depends on which types the program happened to encode
+// first, so it cannot be hashed; here every byte string is preceded by its
+// length and every number is a fixed number of big-endian bytes.
+func (tx *Transaction) canonical() []byte {
+	var buffer bytes.Buffer
+
+	writeBytes(&buffer, tx.Id)
+	writeUint32(&buffer, len(tx.Inputs))
+	for _, in := range tx.Inputs {
+		writeBytes(&buffer, in.Id)
+		buffer.Write(ToHex(int64(in.Out)))
+		writeBytes(&buffer, in.ScriptSig)
+	}
+	writeUint32(&buffer, len(tx.Outputs))
+	for _, out := range tx.Outputs {
+		buffer.Write(ToHex(int64(out.Value)))
+		writeBytes(&buffer, out.ScriptPubKey)
+	}
+
+	return buffer.Bytes()
+}
+
+// Size is the number of bytes of the canonical encoding of the transaction,
+// which fee rates and the block size limit are counted against.
+func (tx *Transaction) Size() int {
+	return len(tx.canonical())
+}
+
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	var transaction Transaction
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&transaction)
 	if err != nil {
-		log.Panic(err)
+		return Transaction{}, fmt.Errorf("decoding transaction: %w", err)
 	}
 
-	return encoded.Bytes()
+	return transaction, nil
 }
 
 func (tx *Transaction) Hash() []byte {
@@ -80,40 +210,56 @@ func (tx *Transaction) Hash() []byte {
 	txCopy := *tx
 	txCopy.Id = []byte{}
 
-	hash = sha256.Sum256(txCopy.Serialize())
+	hash = sha256.Sum256(txCopy.canonical())
 
 	return hash[:]
 }
 
-func (tx *Transaction) SetId() {
-	var encoded bytes.Buffer
-	var hash [32]byte
+// unsignedHash is what a transaction id is computed from: the transaction
+// with the ScriptSigs of its inputs left out, except for the data of a
+// coinbase.
+func (tx *Transaction) unsignedHash() []byte {
+	txCopy := *tx
+	txCopy.Inputs = make([]TxInput, len(tx.Inputs))
 
-	encode := gob.NewEncoder(&encoded)
-	err := encode.Encode(tx)
-	if err != nil {
-		log.Panic(err)
+	for i, in := range tx.Inputs {
+		if !tx.IsCoinbase() {
+			in.ScriptSig = nil
+		}
+		txCopy.Inputs[i] = in
 	}
 
-	hash = sha256.Sum256(encoded.Bytes())
-	tx.Id = hash[:]
+	return txCopy.Hash()
+}
+
+func (tx *Transaction) SetId() {
+	tx.Id = tx.Hash()
 }
 
-func CoinbaseTx(to, data string) *Transaction {
+func CoinbaseTx(to, data string, value int) (*Transaction, error) {
 	if data == "" {
-		data = fmt.Sprintf("Coins to %s", to)
+		randData := make([]byte, 24)
+		_, err := rand.Read(randData)
+		if err != nil {
+			return nil, err
+		}
+		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTxOutput(100, to)
+	txin := TxInput{[]byte{}, -1, Script{}.AddData([]byte(data))}
+	txout, err := NewTxOutput(value, to)
+	if err != nil {
+		return nil, err
+	}
 
 	tx := Transaction{
 		Id:      nil,
 		Inputs:  []TxInput{txin},
 		Outputs: []TxOutput{*txout},
 	}
+	tx.Id = tx.Hash()
 
-	return &tx
+	return &tx, nil
 }
 
 func (tx *Transaction) IsCoinbase() bool {
@@ -125,11 +271,11 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TxOutput
 
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.Id, in.Out, nil, nil})
+		inputs = append(inputs, TxInput{in.Id, in.Out, nil})
 	}
 
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TxOutput{out.Value, out.ScriptPubKey})
 	}
 
 	return Transaction{
@@ -139,69 +285,89 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	}
 }
 
-func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTxs map[string]Transaction) {
+// sigHash is the digest signed for one input: the trimmed transaction with
+// that input carrying the ScriptPubKey of the output it spends.
+func sigHash(txCopy *Transaction, inputId int, prevOut TxOutput) []byte {
+	txCopy.Inputs[inputId].ScriptSig = prevOut.ScriptPubKey
+	hash := txCopy.Hash()
+	txCopy.Inputs[inputId].ScriptSig = nil
+
+	return hash
+}
+
+// prevOutput returns the output an input spends, if prevTxs holds it.
+func prevOutput(in TxInput, prevTxs map[string]Transaction) (TxOutput, bool) {
+	prevTx, ok := prevTxs[hex.EncodeToString(in.Id)]
+	if !ok || prevTx.Id == nil || in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+		return TxOutput{}, false
+	}
+
+	return prevTx.Outputs[in.Out], true
+}
+
+// Sign signs every input with privateKey, setting its ScriptSig to the
+// signature and the public key. The inputs must spend pay-to-pubkey-hash
+// outputs, else it fails with ErrNonStandardScript. prevTxs must hold the
+// transactions whose outputs the inputs spend; otherwise it fails with
+// ErrUnknownInput.
+func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, prevTxs map[string]Transaction) error {
 	if tx.IsCoinbase() {
-		return
+		return nil
+	}
+
+	scheme, ok := wallet.SchemeOfKey(&privateKey)
+	if !ok {
+		return wallet.ErrUnknownScheme
 	}
+	pubKey := scheme.EncodePublicKey(&privateKey.PublicKey)
 
 	for _, in := range tx.Inputs {
-		if prevTxs[hex.EncodeToString(in.Id)].Id == nil {
-			log.Panic("ERROR: Previous transaction does not exist")
+		prevOut, ok := prevOutput(in, prevTxs)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownInput, outpoint(in.Id, in.Out))
+		}
+		if _, _, ok := prevOut.ScriptPubKey.payToPubKeyHash(); !ok {
+			return fmt.Errorf("%w: %s does not pay to a public key hash", ErrNonStandardScript, outpoint(in.Id, in.Out))
 		}
 	}
 
 	txCopy := tx.TrimmedCopy()
 
-	for inputId, input := range txCopy.Inputs {
-		prevTx := prevTxs[hex.EncodeToString(input.Id)]
-		txCopy.Inputs[inputId].Signature = nil
-		txCopy.Inputs[inputId].PubKey = prevTx.Outputs[input.Out].PubKeyHash
-		txCopy.Id = txCopy.Hash()
-		txCopy.Inputs[inputId].PubKey = nil
+	for inputId, input := range tx.Inputs {
+		prevOut, _ := prevOutput(input, prevTxs)
+		hash := sigHash(&txCopy, inputId, prevOut)
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privateKey, txCopy.Id)
+		signature, err := scheme.Sign(&privateKey, hash)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
-		tx.Inputs[inputId].Signature = signature
+		tx.Inputs[inputId].ScriptSig = Script{}.AddData(signature).AddData(pubKey)
 	}
+
+	return nil
 }
 
+// Verify runs the ScriptSig of every input against the ScriptPubKey of the
+// output it spends. It returns false if any script fails or any spent output
+// is missing from prevTxs.
 func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
 
-	for _, in := range tx.Inputs {
-		if prevTxs[hex.EncodeToString(in.Id)].Id == nil {
-			log.Panic("ERROR: Previous transaction does not exist")
-		}
-	}
 	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
 
 	for inputId, input := range tx.Inputs {
-		prevTx := prevTxs[hex.EncodeToString(input.Id)]
-		txCopy.Inputs[inputId].Signature = nil
-		txCopy.Inputs[inputId].PubKey = prevTx.Outputs[input.Out].PubKeyHash
-		txCopy.Id = txCopy.Hash()
-		txCopy.Inputs[inputId].PubKey = nil
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(input.Signature)
-		r.SetBytes(input.Signature[:(sigLen / 2)])
-		s.SetBytes(input.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(input.Signature)
-		x.SetBytes(input.Signature[:(keyLen / 2)])
-		y.SetBytes(input.Signature[(keyLen / 2):])
-
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPubKey, txCopy.Id, &r, &s) == false {
+		prevOut, ok := prevOutput(input, prevTxs)
+		if !ok {
+			return false
+		}
+
+		hash := sigHash(&txCopy, inputId, prevOut)
+		check := func(signature, pubKey []byte) bool {
+			return wallet.Verify(pubKey, hash, signature)
+		}
+		if err := verifyScript(input.ScriptSig, prevOut.ScriptPubKey, check); err != nil {
 			return false
 		}
 	}
@@ -216,14 +382,13 @@ func (tx Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:     %x", input.Id))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Out))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		lines = append(lines, fmt.Sprintf("       ScriptSig: %s", input.ScriptSig))
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("       Script: %s", output.ScriptPubKey))
 	}
 
 	return strings.Join(lines, "\n")
@@ -0,0 +1,223 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+func newTestWallet(t *testing.T) *wallet.Wallet {
+	t.Helper()
+
+	w, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
+
+// newTestChain starts a chain in a temporary directory paying the genesis
+// reward to w, then mines the given number of blocks rewarding w.
+func newTestChain(t *testing.T, w *wallet.Wallet, blocks int) *BlockChain {
+	t.Helper()
+
+	chain, err := InitBlockChain(string(w.Address()), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+
+	for i := 0; i < blocks; i++ {
+		if _, err := chain.MineBlock(string(w.Address()), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return chain
+}
+
+func balanceOf(t *testing.T, chain *BlockChain, pubKey []byte) int {
+	t.Helper()
+
+	outs, err := chain.FindUTxO(wallet.PublicKeyHash(pubKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance := 0
+	for _, out := range outs {
+		balance += out.Value
+	}
+
+	return balance
+}
+
+func cloneTx(t *testing.T, tx *Transaction) *Transaction {
+	t.Helper()
+
+	clone, err := DeserializeTransaction(tx.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &clone
+}
+
+// scriptSigItems splits a pay-to-pubkey-hash ScriptSig into its signature
+// and public key.
+func scriptSigItems(t *testing.T, in TxInput) ([]byte, []byte) {
+	t.Helper()
+
+	items, ok := in.ScriptSig.pushes()
+	if !ok || len(items) != 2 {
+		t.Fatalf("ScriptSig %s is not a signature and a public key", in.ScriptSig)
+	}
+
+	return items[0], items[1]
+}
+
+func setScriptSig(in *TxInput, signature, pubKey []byte) {
+	in.ScriptSig = Script{}.AddData(signature).AddData(pubKey)
+}
+
+func TestVerifySignatures(t *testing.T) {
+	owner := newTestWallet(t)
+	thief := newTestWallet(t)
+	chain := newTestChain(t, owner, 1)
+
+	// 150 takes both block rewards, so the transaction has two inputs.
+	tx, err := NewTransaction(owner, string(thief.Address()), 150, Fee{}, nil, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.Inputs) != 2 {
+		t.Fatalf("transaction has %d inputs, want 2", len(tx.Inputs))
+	}
+
+	prevTxs := make(map[string]Transaction)
+	for _, in := range tx.Inputs {
+		prevTx, err := chain.FindTransaction(in.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prevTxs[hex.EncodeToString(in.Id)] = prevTx
+	}
+
+	// Sign does not care whose outputs it spends, so the thief can sign the
+	// same transaction. other is the owner's signature of another one
+	// spending the same outputs.
+	bySomeoneElse := cloneTx(t, tx)
+	if err := bySomeoneElse.Sign(thief.PrivateKey, prevTxs); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewTransaction(owner, string(thief.Address()), 140, Fee{}, nil, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(tx *Transaction)
+		valid  bool
+	}{
+		{"untouched", func(tx *Transaction) {}, true},
+		{"flipped signature bit", func(tx *Transaction) {
+			signature, pubKey := scriptSigItems(t, tx.Inputs[0])
+			signature[len(signature)/2] ^= 1
+			setScriptSig(&tx.Inputs[0], signature, pubKey)
+		}, false},
+		{"forged by another key", func(tx *Transaction) {
+			signature, _ := scriptSigItems(t, bySomeoneElse.Inputs[0])
+			_, pubKey := scriptSigItems(t, tx.Inputs[0])
+			setScriptSig(&tx.Inputs[0], signature, pubKey)
+		}, false},
+		{"signed and keyed by another key", func(tx *Transaction) {
+			tx.Inputs[0].ScriptSig = bySomeoneElse.Inputs[0].ScriptSig
+		}, false},
+		{"zero signature", func(tx *Transaction) {
+			signature, pubKey := scriptSigItems(t, tx.Inputs[0])
+			setScriptSig(&tx.Inputs[0], make([]byte, len(signature)), pubKey)
+		}, false},
+		{"swapped between inputs", func(tx *Transaction) {
+			tx.Inputs[0].ScriptSig, tx.Inputs[1].ScriptSig = tx.Inputs[1].ScriptSig, tx.Inputs[0].ScriptSig
+		}, false},
+		{"swapped signature halves", func(tx *Transaction) {
+			signature, pubKey := scriptSigItems(t, tx.Inputs[0])
+			half := len(signature) / 2
+			swapped := append(append([]byte{}, signature[half:]...), signature[:half]...)
+			setScriptSig(&tx.Inputs[0], swapped, pubKey)
+		}, false},
+		{"taken from another transaction", func(tx *Transaction) {
+			for i := range tx.Inputs {
+				for _, in := range other.Inputs {
+					if in.Out == tx.Inputs[i].Out && string(in.Id) == string(tx.Inputs[i].Id) {
+						tx.Inputs[i].ScriptSig = in.ScriptSig
+					}
+				}
+			}
+		}, false},
+		{"truncated by a byte", func(tx *Transaction) {
+			signature, pubKey := scriptSigItems(t, tx.Inputs[1])
+			setScriptSig(&tx.Inputs[1], signature[:len(signature)-1], pubKey)
+		}, false},
+		{"truncated to half", func(tx *Transaction) {
+			signature, pubKey := scriptSigItems(t, tx.Inputs[1])
+			setScriptSig(&tx.Inputs[1], signature[:len(signature)/2], pubKey)
+		}, false},
+		{"extended by a byte", func(tx *Transaction) {
+			signature, pubKey := scriptSigItems(t, tx.Inputs[1])
+			setScriptSig(&tx.Inputs[1], append(signature, 0), pubKey)
+		}, false},
+		{"empty signature", func(tx *Transaction) {
+			_, pubKey := scriptSigItems(t, tx.Inputs[1])
+			setScriptSig(&tx.Inputs[1], nil, pubKey)
+		}, false},
+		{"truncated public key", func(tx *Transaction) {
+			signature, pubKey := scriptSigItems(t, tx.Inputs[1])
+			setScriptSig(&tx.Inputs[1], signature, pubKey[:len(pubKey)-1])
+		}, false},
+		{"missing ScriptSig", func(tx *Transaction) {
+			tx.Inputs[1].ScriptSig = nil
+		}, false},
+		{"output changed after signing", func(tx *Transaction) {
+			tx.Outputs[0].Value++
+		}, false},
+		{"output redirected after signing", func(tx *Transaction) {
+			tx.Outputs[0].ScriptPubKey = tx.Outputs[len(tx.Outputs)-1].ScriptPubKey
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := cloneTx(t, tx)
+			tt.tamper(tampered)
+
+			if got := tampered.Verify(prevTxs); got != tt.valid {
+				t.Errorf("Verify = %v, want %v", got, tt.valid)
+			}
+			if got := chain.VerifyTransaction(tampered); got != tt.valid {
+				t.Errorf("VerifyTransaction = %v, want %v", got, tt.valid)
+			}
+		})
+	}
+}
+
+func TestVerifyUnknownInput(t *testing.T) {
+	owner := newTestWallet(t)
+	chain := newTestChain(t, owner, 0)
+
+	tx, err := NewTransaction(owner, string(newTestWallet(t).Address()), 10, Fee{}, nil, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tx.Verify(map[string]Transaction{}) {
+		t.Error("Verify accepted a transaction whose inputs it was not given")
+	}
+
+	tx.Inputs[0].Id = make([]byte, len(tx.Inputs[0].Id))
+	if chain.VerifyTransaction(tx) {
+		t.Error("VerifyTransaction accepted a transaction spending an unknown output")
+	}
+}
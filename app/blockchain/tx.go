@@ -8,33 +8,67 @@ import (
 type TxInput struct {
 	Id        []byte
 	Out       int
-	Signature []byte
-	PubKey    []byte
+	ScriptSig Script
 }
 
 type TxOutput struct {
-	Value      int
-	PubKeyHash []byte
+	Value        int
+	ScriptPubKey Script
 }
 
-func NewTxOutput(value int, address string) *TxOutput {
+func NewTxOutput(value int, address string) (*TxOutput, error) {
 	txo := &TxOutput{value, nil}
-	txo.Lock([]byte(address))
+	if err := txo.Lock([]byte(address)); err != nil {
+		return nil, err
+	}
 
-	return txo
+	return txo, nil
 }
 
+// UsesKey tells whether the input spends with the key, or for
+// pay-to-script-hash the redeem script, whose hash is pubKeyHash. Either is
+// the last item of a standard ScriptSig.
 func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := wallet.PublicKeyHash(in.PubKey)
+	items, ok := in.ScriptSig.pushes()
+	if !ok || len(items) == 0 {
+		return false
+	}
+	lockingHash := wallet.Hash160(items[len(items)-1])
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
 
-func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+// Address returns the address of the key or redeem script a standard
+// ScriptSig spends with.
+func (in *TxInput) Address() ([]byte, bool) {
+	items, ok := in.ScriptSig.pushes()
+	if !ok || len(items) == 0 {
+		return nil, false
+	}
+	last := items[len(items)-1]
+
+	if len(items) == 2 {
+		if _, ok := wallet.SchemeOf(last); ok {
+			return wallet.PublicKeyAddress(last), true
+		}
+	}
+
+	return wallet.HashToAddress(wallet.VersionScriptHash, wallet.Hash160(last)), true
+}
+
+// Lock sets the ScriptPubKey to the standard script paying to address.
+func (out *TxOutput) Lock(address []byte) error {
+	script, err := LockingScript(string(address))
+	if err != nil {
+		return err
+	}
+	out.ScriptPubKey = script
+
+	return nil
 }
 
+// IsLockedWithKey tells whether the output pays to the public key or script
+// hash pubKeyHash with a standard script.
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	hash, ok := out.ScriptPubKey.Hash()
+	return ok && bytes.Compare(hash, pubKeyHash) == 0
 }
@@ -0,0 +1,86 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+// The transaction index has a key for every transaction on the main chain:
+// txPrefix + id -> hash of the block holding it + big-endian position there.
+// It is kept up to date with the UTXO set once txIndexKey marks it built.
+const (
+	txPrefix   = "tx-"
+	txIndexKey = "txindex"
+)
+
+var ErrBadTxIndex = errors.New("transaction index entry is malformed")
+
+func txKey(id []byte) []byte {
+	return append([]byte(txPrefix), id...)
+}
+
+// indexTransactions adds a block connected to the main chain to the index.
+func indexTransactions(txn *badger.Txn, block *Block) error {
+	for position, tx := range block.Transactions {
+		location := make([]byte, len(block.Hash)+indexLength)
+		copy(location, block.Hash)
+		binary.BigEndian.PutUint32(location[len(block.Hash):], uint32(position))
+
+		if err := txn.Set(txKey(tx.Id), location); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexTransactions removes a block disconnected from the main chain.
+func unindexTransactions(txn *badger.Txn, block *Block) error {
+	for _, tx := range block.Transactions {
+		if err := txn.Delete(txKey(tx.Id)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indexAllTransactions builds the transaction index, one block at a time.
+func (ch *BlockChain) indexAllTransactions() error {
+	return ch.buildIndex(txIndexKey, txPrefix, func(block *Block) error {
+		return ch.Database.Update(func(txn *badger.Txn) error {
+			return indexTransactions(txn, block)
+		})
+	})
+}
+
+// TransactionLocation returns the hash of the block on the main chain holding
+// the transaction with the given id and its position in the block. It fails
+// with ErrTxNotFound if there is none.
+func (ch *BlockChain) TransactionLocation(Id []byte) ([]byte, int, error) {
+	var location []byte
+
+	err := ch.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(txKey(Id))
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("%w: %x", ErrTxNotFound, Id)
+		}
+		if err != nil {
+			return err
+		}
+		location, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(location) < indexLength {
+		return nil, 0, fmt.Errorf("%w: %x", ErrBadTxIndex, Id)
+	}
+
+	split := len(location) - indexLength
+	return location[:split], int(binary.BigEndian.Uint32(location[split:])), nil
+}
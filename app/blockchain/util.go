@@ -3,14 +3,37 @@ package blockchain
 import (
 	"bytes"
 	"encoding/binary"
-	"log"
+	"encoding/gob"
 )
 
 func ToHex(num int64) []byte {
-	buff := new(bytes.Buffer)
-	if err := binary.Write(buff, binary.BigEndian, num); err != nil {
-		log.Panic(err)
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint64(buff, uint64(num))
+
+	return buff
+}
+
+func writeUint32(buffer *bytes.Buffer, n int) {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], uint32(n))
+	buffer.Write(data[:])
+}
+
+// writeBytes writes data preceded by its length.
+func writeBytes(buffer *bytes.Buffer, data []byte) {
+	writeUint32(buffer, len(data))
+	buffer.Write(data)
+}
+
+// encode gob-encodes v. Encoding into memory only fails for types gob cannot
+// handle at all, which is a programming error, so it panics rather than
+// making every caller handle an error that cannot happen.
+func encode(v interface{}) []byte {
+	var buffer bytes.Buffer
+
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		panic(err)
 	}
 
-	return buff.Bytes()
+	return buffer.Bytes()
 }
@@ -0,0 +1,537 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Unspent outputs are kept under their own key prefix, one key per output:
+// utxoPrefix + tx id + big-endian output index -> serialized TxOutput.
+// Outputs paying to a public key or script hash are also kept by their owner,
+// so that looking up the outputs of an address only reads those:
+// ownerPrefix + hash + tx id + big-endian output index -> serialized TxOutput.
+// Both are written together once ownerIndexKey marks the second built.
+const (
+	utxoPrefix    = "utxo-"
+	prefixLength  = len(utxoPrefix)
+	ownerPrefix   = "owner-"
+	ownerIndexKey = "ownerindex"
+	indexLength   = 4
+	deleteBatch   = 100000
+)
+
+var ErrOutputNotFound = errors.New("output is not in the UTXO set")
+
+func utxoKey(txId []byte, outIdx int) []byte {
+	idx := make([]byte, indexLength)
+	binary.BigEndian.PutUint32(idx, uint32(outIdx))
+
+	key := append([]byte(utxoPrefix), txId...)
+	return append(key, idx...)
+}
+
+func parseUTxOKey(key []byte) ([]byte, int) {
+	key = key[prefixLength:]
+	txId := key[:len(key)-indexLength]
+	outIdx := binary.BigEndian.Uint32(key[len(key)-indexLength:])
+
+	return txId, int(outIdx)
+}
+
+func ownerKey(pubKeyHash, txId []byte, outIdx int) []byte {
+	key := append([]byte(ownerPrefix), pubKeyHash...)
+	return append(key, utxoKey(txId, outIdx)[prefixLength:]...)
+}
+
+// setUTxO adds an unspent output to the set and to the index by owner.
+func setUTxO(txn *badger.Txn, txId []byte, outIdx int, out *TxOutput) error {
+	value := out.Serialize()
+	if err := txn.Set(utxoKey(txId, outIdx), value); err != nil {
+		return err
+	}
+	if hash, ok := out.ScriptPubKey.Hash(); ok {
+		return txn.Set(ownerKey(hash, txId, outIdx), value)
+	}
+
+	return nil
+}
+
+// deleteUTxO removes an output from the set and from the index by owner.
+func deleteUTxO(txn *badger.Txn, txId []byte, outIdx int, out *TxOutput) error {
+	if err := txn.Delete(utxoKey(txId, outIdx)); err != nil {
+		return err
+	}
+	if hash, ok := out.ScriptPubKey.Hash(); ok {
+		return txn.Delete(ownerKey(hash, txId, outIdx))
+	}
+
+	return nil
+}
+
+func (out *TxOutput) Serialize() []byte {
+	return encode(out)
+}
+
+func DeserializeOutput(data []byte) (TxOutput, error) {
+	var out TxOutput
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&out); err != nil {
+		return TxOutput{}, fmt.Errorf("decoding output: %w", err)
+	}
+
+	return out, nil
+}
+
+// Reindex validates the chain, drops the UTXO set and rebuilds it from a
+// single pass over the chain, then rebuilds the address and transaction
+// indexes. Nothing is rebuilt from a chain that fails validation.
+func (ch *BlockChain) Reindex() error {
+	if err := ch.ValidateChain(); err != nil {
+		return err
+	}
+
+	if err := ch.deleteByPrefix([]byte(utxoPrefix)); err != nil {
+		return err
+	}
+	if err := ch.deleteByPrefix([]byte(ownerPrefix)); err != nil {
+		return err
+	}
+
+	UTXO, err := ch.FindAllUTxO()
+	if err != nil {
+		return err
+	}
+
+	txn := ch.Database.NewTransaction(true)
+	defer txn.Discard()
+
+	for txId, outs := range UTXO {
+		id, err := hex.DecodeString(txId)
+		if err != nil {
+			return err
+		}
+
+		for outIdx, out := range outs {
+			err = setUTxO(txn, id, outIdx, &out)
+			if err == badger.ErrTxnTooBig {
+				if err = txn.Commit(); err != nil {
+					return err
+				}
+				txn = ch.Database.NewTransaction(true)
+				err = setUTxO(txn, id, outIdx, &out)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := txn.Set([]byte(ownerIndexKey), []byte{1}); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	err = ch.Database.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete([]byte(addrIndexKey)); err != nil {
+			return err
+		}
+		return txn.Delete([]byte(txIndexKey))
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := ch.indexAllAddresses(); err != nil {
+		return err
+	}
+
+	return ch.indexAllTransactions()
+}
+
+// FindAllUTxO walks the whole chain and returns every unspent output keyed by
+// transaction id and output index. It is only used to rebuild the index.
+func (ch *BlockChain) FindAllUTxO() (map[string]map[int]TxOutput, error) {
+	return ch.findAllUTxOFrom(ch.LastHash)
+}
+
+// findAllUTxOFrom does the same for the chain ending at the given block.
+func (ch *BlockChain) findAllUTxOFrom(blockHash []byte) (map[string]map[int]TxOutput, error) {
+	UTXO := make(map[string]map[int]TxOutput)
+	spentTxOs := make(map[string][]int)
+
+	iter := &Iterator{CurrentHash: blockHash, Database: ch.Database}
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tx := range block.Transactions {
+			txId := hex.EncodeToString(tx.Id)
+
+		Outputs:
+			for outIdx, out := range tx.Outputs {
+				for _, spentOut := range spentTxOs[txId] {
+					if spentOut == outIdx {
+						continue Outputs
+					}
+				}
+				if UTXO[txId] == nil {
+					UTXO[txId] = make(map[int]TxOutput)
+				}
+				UTXO[txId][outIdx] = out
+			}
+			if tx.IsCoinbase() == false {
+				for _, in := range tx.Inputs {
+					inTxId := hex.EncodeToString(in.Id)
+					spentTxOs[inTxId] = append(spentTxOs[inTxId], in.Out)
+				}
+			}
+		}
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	return UTXO, nil
+}
+
+// updateUTxO applies a block to the UTXO set inside txn: outputs spent by the
+// block are removed and the block's own outputs are added. The spent outputs
+// are kept as the block's undo data so that it can be disconnected again, and
+// the block is added to the address index.
+func (ch *BlockChain) updateUTxO(txn *badger.Txn, block *Block) error {
+	var undo []TxOutput
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, in := range tx.Inputs {
+				key := utxoKey(in.Id, in.Out)
+
+				item, err := txn.Get(key)
+				if err != nil {
+					return err
+				}
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				out, err := DeserializeOutput(v)
+				if err != nil {
+					return err
+				}
+				undo = append(undo, out)
+
+				if err := deleteUTxO(txn, in.Id, in.Out, &out); err != nil {
+					return err
+				}
+			}
+		}
+
+		for outIdx := range tx.Outputs {
+			if err := setUTxO(txn, tx.Id, outIdx, &tx.Outputs[outIdx]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := indexAddresses(txn, block, undo); err != nil {
+		return err
+	}
+	if err := indexTransactions(txn, block); err != nil {
+		return err
+	}
+
+	return txn.Set(undoKey(block.Hash), serializeUndo(undo))
+}
+
+// UnspentOutput is an unspent output along with the id of the transaction
+// that created it and its index there.
+type UnspentOutput struct {
+	TxId   []byte
+	Index  int
+	Output TxOutput
+}
+
+func (ch *BlockChain) FindUTxO(pubKeyHash []byte) ([]TxOutput, error) {
+	unspent, err := ch.ListUnspent(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	UTXOs := make([]TxOutput, 0, len(unspent))
+	for _, u := range unspent {
+		UTXOs = append(UTXOs, u.Output)
+	}
+	return UTXOs, nil
+}
+
+// ListUnspent returns the unspent outputs locked to pubKeyHash along with the
+// transaction and index that created them. Only the outputs of pubKeyHash are
+// read, however large the UTXO set.
+func (ch *BlockChain) ListUnspent(pubKeyHash []byte) ([]UnspentOutput, error) {
+	var unspent []UnspentOutput
+
+	err := ch.eachOwnedOutput(pubKeyHash, func(txId []byte, outIdx int, out TxOutput) bool {
+		unspent = append(unspent, UnspentOutput{TxId: txId, Index: outIdx, Output: out})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return unspent, nil
+}
+
+func (ch *BlockChain) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
+	unspentOuts := make(map[string][]int)
+	accumulated := 0
+
+	err := ch.eachOwnedOutput(pubKeyHash, func(txId []byte, outIdx int, out TxOutput) bool {
+		id := hex.EncodeToString(txId)
+
+		accumulated += out.Value
+		unspentOuts[id] = append(unspentOuts[id], outIdx)
+
+		return accumulated < amount
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return accumulated, unspentOuts, nil
+}
+
+// eachOwnedOutput calls f with the unspent outputs locked to pubKeyHash, in
+// the order of their keys, until f returns false.
+func (ch *BlockChain) eachOwnedOutput(pubKeyHash []byte, f func(txId []byte, outIdx int, out TxOutput) bool) error {
+	return ch.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := append([]byte(ownerPrefix), pubKeyHash...)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if len(item.Key()) <= len(prefix)+indexLength {
+				continue
+			}
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			out, err := DeserializeOutput(v)
+			if err != nil {
+				return err
+			}
+			// Hashes of other lengths could start with pubKeyHash.
+			if !out.IsLockedWithKey(pubKeyHash) {
+				continue
+			}
+
+			key := item.KeyCopy(nil)[len(prefix):]
+			txId := key[:len(key)-indexLength]
+			outIdx := int(binary.BigEndian.Uint32(key[len(key)-indexLength:]))
+			if !f(txId, outIdx, out) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// indexAllOwners builds the index of unspent outputs by owner from the UTXO
+// set, for databases written before there was one.
+func (ch *BlockChain) indexAllOwners() error {
+	err := ch.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(ownerIndexKey))
+		return err
+	})
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	if err := ch.deleteByPrefix([]byte(ownerPrefix)); err != nil {
+		return err
+	}
+
+	wtxn := ch.Database.NewTransaction(true)
+	defer func() { wtxn.Discard() }()
+
+	err = ch.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(utxoPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			out, err := DeserializeOutput(v)
+			if err != nil {
+				return err
+			}
+			hash, ok := out.ScriptPubKey.Hash()
+			if !ok {
+				continue
+			}
+
+			txId, outIdx := parseUTxOKey(item.KeyCopy(nil))
+			key := ownerKey(hash, txId, outIdx)
+			err = wtxn.Set(key, v)
+			if err == badger.ErrTxnTooBig {
+				if err = wtxn.Commit(); err != nil {
+					return err
+				}
+				wtxn = ch.Database.NewTransaction(true)
+				err = wtxn.Set(key, v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := wtxn.Set([]byte(ownerIndexKey), []byte{1}); err != nil {
+		return err
+	}
+
+	return wtxn.Commit()
+}
+
+// FindOutput looks up a single unspent output. It fails with
+// ErrOutputNotFound if the output is spent or was never created.
+func (ch *BlockChain) FindOutput(txId []byte, outIdx int) (TxOutput, error) {
+	var out TxOutput
+
+	err := ch.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(utxoKey(txId, outIdx))
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("%w: %s", ErrOutputNotFound, outpoint(txId, outIdx))
+		}
+		if err != nil {
+			return err
+		}
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		out, err = DeserializeOutput(v)
+
+		return err
+	})
+
+	return out, err
+}
+
+// CountTransactions returns the number of transactions that still have at
+// least one unspent output.
+func (ch *BlockChain) CountTransactions() (int, error) {
+	txs := make(map[string]bool)
+
+	err := ch.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(utxoPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			txId, _ := parseUTxOKey(it.Item().Key())
+			txs[string(txId)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(txs), nil
+}
+
+// buildIndex calls index with every block of the main chain, tip first, and
+// then sets marker. It does nothing if marker is set already; otherwise
+// whatever an earlier, interrupted build left under prefix is deleted first.
+// Databases written before an index existed get it built this way on open.
+func (ch *BlockChain) buildIndex(marker, prefix string, index func(block *Block) error) error {
+	err := ch.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(marker))
+		return err
+	})
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	if err := ch.deleteByPrefix([]byte(prefix)); err != nil {
+		return err
+	}
+
+	iter := ch.Iterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if err := index(block); err != nil {
+			return err
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return ch.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(marker), []byte{1})
+	})
+}
+
+func (ch *BlockChain) deleteByPrefix(prefix []byte) error {
+	deleteKeys := func(keysForDelete [][]byte) error {
+		return ch.Database.Update(func(txn *badger.Txn) error {
+			for _, key := range keysForDelete {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	return ch.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		keysForDelete := make([][]byte, 0, deleteBatch)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keysForDelete = append(keysForDelete, it.Item().KeyCopy(nil))
+
+			if len(keysForDelete) == deleteBatch {
+				if err := deleteKeys(keysForDelete); err != nil {
+					return err
+				}
+				keysForDelete = make([][]byte, 0, deleteBatch)
+			}
+		}
+
+		if len(keysForDelete) > 0 {
+			return deleteKeys(keysForDelete)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,179 @@
+package blockchain
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+// scanUTxO reads the whole UTXO set, keyed by outpoint.
+func scanUTxO(t *testing.T, chain *BlockChain) map[string]TxOutput {
+	t.Helper()
+
+	UTXO := make(map[string]TxOutput)
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(utxoPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			out, err := DeserializeOutput(v)
+			if err != nil {
+				return err
+			}
+			txId, outIdx := parseUTxOKey(it.Item().KeyCopy(nil))
+			UTXO[outpoint(txId, outIdx)] = out
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return UTXO
+}
+
+// checkOwnerIndex checks that ListUnspent finds exactly the outputs of the
+// UTXO set paying to each owner in it, and that the index has no entries
+// for outputs that are gone.
+func checkOwnerIndex(t *testing.T, chain *BlockChain) {
+	t.Helper()
+
+	UTXO := scanUTxO(t, chain)
+	byOwner := make(map[string][]string)
+	for op, out := range UTXO {
+		if hash, ok := out.ScriptPubKey.Hash(); ok {
+			byOwner[string(hash)] = append(byOwner[string(hash)], op)
+		}
+	}
+
+	indexed := 0
+	for hash, want := range byOwner {
+		unspent, err := chain.ListUnspent([]byte(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, u := range unspent {
+			op := outpoint(u.TxId, u.Index)
+			if want := UTXO[op]; u.Output.Value != want.Value || !bytes.Equal(u.Output.ScriptPubKey, want.ScriptPubKey) {
+				t.Errorf("index has a different output for %s", op)
+			}
+			got = append(got, op)
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if len(got) != len(want) {
+			t.Errorf("owner %x: index has %v, UTXO set has %v", hash, got, want)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("owner %x: index has %v, UTXO set has %v", hash, got, want)
+				break
+			}
+		}
+		indexed += len(got)
+	}
+
+	entries := 0
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(ownerPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			entries++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries != indexed {
+		t.Errorf("index has %d entries for %d unspent outputs", entries, indexed)
+	}
+}
+
+func TestOwnerIndex(t *testing.T) {
+	owner := newTestWallet(t)
+	payee := newTestWallet(t)
+	chain := newTestChain(t, owner, 2)
+
+	tx, err := NewTransaction(owner, string(payee.Address()), 120, Fee{Amount: 3}, nil, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.MineBlock(string(payee.Address()), []*Transaction{tx}); err != nil {
+		t.Fatal(err)
+	}
+	checkOwnerIndex(t, chain)
+
+	// FindSpendableOutputs stops at the first outputs that are enough.
+	accumulated, outs, err := chain.FindSpendableOutputs(wallet.PublicKeyHash(payee.PublicKey), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outs) != 1 || accumulated < 1 {
+		t.Errorf("FindSpendableOutputs = %d, %v, want one output", accumulated, outs)
+	}
+
+	if err := chain.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	checkOwnerIndex(t, chain)
+
+	// A database written before the index gets it built when opened.
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(ownerIndexKey))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.deleteByPrefix([]byte(ownerPrefix)); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.indexAllOwners(); err != nil {
+		t.Fatal(err)
+	}
+	checkOwnerIndex(t, chain)
+}
+
+// TestReindexValidatesChain checks that Reindex leaves the UTXO set alone
+// when a stored block has been tampered with.
+func TestReindexValidatesChain(t *testing.T) {
+	owner := newTestWallet(t)
+	chain := newTestChain(t, owner, 2)
+	before := scanUTxO(t, chain)
+
+	tip := tipBlock(t, chain)
+	tip.Transactions[0].Outputs[0].Value++
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(tip.Hash, tip.Serialize())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chain.Reindex(); err == nil {
+		t.Fatal("Reindex rebuilt the indexes from a tampered chain")
+	}
+	after := scanUTxO(t, chain)
+	if len(after) != len(before) {
+		t.Fatalf("UTXO set has %d outputs, had %d", len(after), len(before))
+	}
+	for op, out := range before {
+		if after[op].Value != out.Value {
+			t.Errorf("output %s is worth %d, was %d", op, after[op].Value, out.Value)
+		}
+	}
+}
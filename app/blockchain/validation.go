@@ -0,0 +1,396 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidPoW         = errors.New("block hash does not satisfy the proof of work")
+	ErrBadBlockHash       = errors.New("block hash does not match its header")
+	ErrBadVersion         = errors.New("block version is not supported")
+	ErrBadMerkleRoot      = errors.New("merkle root does not match the transactions")
+	ErrUnknownParent      = errors.New("parent block is not known")
+	ErrBadHeight          = errors.New("block height does not follow its parent")
+	ErrBadTxId            = errors.New("transaction id does not match its contents")
+	ErrInvalidOutput      = errors.New("transaction output value is negative or above MaxMoney")
+	ErrMoneyOverflow      = errors.New("amounts add up to more than MaxMoney")
+	ErrInvalidSignature   = errors.New("transaction signature is invalid")
+	ErrValueNotConserved  = errors.New("transaction outputs exceed its inputs")
+	ErrEmptyInputs        = errors.New("transaction has no inputs")
+	ErrDuplicateTxInBlock = errors.New("transaction appears twice in the block")
+	ErrDuplicateTx        = errors.New("transaction has the id of one with unspent outputs")
+	ErrBlockTooLarge      = errors.New("block is larger than the maximum block size")
+)
+
+// BlockError is returned when a block fails validation. Err is one of the
+// sentinel errors above and can be matched with errors.Is. TxId names the
+// transaction at fault, if any, and Hash is nil for a block still being
+// assembled.
+type BlockError struct {
+	Hash []byte
+	TxId []byte
+	Err  error
+}
+
+func (e *BlockError) Error() string {
+	if e.Hash == nil && e.TxId != nil {
+		return fmt.Sprintf("transaction %x: %s", e.TxId, e.Err)
+	}
+	if e.TxId != nil {
+		return fmt.Sprintf("block %x: transaction %x: %s", e.Hash, e.TxId, e.Err)
+	}
+	return fmt.Sprintf("block %x: %s", e.Hash, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// blockContext is the state a block is validated against: its parent (nil
+// for a genesis block), the outputs still unspent on the parent's chain and
+// the transactions of that chain.
+type blockContext struct {
+	parent    *Block
+	spendable func(txId []byte, outIdx int) (TxOutput, error)
+	prevTx    func(txId []byte) (Transaction, error)
+}
+
+// ValidateBlock runs every consensus check on a block that would be added on
+// top of its parent: the header checks of ValidateHeader, the Merkle root,
+// coinbase rules and for every transaction the
+// signatures, that the inputs are unspent and not spent twice, that the
+// outputs do not exceed the inputs and that no unspent output has its id.
+func (ch *BlockChain) ValidateBlock(block *Block) error {
+	ctx, err := ch.contextFor(block)
+	if err != nil {
+		return &BlockError{Hash: block.Hash, Err: err}
+	}
+
+	return ch.validateBlock(block, ctx)
+}
+
+// ValidateChain replays the chain from the genesis block to the tip and
+// validates every block against the state left by the blocks before it.
+func (ch *BlockChain) ValidateChain() error {
+	spendable := make(map[string]TxOutput)
+	txs := make(map[string]Transaction)
+
+	ctx := blockContext{
+		spendable: func(txId []byte, outIdx int) (TxOutput, error) {
+			out, ok := spendable[outpoint(txId, outIdx)]
+			if !ok {
+				return out, ErrOutputNotFound
+			}
+			return out, nil
+		},
+		prevTx: func(txId []byte) (Transaction, error) {
+			tx, ok := txs[hex.EncodeToString(txId)]
+			if !ok {
+				return tx, ErrTxNotFound
+			}
+			return tx, nil
+		},
+	}
+
+	hashes, err := ch.GetBlockHashes()
+	if err != nil {
+		return err
+	}
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := ch.GetBlock(hashes[i])
+		if err != nil {
+			return err
+		}
+
+		if err := ch.validateBlock(&block, ctx); err != nil {
+			return err
+		}
+
+		for _, tx := range block.Transactions {
+			if !tx.IsCoinbase() {
+				for _, in := range tx.Inputs {
+					delete(spendable, outpoint(in.Id, in.Out))
+				}
+			}
+			for outIdx, out := range tx.Outputs {
+				spendable[outpoint(tx.Id, outIdx)] = out
+			}
+			txs[hex.EncodeToString(tx.Id)] = *tx
+		}
+
+		ctx.parent = &block
+	}
+
+	return nil
+}
+
+// contextFor builds the validation context of a block from the database.
+// Blocks on top of the tip are checked against the UTXO set; blocks on any
+// other branch against the unspent outputs rebuilt for their parent.
+func (ch *BlockChain) contextFor(block *Block) (blockContext, error) {
+	if len(block.PrevHash) == 0 {
+		return blockContext{
+			spendable: func([]byte, int) (TxOutput, error) {
+				return TxOutput{}, ErrOutputNotFound
+			},
+			prevTx: func([]byte) (Transaction, error) {
+				return Transaction{}, ErrTxNotFound
+			},
+		}, nil
+	}
+
+	parent, err := ch.GetBlock(block.PrevHash)
+	if errors.Is(err, ErrBlockNotFound) {
+		return blockContext{}, ErrUnknownParent
+	}
+	if err != nil {
+		return blockContext{}, err
+	}
+
+	ctx := blockContext{
+		parent: &parent,
+		prevTx: func(txId []byte) (Transaction, error) {
+			return ch.findTransactionFrom(block.PrevHash, txId)
+		},
+	}
+
+	if bytes.Equal(block.PrevHash, ch.LastHash) {
+		ctx.spendable = ch.FindOutput
+	} else {
+		UTXO, err := ch.findAllUTxOFrom(block.PrevHash)
+		if err != nil {
+			return blockContext{}, err
+		}
+		ctx.spendable = func(txId []byte, outIdx int) (TxOutput, error) {
+			out, ok := UTXO[hex.EncodeToString(txId)][outIdx]
+			if !ok {
+				return out, ErrOutputNotFound
+			}
+			return out, nil
+		}
+	}
+
+	return ctx, nil
+}
+
+// ValidateHeader checks a block header without its transactions: version,
+// proof of work at the expected difficulty, timestamp and height. The parent
+// block has to be known already.
+func (ch *BlockChain) ValidateHeader(header *BlockHeader) error {
+	var parent *Block
+
+	if len(header.PrevHash) > 0 {
+		block, err := ch.GetBlock(header.PrevHash)
+		if err != nil {
+			return &BlockError{Hash: header.Hash(), Err: ErrUnknownParent}
+		}
+		parent = &block
+	}
+
+	if err := ch.validateHeader(header, parent); err != nil {
+		return &BlockError{Hash: header.Hash(), Err: err}
+	}
+	return nil
+}
+
+func (ch *BlockChain) validateHeader(header *BlockHeader, parent *Block) error {
+	if err := checkDifficultyRange(header); err != nil {
+		return err
+	}
+	if header.Version < BlockVersion {
+		return ErrBadVersion
+	}
+	if !NewProof(header).Validate() {
+		return ErrInvalidPoW
+	}
+	if header.Difficulty != ch.NextDifficulty(parent) {
+		return ErrBadDifficulty
+	}
+	if err := ch.checkTimestamp(header, parent); err != nil {
+		return err
+	}
+
+	if parent == nil && header.Height != 0 {
+		return ErrBadHeight
+	}
+	if parent != nil && header.Height != parent.Height+1 {
+		return ErrBadHeight
+	}
+
+	return nil
+}
+
+// validateStructure runs the checks that do not depend on the UTXO set: the
+// block hash, the header against its parent and the Merkle root. The Merkle
+// tree pairs the last node of an odd level with itself, so transactions
+// [a, b, c] and [a, b, c, c] have the same root; rejecting repeated ids keeps
+// such a copy from being stored under the hash of the real block.
+func (ch *BlockChain) validateStructure(block *Block, parent *Block) error {
+	if err := checkDifficultyRange(&block.BlockHeader); err != nil {
+		return err
+	}
+	if !bytes.Equal(block.BlockHeader.Hash(), block.Hash) {
+		return ErrBadBlockHash
+	}
+	if err := ch.validateHeader(&block.BlockHeader, parent); err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		if seen[string(tx.Id)] {
+			return fmt.Errorf("%w: %x", ErrDuplicateTxInBlock, tx.Id)
+		}
+		seen[string(tx.Id)] = true
+	}
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return ErrBadMerkleRoot
+	}
+	if size := block.TxSize(); size > MaxBlockSize {
+		return fmt.Errorf("%w: %d bytes", ErrBlockTooLarge, size)
+	}
+	return nil
+}
+
+// checkTransaction runs the checks that need nothing but the transaction
+// itself: that its id matches its contents, that it has inputs unless it is a
+// coinbase and that its outputs are valid amounts adding up to at most
+// MaxMoney. It returns the value of the outputs.
+func checkTransaction(tx *Transaction) (int, error) {
+	if !bytes.Equal(tx.Id, tx.unsignedHash()) {
+		return 0, ErrBadTxId
+	}
+	if !tx.IsCoinbase() && len(tx.Inputs) == 0 {
+		return 0, ErrEmptyInputs
+	}
+
+	outputs := 0
+	for _, out := range tx.Outputs {
+		if !validAmount(out.Value) {
+			return 0, ErrInvalidOutput
+		}
+		var ok bool
+		if outputs, ok = addMoney(outputs, out.Value); !ok {
+			return 0, ErrMoneyOverflow
+		}
+	}
+
+	return outputs, nil
+}
+
+func (ch *BlockChain) validateBlock(block *Block, ctx blockContext) error {
+	fail := func(tx *Transaction, err error) error {
+		blockErr := &BlockError{Hash: block.Hash, Err: err}
+		if tx != nil {
+			blockErr.TxId = tx.Id
+		}
+		return blockErr
+	}
+
+	if err := ch.validateStructure(block, ctx.parent); err != nil {
+		return fail(nil, err)
+	}
+
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return fail(nil, ErrMissingCoinbase)
+	}
+
+	fees := 0
+	created := make(map[string]TxOutput)
+	spent := make(map[string]bool)
+	blockTxs := make(map[string]Transaction)
+
+	for i, tx := range block.Transactions {
+		txId := hex.EncodeToString(tx.Id)
+
+		if i > 0 && tx.IsCoinbase() {
+			return fail(tx, ErrMultipleCoinbase)
+		}
+		outputs, err := checkTransaction(tx)
+		if err != nil {
+			return fail(tx, err)
+		}
+
+		// As in BIP30, an id may only come back once every output of the
+		// transaction it belonged to is spent; the copy would otherwise
+		// overwrite them in the UTXO set and the transaction index. The same
+		// id means the same outputs, so checking as many as tx has is enough.
+		for outIdx := range tx.Outputs {
+			_, err := ctx.spendable(tx.Id, outIdx)
+			if err == nil {
+				return fail(tx, ErrDuplicateTx)
+			}
+			if !errors.Is(err, ErrOutputNotFound) {
+				return err
+			}
+		}
+
+		if !tx.IsCoinbase() {
+			inputs := 0
+			prevTxs := make(map[string]Transaction)
+			for _, in := range tx.Inputs {
+				point := outpoint(in.Id, in.Out)
+				if spent[point] {
+					return fail(tx, fmt.Errorf("%w: %s is spent twice in the block", ErrDoubleSpend, point))
+				}
+
+				out, ok := created[point]
+				if !ok {
+					var err error
+					out, err = ctx.spendable(in.Id, in.Out)
+					if errors.Is(err, ErrOutputNotFound) {
+						return fail(tx, fmt.Errorf("%w: %s is not in the UTXO set", ErrDoubleSpend, point))
+					}
+					if err != nil {
+						return err
+					}
+				}
+				spent[point] = true
+				if inputs, ok = addMoney(inputs, out.Value); !ok {
+					return fail(tx, ErrMoneyOverflow)
+				}
+
+				prevId := hex.EncodeToString(in.Id)
+				prevTx, ok := blockTxs[prevId]
+				if !ok {
+					var err error
+					if prevTx, err = ctx.prevTx(in.Id); err != nil {
+						return fail(tx, fmt.Errorf("%w: %s", ErrUnknownInput, point))
+					}
+				}
+				prevTxs[prevId] = prevTx
+			}
+
+			if !tx.Verify(prevTxs) {
+				return fail(tx, ErrInvalidSignature)
+			}
+			if outputs > inputs {
+				return fail(tx, ErrValueNotConserved)
+			}
+			var ok bool
+			if fees, ok = addMoney(fees, inputs-outputs); !ok {
+				return fail(tx, ErrMoneyOverflow)
+			}
+		}
+
+		for outIdx, out := range tx.Outputs {
+			created[outpoint(tx.Id, outIdx)] = out
+		}
+		blockTxs[txId] = *tx
+	}
+
+	paid := 0
+	for _, out := range block.Transactions[0].Outputs {
+		var ok bool
+		if paid, ok = addMoney(paid, out.Value); !ok {
+			return fail(block.Transactions[0], ErrMoneyOverflow)
+		}
+	}
+	if paid > ch.Reward+fees {
+		return fail(block.Transactions[0], fmt.Errorf("%w: %d > %d", ErrCoinbaseOverpays, paid, ch.Reward+fees))
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// blockOn mines a block on parent holding txs after a coinbase paying the
+// reward and fees to minerAddress, without adding it to the chain.
+func blockOn(t *testing.T, chain *BlockChain, parent *Block, minerAddress string, txs ...*Transaction) *Block {
+	t.Helper()
+
+	fees, err := chain.BlockFees(parent.Hash, txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := CoinbaseTx(minerAddress, "", chain.Reward+fees)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := newBlockTemplate(append([]*Transaction{coinbase}, txs...), parent.Hash, parent.Height+1, chain.NextDifficulty(parent))
+	block.Nonce, block.Hash, err = chain.Miner.Run(context.Background(), NewProof(&block.BlockHeader))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+func tipBlock(t *testing.T, chain *BlockChain) *Block {
+	t.Helper()
+
+	block, err := chain.GetBlock(chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &block
+}
+
+// TestDuplicateTransactionsKeepMerkleRoot builds the mutation of
+// CVE-2012-2459: repeating the last transaction of an odd level leaves the
+// Merkle root and so the block hash unchanged, and only the check for repeated
+// ids tells the copy from the real block.
+func TestDuplicateTransactionsKeepMerkleRoot(t *testing.T) {
+	owner := newTestWallet(t)
+	chain := newTestChain(t, owner, 0)
+
+	parent, err := chain.GetBlock(chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var txs []*Transaction
+	for i := 0; i < 3; i++ {
+		tx, err := CoinbaseTx(string(owner.Address()), "", chain.Reward)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	block := CreateBlock(txs, parent.Hash, parent.Height+1, chain.NextDifficulty(&parent))
+	if err := chain.validateStructure(block, &parent); err != nil {
+		t.Fatalf("validateStructure rejected the real block: %s", err)
+	}
+
+	mutated := *block
+	mutated.Transactions = append(txs[:3:3], txs[2])
+	if !bytes.Equal(mutated.HashTransactions(), block.MerkleRoot) {
+		t.Fatal("repeating the last transaction changed the Merkle root")
+	}
+	if err := chain.validateStructure(&mutated, &parent); !errors.Is(err, ErrDuplicateTxInBlock) {
+		t.Errorf("validateStructure = %v, want %v", err, ErrDuplicateTxInBlock)
+	}
+}
+
+// TestDuplicateUnspentTransaction checks that a block cannot repeat a
+// transaction whose outputs are still unspent, here the coinbase of the
+// block before it.
+func TestDuplicateUnspentTransaction(t *testing.T) {
+	owner := newTestWallet(t)
+	chain := newTestChain(t, owner, 1)
+	parent := tipBlock(t, chain)
+
+	block := newBlockTemplate([]*Transaction{parent.Transactions[0]}, parent.Hash, parent.Height+1, chain.NextDifficulty(parent))
+	var err error
+	block.Nonce, block.Hash, err = chain.Miner.Run(context.Background(), NewProof(&block.BlockHeader))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chain.ValidateBlock(block); !errors.Is(err, ErrDuplicateTx) {
+		t.Fatalf("ValidateBlock = %v, want %v", err, ErrDuplicateTx)
+	}
+	if err := chain.AddBlock(block); !errors.Is(err, ErrDuplicateTx) {
+		t.Fatalf("AddBlock = %v, want %v", err, ErrDuplicateTx)
+	}
+	if balance := balanceOf(t, chain, owner.PublicKey); balance != 2*chain.Reward {
+		t.Errorf("owner has %d, want %d", balance, 2*chain.Reward)
+	}
+}
@@ -1,48 +1,92 @@
 package cli
 
 import (
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/serj1c/blockchainio/app/api"
+	"github.com/serj1c/blockchainio/app/config"
+	"github.com/serj1c/blockchainio/app/network"
+	"github.com/serj1c/blockchainio/app/rpc"
 	"github.com/serj1c/blockchainio/app/wallet"
-	"log"
+	"net"
+	"net/http"
 	"os"
-	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	bc "github.com/serj1c/blockchainio/app/blockchain"
 )
 
-type CommandLine struct{}
+// ErrUsage is returned by Run when the command line is malformed; the usage
+// has been printed already.
+var ErrUsage = errors.New("invalid usage")
+
+type CommandLine struct {
+	config *config.Config
+}
 
 func (cli *CommandLine) printUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-config FILE] [-datadir DIR] [-network NAME] [-node ID] [-seed ADDRESS] COMMAND")
+	fmt.Println("Global options can also be set with BLOCKCHAINIO_CONFIG, BLOCKCHAINIO_DATADIR, BLOCKCHAINIO_NETWORK, NODE_ID and BLOCKCHAINIO_SEED or in config.json in the data directory")
+	fmt.Println("The wallet passphrase is asked for on the terminal or read from BLOCKCHAINIO_PASSPHRASE")
+	fmt.Println("Commands:")
 	fmt.Println("getbalance -address ADDRESS - get the balance for the address")
 	fmt.Println("createblockchain -address ADDRESS - creates a blockchain")
+	fmt.Println("history -address ADDRESS -offset N -limit N - Prints the transactions that credit or debit the address, newest first, a page of -limit at a time")
 	fmt.Println("printchain - Prints the blocks in the chain")
-	fmt.Println("send -from FROM -to TO -amount AMOUNT - Send amount")
-	fmt.Println("createwallet - Creates a new Wallet")
+	fmt.Printf("send -from FROM -to TO -amount AMOUNT -fee FEE -feerate RATE -coins SELECTOR -mine -unlock DURATION - Send amount, paying the miner FEE or RATE per 1000 bytes of the transaction, whichever is more. -coins picks the outputs to spend with one of %s. When -mine flag is set, mine off of this node. An encrypted wallet stays unlocked for at most -unlock\n", strings.Join(bc.CoinSelectorNames(), ", "))
+	fmt.Println("sendmany -from FROM -to ADDRESS:AMOUNT,... -file FILE -fee FEE -feerate RATE -coins SELECTOR -mine -unlock DURATION - Send to several addresses in one transaction, listed in -to or in a CSV file of address,amount lines or a JSON file of [{\"address\": ..., \"amount\": ...}]. Otherwise like send")
+	fmt.Println("createwallet -hd - Creates a new Wallet. With -hd, addresses from now on are derived from a new recovery phrase")
+	fmt.Println("restorewallet -mnemonic PHRASE -scheme NAME - Restores the used addresses of a recovery phrase into a new wallet file. Use -scheme p256 for wallets made before secp256k1 keys")
+	fmt.Println("encryptwallet - Encrypts the wallet file with a passphrase")
+	fmt.Println("changepassphrase - Changes the passphrase of an encrypted wallet file")
 	fmt.Println("listaddresses - Lists the addresses in our wallet file")
+	fmt.Println("getpubkey -address ADDRESS - Prints the public key of an address in our wallet file, to give to others for createmultisig")
+	fmt.Println("createmultisig -m M -keys KEYS - Creates an address needing M signatures by the comma-separated KEYS, each an address in our wallet file or a public key in hex")
+	fmt.Println("spendmultisig -from FROM -to TO -amount AMOUNT -fee FEE -coins SELECTOR -file FILE - Writes an unsigned transaction spending from a multisig address to FILE")
+	fmt.Println("signmultisig -file FILE -unlock DURATION - Adds the signatures of our keys to the transaction in FILE")
+	fmt.Println("sendmultisig -file FILE -mine - Sends the transaction in FILE once it has enough signatures. When -mine flag is set, mine off of this node")
+	fmt.Println("reindexutxo - Validates the chain, then rebuilds the UTXO set, the address index and the transaction index")
+	fmt.Println("validatechain - Validates every block from the genesis block to the tip, which opening a chain does not")
+	fmt.Println("getproof -txid TXID - Prints the Merkle inclusion proof of a transaction")
+	fmt.Println("gettx -id TXID - Prints a transaction on the chain and the block holding it")
+	fmt.Println("startnode -miner ADDRESS -rpc ADDRESS -api ADDRESS - Start a node listening on the port given by its node ID. -miner enables mining, -rpc serves JSON-RPC and -api the REST API over HTTP on the address")
 }
 
-func (cli *CommandLine) validateArgs() {
-	if len(os.Args) < 2 {
+func (cli *CommandLine) validateArgs(args []string) error {
+	if len(args) < 1 {
 		cli.printUsage()
-		runtime.Goexit()
+		return ErrUsage
 	}
+	return nil
 }
 
-func (cli *CommandLine) printChain() {
-	chain := bc.ContinueBlockChain("")
+func (cli *CommandLine) printChain() error {
+	chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 	iterator := chain.Iterator()
 
 	for {
-		block := iterator.Next()
+		block, err := iterator.Next()
+		if err != nil {
+			return err
+		}
 
 		fmt.Printf("Hash: %x\n", block.Hash)
+		fmt.Printf("Version: %d\n", block.Version)
+		fmt.Printf("Height: %d\n", block.Height)
+		fmt.Printf("Timestamp: %s\n", time.Unix(block.Timestamp, 0).UTC().Format(time.RFC3339))
+		fmt.Printf("Difficulty: %d\n", block.Difficulty)
 		fmt.Printf("Prev hash: %x\n", block.PrevHash)
+		fmt.Printf("Merkle root: %x\n", block.MerkleRoot)
 
-		pow := bc.NewProof(block)
+		pow := bc.NewProof(&block.BlockHeader)
 		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
@@ -53,158 +97,756 @@ func (cli *CommandLine) printChain() {
 			break
 		}
 	}
+
+	return nil
 }
 
-func (cli *CommandLine) createBlockChain(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Address is not valid")
+func (cli *CommandLine) createBlockChain(address string) error {
+	if err := wallet.ValidateAddress(address); err != nil {
+		return err
 	}
 
-	chain := bc.InitBlockChain(address)
+	chain, err := bc.InitBlockChain(address, cli.config.ChainDir())
+	if err != nil {
+		return err
+	}
 	chain.Database.Close()
 	fmt.Println("Finished")
+
+	return nil
 }
 
-func (cli *CommandLine) getBalance(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Address is not valid")
+func (cli *CommandLine) getBalance(address string) error {
+	pubKeyHash, err := wallet.DecodeAddress(address)
+	if err != nil {
+		return err
 	}
 
-	chain := bc.ContinueBlockChain(address)
+	chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 
 	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := chain.FindUTxO(pubKeyHash)
+	UTXOs, err := chain.FindUTxO(pubKeyHash)
+	if err != nil {
+		return err
+	}
 
 	for _, out := range UTXOs {
 		balance += out.Value
 	}
 
 	fmt.Printf("Balance of %s: %d\n", address, balance)
+
+	return nil
+}
+
+// history prints a page of the transactions that credit or debit an
+// address, newest first.
+func (cli *CommandLine) history(address string, offset, limit int) error {
+	pubKeyHash, err := wallet.DecodeAddress(address)
+	if err != nil {
+		return err
+	}
+
+	chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	history, total, err := chain.AddressHistory(pubKeyHash, offset, limit)
+	if err != nil {
+		return err
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	if len(history) == 0 {
+		fmt.Printf("History of %s: no transactions past %d of %d\n", address, offset, total)
+	} else {
+		fmt.Printf("History of %s: %d to %d of %d transactions\n", address, offset+1, offset+len(history), total)
+	}
+	for _, entry := range history {
+		fmt.Printf("Transaction: %x\n", entry.Transaction.Id)
+		fmt.Printf("  Height: %d (%d confirmations)\n", entry.Height, bestHeight-entry.Height+1)
+		fmt.Printf("  Received: %d\n", entry.Received)
+		fmt.Printf("  Sent: %d\n", entry.Sent)
+		if entry.Transaction.IsCoinbase() {
+			fmt.Println("  Counterparties: coinbase")
+		} else {
+			fmt.Printf("  Counterparties: %s\n", strings.Join(entry.Counterparties, ", "))
+		}
+	}
+
+	return nil
 }
 
-func (cli *CommandLine) send(from, to string, amount int) {
-	if !wallet.ValidateAddress(to) {
-		log.Panic("To address is not valid")
+// send makes one transaction for all payments, checking every address
+// before anything is spent.
+func (cli *CommandLine) send(from string, payments []bc.Payment, fee bc.Fee, coins string, mineNow bool, unlockFor time.Duration) error {
+	for _, payment := range payments {
+		if err := wallet.ValidateAddress(payment.Address); err != nil {
+			return err
+		}
+	}
+	selector, err := bc.CoinSelectorByName(coins)
+	if err != nil {
+		return err
 	}
 
-	if !wallet.ValidateAddress(from) {
-		log.Panic("From address is not valid")
+	if err := wallet.ValidateAddress(from); err != nil {
+		return err
 	}
 
-	chain := bc.ContinueBlockChain(from)
+	chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 
-	tx := bc.NewTransaction(from, to, amount, chain)
-	chain.AddBlock([]*bc.Transaction{tx})
+	wallets, err := wallet.CreateWallets(cli.config.WalletFile())
+	if err != nil {
+		return err
+	}
+	if err := unlockWallets(wallets, unlockFor); err != nil {
+		return err
+	}
+	defer wallets.Lock()
+
+	w, err := wallets.GetWallet(from)
+	if err != nil {
+		return err
+	}
+
+	tx, err := bc.NewBatchTransaction(&w, payments, fee, selector, chain)
+	if err != nil {
+		return err
+	}
+	paid, err := chain.BlockFees(chain.LastHash, []*bc.Transaction{tx})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Fee: %d for %d bytes\n", paid, tx.Size())
+	if mineNow {
+		if _, err := chain.MineBlock(from, []*bc.Transaction{tx}); err != nil {
+			return err
+		}
+	} else {
+		if err := network.SendTx(cli.config.Seed, tx); err != nil {
+			return err
+		}
+		fmt.Println("send tx")
+	}
+
 	fmt.Println("Success!")
+
+	return nil
+}
+
+func (cli *CommandLine) reindexUTxO() error {
+	chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	if err := chain.Reindex(); err != nil {
+		return err
+	}
+
+	count, err := chain.CountTransactions()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+
+	return nil
+}
+
+func (cli *CommandLine) validateChain() error {
+	chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	if err := chain.ValidateChain(); err != nil {
+		return err
+	}
+
+	fmt.Println("Chain is valid")
+
+	return nil
+}
+
+func (cli *CommandLine) getProof(txId string) error {
+	id, err := hex.DecodeString(txId)
+	if err != nil {
+		return err
+	}
+
+	chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	header, proof, err := chain.TransactionProof(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Transaction: %x\n", id)
+	fmt.Printf("Block: %x\n", header.Hash())
+	fmt.Printf("Height: %d\n", header.Height)
+	fmt.Printf("Merkle root: %x\n", header.MerkleRoot)
+	fmt.Printf("Index: %d\n", proof.Index)
+	for i, hash := range proof.Hashes {
+		fmt.Printf("  %d: %x\n", i, hash)
+	}
+	fmt.Printf("Valid: %s\n", strconv.FormatBool(bc.VerifyTransactionProof(header, id, proof)))
+
+	return nil
+}
+
+func (cli *CommandLine) getTx(txId string) error {
+	id, err := hex.DecodeString(txId)
+	if err != nil {
+		return err
+	}
+
+	chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	blockHash, position, err := chain.TransactionLocation(id)
+	if err != nil {
+		return err
+	}
+	block, err := chain.GetBlock(blockHash)
+	if err != nil {
+		return err
+	}
+	if position >= len(block.Transactions) {
+		return fmt.Errorf("%w: %x", bc.ErrBadTxIndex, id)
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(block.Transactions[position])
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Height: %d (%d confirmations)\n", block.Height, bestHeight-block.Height+1)
+	fmt.Printf("Timestamp: %s\n", time.Unix(block.Timestamp, 0).UTC().Format(time.RFC3339))
+	fmt.Printf("Position: %d of %d\n", position, len(block.Transactions))
+
+	return nil
+}
+
+// loadWallets opens the wallet file, treating a missing file as empty.
+func (cli *CommandLine) loadWallets() (*wallet.Wallets, error) {
+	wallets, err := wallet.CreateWallets(cli.config.WalletFile())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return wallets, nil
 }
 
-func (cli *CommandLine) listAddresses() {
-	wallets, _ := wallet.CreateWallets()
+func (cli *CommandLine) listAddresses() error {
+	wallets, err := cli.loadWallets()
+	if err != nil {
+		return err
+	}
 	addresses := wallets.GetAllAddresses()
 
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+
+	return nil
 }
 
-func (cli *CommandLine) createWallet() {
-	wallets, _ := wallet.CreateWallets()
-	address := wallets.AddWallet()
-	wallets.SaveFile()
+func (cli *CommandLine) createWallet(hd bool) error {
+	wallets, err := cli.loadWallets()
+	if err != nil {
+		return err
+	}
+	if err := unlockWallets(wallets, 0); err != nil {
+		return err
+	}
+	defer wallets.Lock()
+
+	if hd && !wallets.IsHD() {
+		mnemonic, err := wallet.NewMnemonic()
+		if err != nil {
+			return err
+		}
+		if err := wallets.SetMnemonic(wallet.DefaultScheme, mnemonic); err != nil {
+			return err
+		}
+		fmt.Println("New addresses are derived from this recovery phrase. Write it down and keep it safe:")
+		fmt.Println(mnemonic)
+	}
+
+	address, err := wallets.AddWallet()
+	if err != nil {
+		return err
+	}
+	if err := wallets.SaveFile(cli.config.WalletFile()); err != nil {
+		return err
+	}
 
 	fmt.Printf("New address is: %s\n", address)
+
+	return nil
+}
+
+// restoreWallet creates an HD wallet from its mnemonic and adds the keys of
+// the named scheme the chain shows have been used.
+func (cli *CommandLine) restoreWallet(mnemonic, schemeName string) error {
+	scheme, ok := wallet.SchemeByName(schemeName)
+	if !ok {
+		return fmt.Errorf("%w: %s", wallet.ErrUnknownScheme, schemeName)
+	}
+
+	wallets, err := wallet.CreateWallets(cli.config.WalletFile())
+	if err == nil {
+		return fmt.Errorf("wallet file %s already exists", cli.config.WalletFile())
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := wallets.SetMnemonic(scheme, mnemonic); err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+	if err == nil {
+		used, err = chain.UsedPubKeyHashes()
+		chain.Database.Close()
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, bc.ErrChainNotFound) {
+		return err
+	}
+
+	count, err := wallets.Restore(func(pubKeyHash []byte) bool {
+		return used[hex.EncodeToString(pubKeyHash)]
+	})
+	if err != nil {
+		return err
+	}
+	if err := wallets.SaveFile(cli.config.WalletFile()); err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %d addresses\n", count)
+	for _, address := range wallets.GetAllAddresses() {
+		fmt.Println(address)
+	}
+
+	return nil
+}
+
+func (cli *CommandLine) encryptWallet() error {
+	wallets, err := wallet.CreateWallets(cli.config.WalletFile())
+	if err != nil {
+		return err
+	}
+	if wallets.IsEncrypted() {
+		return wallet.ErrAlreadyEncrypted
+	}
+
+	passphrase, err := readNewPassphrase("New passphrase: ")
+	if err != nil {
+		return err
+	}
+	if err := wallets.Encrypt(passphrase); err != nil {
+		return err
+	}
+	if err := wallets.SaveFile(cli.config.WalletFile()); err != nil {
+		return err
+	}
+
+	fmt.Println("Wallet encrypted")
+
+	return nil
+}
+
+func (cli *CommandLine) changePassphrase() error {
+	wallets, err := wallet.CreateWallets(cli.config.WalletFile())
+	if err != nil {
+		return err
+	}
+	if !wallets.IsEncrypted() {
+		return wallet.ErrNotEncrypted
+	}
+
+	oldPassphrase, err := readPassphrase("Current passphrase: ")
+	if err != nil {
+		return err
+	}
+	newPassphrase, err := readNewPassphrase("New passphrase: ")
+	if err != nil {
+		return err
+	}
+	if err := wallets.ChangePassphrase(oldPassphrase, newPassphrase); err != nil {
+		return err
+	}
+	if err := wallets.SaveFile(cli.config.WalletFile()); err != nil {
+		return err
+	}
+
+	fmt.Println("Passphrase changed")
+
+	return nil
+}
+
+// serveHTTP starts serving handler on address in the background.
+func serveHTTP(name, address string, handler http.Handler) (net.Listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("%s server listening on %s\n", name, ln.Addr())
+	go func() {
+		if err := http.Serve(ln, handler); err != nil {
+			fmt.Printf("%s server stopped: %s\n", name, err)
+		}
+	}()
+
+	return ln, nil
+}
+
+func (cli *CommandLine) startNode(minerAddress, rpcAddress, apiAddress string) error {
+	nodeId := cli.config.NodeID
+	fmt.Printf("Starting Node %s on %s\n", nodeId, cli.config.Network)
+
+	if len(minerAddress) > 0 {
+		if err := wallet.ValidateAddress(minerAddress); err != nil {
+			return fmt.Errorf("miner address: %w", err)
+		}
+		fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
+	}
+
+	chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	chain.Miner.OnHashRate = func(hashesPerSecond float64) {
+		fmt.Printf("Mining at %.0f hashes/s\n", hashesPerSecond)
+	}
+
+	address := fmt.Sprintf("localhost:%s", nodeId)
+	server := network.NewServer(address, minerAddress, chain, []string{cli.config.Seed})
+
+	if len(rpcAddress) > 0 {
+		ln, err := serveHTTP("JSON-RPC", rpcAddress, rpc.NewServer(server))
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+	}
+	if len(apiAddress) > 0 {
+		ln, err := serveHTTP("REST API", apiAddress, api.NewServer(chain))
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+	}
+
+	return server.Start()
 }
 
-func (cli *CommandLine) Run() {
-	cli.validateArgs()
+// ExitCode maps an error returned by Run to a process exit status: 0 for
+// success or a request for help, 2 for usage errors and 1 for anything else.
+func ExitCode(err error) int {
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, ErrUsage):
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Run parses the command line and executes the command. Errors are returned
+// rather than printed; ExitCode turns them into an exit status.
+func (cli *CommandLine) Run() error {
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		cli.printUsage()
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUsage, err)
+	}
+	cli.config = cfg
+
+	if err := cli.validateArgs(args); err != nil {
+		return err
+	}
 
-	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
-	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
-	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
-	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
-	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
-	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ContinueOnError)
+	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ContinueOnError)
+	historyCmd := flag.NewFlagSet("history", flag.ContinueOnError)
+	sendCmd := flag.NewFlagSet("send", flag.ContinueOnError)
+	sendManyCmd := flag.NewFlagSet("sendmany", flag.ContinueOnError)
+	printChainCmd := flag.NewFlagSet("printchain", flag.ContinueOnError)
+	createWalletCmd := flag.NewFlagSet("createwallet", flag.ContinueOnError)
+	restoreWalletCmd := flag.NewFlagSet("restorewallet", flag.ContinueOnError)
+	encryptWalletCmd := flag.NewFlagSet("encryptwallet", flag.ContinueOnError)
+	changePassphraseCmd := flag.NewFlagSet("changepassphrase", flag.ContinueOnError)
+	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ContinueOnError)
+	reindexUTxOCmd := flag.NewFlagSet("reindexutxo", flag.ContinueOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ContinueOnError)
+	validateChainCmd := flag.NewFlagSet("validatechain", flag.ContinueOnError)
+	getProofCmd := flag.NewFlagSet("getproof", flag.ContinueOnError)
+	getTxCmd := flag.NewFlagSet("gettx", flag.ContinueOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ContinueOnError)
+	createMultiSigCmd := flag.NewFlagSet("createmultisig", flag.ContinueOnError)
+	spendMultiSigCmd := flag.NewFlagSet("spendmultisig", flag.ContinueOnError)
+	signMultiSigCmd := flag.NewFlagSet("signmultisig", flag.ContinueOnError)
+	sendMultiSigCmd := flag.NewFlagSet("sendmultisig", flag.ContinueOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	historyAddress := historyCmd.String("address", "", "The address to get the history of")
+	historyOffset := historyCmd.Int("offset", 0, "Number of newer transactions to skip")
+	historyLimit := historyCmd.Int("limit", 20, "Number of transactions to print")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
-
-	switch os.Args[1] {
+	sendFee := sendCmd.Int("fee", 0, "Fee to pay the miner")
+	sendFeeRate := sendCmd.Int("feerate", 0, "Fee to pay the miner per 1000 bytes")
+	sendCoins := sendCmd.String("coins", bc.DefaultCoinSelector.Name(), "How to pick the outputs to spend")
+	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendUnlock := sendCmd.Duration("unlock", time.Minute, "How long an encrypted wallet stays unlocked")
+	sendManyFrom := sendManyCmd.String("from", "", "Source wallet address")
+	sendManyTo := sendManyCmd.String("to", "", "Comma-separated ADDRESS:AMOUNT pairs")
+	sendManyFile := sendManyCmd.String("file", "", "CSV or JSON file listing the payments")
+	sendManyFee := sendManyCmd.Int("fee", 0, "Fee to pay the miner")
+	sendManyFeeRate := sendManyCmd.Int("feerate", 0, "Fee to pay the miner per 1000 bytes")
+	sendManyCoins := sendManyCmd.String("coins", bc.DefaultCoinSelector.Name(), "How to pick the outputs to spend")
+	sendManyMine := sendManyCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendManyUnlock := sendManyCmd.Duration("unlock", time.Minute, "How long an encrypted wallet stays unlocked")
+	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeRPC := startNodeCmd.String("rpc", "", "Serve JSON-RPC requests on ADDRESS")
+	startNodeAPI := startNodeCmd.String("api", "", "Serve the REST API on ADDRESS")
+	getProofTxId := getProofCmd.String("txid", "", "Id of the transaction to prove")
+	getTxId := getTxCmd.String("id", "", "Id of the transaction to print")
+	createWalletHD := createWalletCmd.Bool("hd", false, "Derive addresses from a recovery phrase")
+	restoreWalletMnemonic := restoreWalletCmd.String("mnemonic", "", "Recovery phrase of the wallet")
+	restoreWalletScheme := restoreWalletCmd.String("scheme", wallet.DefaultScheme.Name(), "Key scheme of the wallet")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "Address in the wallet file")
+	createMultiSigM := createMultiSigCmd.Int("m", 0, "Number of signatures needed")
+	createMultiSigKeys := createMultiSigCmd.String("keys", "", "Comma-separated addresses or public keys")
+	spendMultiSigFrom := spendMultiSigCmd.String("from", "", "Source multisig address")
+	spendMultiSigTo := spendMultiSigCmd.String("to", "", "Destination wallet address")
+	spendMultiSigAmount := spendMultiSigCmd.Int("amount", 0, "Amount to send")
+	spendMultiSigFee := spendMultiSigCmd.Int("fee", 0, "Fee to pay the miner")
+	spendMultiSigCoins := spendMultiSigCmd.String("coins", bc.DefaultCoinSelector.Name(), "How to pick the outputs to spend")
+	spendMultiSigFile := spendMultiSigCmd.String("file", "", "File to write the transaction to")
+	signMultiSigFile := signMultiSigCmd.String("file", "", "File holding the transaction")
+	signMultiSigUnlock := signMultiSigCmd.Duration("unlock", time.Minute, "How long an encrypted wallet stays unlocked")
+	sendMultiSigFile := sendMultiSigCmd.String("file", "", "File holding the transaction")
+	sendMultiSigMine := sendMultiSigCmd.Bool("mine", false, "Mine immediately on the same node")
+
+	var cmd *flag.FlagSet
+	switch args[0] {
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		cmd = getBalanceCmd
 	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		cmd = createBlockchainCmd
+	case "history":
+		cmd = historyCmd
 	case "listaddresses":
-		err := listAddressesCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		cmd = listAddressesCmd
 	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		cmd = createWalletCmd
+	case "restorewallet":
+		cmd = restoreWalletCmd
+	case "encryptwallet":
+		cmd = encryptWalletCmd
+	case "changepassphrase":
+		cmd = changePassphraseCmd
 	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		cmd = printChainCmd
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		cmd = sendCmd
+	case "sendmany":
+		cmd = sendManyCmd
+	case "reindexutxo":
+		cmd = reindexUTxOCmd
+	case "startnode":
+		cmd = startNodeCmd
+	case "validatechain":
+		cmd = validateChainCmd
+	case "getproof":
+		cmd = getProofCmd
+	case "gettx":
+		cmd = getTxCmd
+	case "getpubkey":
+		cmd = getPubKeyCmd
+	case "createmultisig":
+		cmd = createMultiSigCmd
+	case "spendmultisig":
+		cmd = spendMultiSigCmd
+	case "signmultisig":
+		cmd = signMultiSigCmd
+	case "sendmultisig":
+		cmd = sendMultiSigCmd
 	default:
 		cli.printUsage()
-		runtime.Goexit()
+		return ErrUsage
 	}
 
-	if getBalanceCmd.Parsed() {
-		if *getBalanceAddress == "" {
-			getBalanceCmd.Usage()
-			runtime.Goexit()
+	if err := cmd.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
 		}
-		cli.getBalance(*getBalanceAddress)
+		return fmt.Errorf("%w: %v", ErrUsage, err)
+	}
+
+	usage := func() error {
+		cmd.Usage()
+		return ErrUsage
 	}
 
-	if createBlockchainCmd.Parsed() {
+	switch cmd {
+	case getBalanceCmd:
+		if *getBalanceAddress == "" {
+			return usage()
+		}
+		return cli.getBalance(*getBalanceAddress)
+
+	case createBlockchainCmd:
 		if *createBlockchainAddress == "" {
-			createBlockchainCmd.Usage()
-			runtime.Goexit()
+			return usage()
 		}
-		cli.createBlockChain(*createBlockchainAddress)
-	}
+		return cli.createBlockChain(*createBlockchainAddress)
 
-	if printChainCmd.Parsed() {
-		cli.printChain()
-	}
+	case historyCmd:
+		if *historyAddress == "" || *historyOffset < 0 || *historyLimit <= 0 {
+			return usage()
+		}
+		return cli.history(*historyAddress, *historyOffset, *historyLimit)
 
-	if createWalletCmd.Parsed() {
-		cli.createWallet()
-	}
+	case printChainCmd:
+		return cli.printChain()
 
-	if listAddressesCmd.Parsed() {
-		cli.listAddresses()
-	}
+	case createWalletCmd:
+		return cli.createWallet(*createWalletHD)
+
+	case restoreWalletCmd:
+		if *restoreWalletMnemonic == "" {
+			return usage()
+		}
+		return cli.restoreWallet(*restoreWalletMnemonic, *restoreWalletScheme)
+
+	case encryptWalletCmd:
+		return cli.encryptWallet()
+
+	case changePassphraseCmd:
+		return cli.changePassphrase()
+
+	case listAddressesCmd:
+		return cli.listAddresses()
+
+	case reindexUTxOCmd:
+		return cli.reindexUTxO()
+
+	case validateChainCmd:
+		return cli.validateChain()
+
+	case getProofCmd:
+		if *getProofTxId == "" {
+			return usage()
+		}
+		return cli.getProof(*getProofTxId)
+
+	case getTxCmd:
+		if *getTxId == "" {
+			return usage()
+		}
+		return cli.getTx(*getTxId)
+
+	case sendCmd:
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendFeeRate < 0 || *sendUnlock <= 0 {
+			return usage()
+		}
+		fee := bc.Fee{Amount: *sendFee, Rate: *sendFeeRate}
+		payments := []bc.Payment{{Address: *sendTo, Amount: *sendAmount}}
+		return cli.send(*sendFrom, payments, fee, *sendCoins, *sendMine, *sendUnlock)
 
-	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
-			sendCmd.Usage()
-			runtime.Goexit()
+	case sendManyCmd:
+		if *sendManyFrom == "" || (*sendManyTo == "") == (*sendManyFile == "") || *sendManyFee < 0 || *sendManyFeeRate < 0 || *sendManyUnlock <= 0 {
+			return usage()
 		}
+		var payments []bc.Payment
+		if *sendManyFile != "" {
+			payments, err = readPayments(*sendManyFile)
+		} else {
+			payments, err = parsePayments(*sendManyTo)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUsage, err)
+		}
+		fee := bc.Fee{Amount: *sendManyFee, Rate: *sendManyFeeRate}
+		return cli.send(*sendManyFrom, payments, fee, *sendManyCoins, *sendManyMine, *sendManyUnlock)
+
+	case getPubKeyCmd:
+		if *getPubKeyAddress == "" {
+			return usage()
+		}
+		return cli.getPubKey(*getPubKeyAddress)
+
+	case createMultiSigCmd:
+		if *createMultiSigM <= 0 || *createMultiSigKeys == "" {
+			return usage()
+		}
+		return cli.createMultiSig(*createMultiSigM, *createMultiSigKeys)
 
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+	case spendMultiSigCmd:
+		if *spendMultiSigFrom == "" || *spendMultiSigTo == "" || *spendMultiSigAmount <= 0 || *spendMultiSigFee < 0 || *spendMultiSigFile == "" {
+			return usage()
+		}
+		return cli.spendMultiSig(*spendMultiSigFrom, *spendMultiSigTo, *spendMultiSigAmount, *spendMultiSigFee, *spendMultiSigCoins, *spendMultiSigFile)
+
+	case signMultiSigCmd:
+		if *signMultiSigFile == "" || *signMultiSigUnlock <= 0 {
+			return usage()
+		}
+		return cli.signMultiSig(*signMultiSigFile, *signMultiSigUnlock)
+
+	case sendMultiSigCmd:
+		if *sendMultiSigFile == "" {
+			return usage()
+		}
+		return cli.sendMultiSig(*sendMultiSigFile, *sendMultiSigMine)
+
+	case startNodeCmd:
+		return cli.startNode(*startNodeMiner, *startNodeRPC, *startNodeAPI)
 	}
+
+	return nil
 }
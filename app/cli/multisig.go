@@ -0,0 +1,219 @@
+package cli
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	bc "github.com/serj1c/blockchainio/app/blockchain"
+	"github.com/serj1c/blockchainio/app/network"
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+// A multisig spend goes from hand to hand as a JSON file: spendmultisig
+// writes it, each key holder runs signmultisig on it and sendmultisig
+// broadcasts it once it has enough signatures.
+
+func (cli *CommandLine) getPubKey(address string) error {
+	wallets, err := wallet.CreateWallets(cli.config.WalletFile())
+	if err != nil {
+		return err
+	}
+
+	pubKey, err := wallets.PublicKey(address)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%x\n", pubKey)
+
+	return nil
+}
+
+// createMultiSig makes the m-of-n redeem script of keys, each either an
+// address in our wallet file or a public key in hex, and keeps it in the
+// wallet file.
+func (cli *CommandLine) createMultiSig(m int, keys string) error {
+	wallets, err := cli.loadWallets()
+	if err != nil {
+		return err
+	}
+
+	var pubKeys [][]byte
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if pubKey, err := wallets.PublicKey(key); err == nil {
+			pubKeys = append(pubKeys, pubKey)
+			continue
+		}
+		pubKey, err := hex.DecodeString(key)
+		if err != nil {
+			return fmt.Errorf("%s is neither an address in the wallet nor a public key", key)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	script, err := bc.MultiSigScript(m, pubKeys)
+	if err != nil {
+		return err
+	}
+	if err := unlockWallets(wallets, 0); err != nil {
+		return err
+	}
+	address, err := wallets.AddScript(script)
+	if err != nil {
+		return err
+	}
+	if err := wallets.SaveFile(cli.config.WalletFile()); err != nil {
+		return err
+	}
+
+	fmt.Printf("Multisig address: %s\n", address)
+	fmt.Printf("Redeem script: %x\n", []byte(script))
+	fmt.Printf("Script: %s\n", script)
+
+	return nil
+}
+
+func (cli *CommandLine) spendMultiSig(from, to string, amount, fee int, coins, file string) error {
+	if err := wallet.ValidateAddress(to); err != nil {
+		return err
+	}
+	selector, err := bc.CoinSelectorByName(coins)
+	if err != nil {
+		return err
+	}
+
+	wallets, err := wallet.CreateWallets(cli.config.WalletFile())
+	if err != nil {
+		return err
+	}
+	script, err := wallets.GetScript(from)
+	if err != nil {
+		return err
+	}
+
+	chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	ptx, err := bc.NewMultiSigTransaction(script, to, amount, fee, selector, chain)
+	if err != nil {
+		return err
+	}
+	if err := writePartialTx(file, ptx); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote transaction %x to %s; it needs %d signatures\n", ptx.Tx.Id, file, ptx.Missing())
+
+	return nil
+}
+
+// signMultiSig adds the signatures of every key of our wallet file the
+// transaction in file can be signed with.
+func (cli *CommandLine) signMultiSig(file string, unlockFor time.Duration) error {
+	ptx, err := readPartialTx(file)
+	if err != nil {
+		return err
+	}
+
+	wallets, err := wallet.CreateWallets(cli.config.WalletFile())
+	if err != nil {
+		return err
+	}
+	if err := unlockWallets(wallets, unlockFor); err != nil {
+		return err
+	}
+	defer wallets.Lock()
+
+	added, signers := 0, 0
+	for _, pubKey := range ptx.PubKeys() {
+		w, err := wallets.GetWallet(string(wallet.PublicKeyAddress(pubKey)))
+		if err != nil {
+			continue
+		}
+		count, err := ptx.Sign(&w)
+		if err != nil {
+			return err
+		}
+		added += count
+		signers++
+	}
+	if signers == 0 {
+		return bc.ErrKeyNotInScript
+	}
+	if err := writePartialTx(file, ptx); err != nil {
+		return err
+	}
+
+	fmt.Printf("Added %d signatures, %d more needed\n", added, ptx.Missing())
+
+	return nil
+}
+
+// sendMultiSig finalizes the transaction in file and sends it like send. When
+// mined here the reward goes to the multisig address spent from.
+func (cli *CommandLine) sendMultiSig(file string, mineNow bool) error {
+	ptx, err := readPartialTx(file)
+	if err != nil {
+		return err
+	}
+
+	tx, err := ptx.Finalize()
+	if err != nil {
+		return err
+	}
+
+	if mineNow {
+		chain, err := bc.ContinueBlockChain(cli.config.ChainDir())
+		if err != nil {
+			return err
+		}
+		defer chain.Database.Close()
+
+		from := string(bc.ScriptAddress(ptx.Inputs[0].RedeemScript))
+		if _, err := chain.MineBlock(from, []*bc.Transaction{tx}); err != nil {
+			return err
+		}
+	} else {
+		if err := network.SendTx(cli.config.Seed, tx); err != nil {
+			return err
+		}
+		fmt.Println("send tx")
+	}
+
+	fmt.Println("Success!")
+
+	return nil
+}
+
+func readPartialTx(file string) (*bc.PartialTx, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var ptx bc.PartialTx
+	if err := json.Unmarshal(data, &ptx); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", file, err)
+	}
+	if len(ptx.Inputs) == 0 || len(ptx.Inputs) != len(ptx.Tx.Inputs) {
+		return nil, fmt.Errorf("reading %s: %w", file, bc.ErrInvalidMultiSig)
+	}
+
+	return &ptx, nil
+}
+
+func writePartialTx(file string, ptx *bc.PartialTx) error {
+	data, err := json.MarshalIndent(ptx, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, append(data, '\n'), 0600)
+}
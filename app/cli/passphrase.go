@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/serj1c/blockchainio/app/wallet"
+	"golang.org/x/term"
+)
+
+// EnvPassphrase, if set, is used instead of asking for the wallet passphrase,
+// for scripts without a terminal.
+const EnvPassphrase = "BLOCKCHAINIO_PASSPHRASE"
+
+var errPassphraseMismatch = errors.New("passphrases do not match")
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassphrase asks for a passphrase without echoing it if stdin is a
+// terminal, and otherwise reads a line from stdin.
+func readPassphrase(prompt string) (string, error) {
+	if passphrase, ok := os.LookupEnv(EnvPassphrase); ok {
+		return passphrase, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+
+	return string(passphrase), err
+}
+
+// readNewPassphrase asks for a new passphrase twice when on a terminal.
+func readNewPassphrase(prompt string) (string, error) {
+	passphrase, err := readPassphrase(prompt)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := os.LookupEnv(EnvPassphrase); ok || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return passphrase, nil
+	}
+
+	again, err := readPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if again != passphrase {
+		return "", errPassphraseMismatch
+	}
+
+	return passphrase, nil
+}
+
+// unlockWallets asks for the passphrase of encrypted wallets and unlocks them
+// for timeout. It does nothing for wallets that are not encrypted.
+func unlockWallets(wallets *wallet.Wallets, timeout time.Duration) error {
+	if !wallets.IsLocked() {
+		return nil
+	}
+
+	passphrase, err := readPassphrase("Wallet passphrase: ")
+	if err != nil {
+		return err
+	}
+
+	return wallets.Unlock(passphrase, timeout)
+}
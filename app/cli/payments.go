@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	bc "github.com/serj1c/blockchainio/app/blockchain"
+)
+
+// parsePayments reads comma-separated ADDRESS:AMOUNT pairs.
+func parsePayments(list string) ([]bc.Payment, error) {
+	var payments []bc.Payment
+
+	for _, pair := range strings.Split(list, ",") {
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("payment %q is not ADDRESS:AMOUNT", pair)
+		}
+		payment, err := newPayment(pair[:i], pair[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+
+	return payments, nil
+}
+
+// readPayments reads the payments in a JSON file, if its name ends in .json,
+// or else a CSV file of address,amount lines.
+func readPayments(file string) ([]bc.Payment, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		var payments []bc.Payment
+		if err := json.Unmarshal(data, &payments); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", file, err)
+		}
+		return payments, nil
+	}
+
+	var payments []bc.Payment
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", file, err)
+		}
+		payment, err := newPayment(record[0], record[1])
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", file, err)
+		}
+		payments = append(payments, payment)
+	}
+
+	return payments, nil
+}
+
+func newPayment(address, amount string) (bc.Payment, error) {
+	value, err := strconv.Atoi(strings.TrimSpace(amount))
+	if err != nil {
+		return bc.Payment{}, fmt.Errorf("amount %q to %s is not a number", amount, address)
+	}
+
+	return bc.Payment{Address: strings.TrimSpace(address), Amount: value}, nil
+}
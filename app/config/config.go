@@ -0,0 +1,148 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	DefaultNetwork = "main"
+	DefaultSeed    = "localhost:3000"
+	configFile     = "config.json"
+)
+
+// Environment variables read by Load. NODE_ID is kept from before there was
+// a configuration file.
+const (
+	EnvConfig  = "BLOCKCHAINIO_CONFIG"
+	EnvDataDir = "BLOCKCHAINIO_DATADIR"
+	EnvNetwork = "BLOCKCHAINIO_NETWORK"
+	EnvNodeID  = "NODE_ID"
+	EnvSeed    = "BLOCKCHAINIO_SEED"
+)
+
+var ErrNoNodeID = errors.New("node ID is not set")
+
+// Config says where a node keeps its data and which chain it is on. Every
+// network and node ID gets its own directory under DataDir, so several chains
+// and nodes can share a host.
+type Config struct {
+	DataDir string `json:"datadir"`
+	Network string `json:"network"`
+	NodeID  string `json:"nodeid"`
+	// Seed is the node others announce themselves to on startup and where
+	// transactions are sent when they are not mined locally. The default is
+	// the same for every network; a seed whose chain has another genesis
+	// block is dropped at the version handshake.
+	Seed string `json:"seed"`
+}
+
+// Default returns the configuration used when nothing else is set: the main
+// network in ~/.blockchainio.
+func Default() *Config {
+	dataDir := "tmp"
+	if home, err := os.UserHomeDir(); err == nil {
+		dataDir = filepath.Join(home, ".blockchainio")
+	}
+
+	return &Config{
+		DataDir: dataDir,
+		Network: DefaultNetwork,
+		Seed:    DefaultSeed,
+	}
+}
+
+// Load builds the configuration from the global flags at the start of args,
+// the environment and a JSON config file, in that order of precedence. The
+// file is the one given by -config or BLOCKCHAINIO_CONFIG, or config.json in
+// the data directory if it exists. It returns the arguments left after the
+// global flags.
+func Load(args []string) (*Config, []string, error) {
+	flags := flag.NewFlagSet("global", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv(EnvConfig), "Path of the JSON config file")
+	dataDir := flags.String("datadir", "", "Directory for chains and wallets")
+	network := flags.String("network", "", "Name of the network")
+	nodeId := flags.String("node", "", "Node ID, also the port the node listens on")
+	seed := flags.String("seed", "", "Address of the seed node")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := Default()
+	override := func(values ...string) {
+		for i, dst := range []*string{&cfg.DataDir, &cfg.Network, &cfg.NodeID, &cfg.Seed} {
+			if values[i] != "" {
+				*dst = values[i]
+			}
+		}
+	}
+
+	if *configPath == "" {
+		dir := cfg.DataDir
+		if *dataDir != "" {
+			dir = *dataDir
+		} else if env := os.Getenv(EnvDataDir); env != "" {
+			dir = env
+		}
+
+		path := filepath.Join(dir, configFile)
+		if _, err := os.Stat(path); err == nil {
+			*configPath = path
+		}
+	}
+	if *configPath != "" {
+		file, err := ReadFile(*configPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		override(file.DataDir, file.Network, file.NodeID, file.Seed)
+	}
+
+	override(os.Getenv(EnvDataDir), os.Getenv(EnvNetwork), os.Getenv(EnvNodeID), os.Getenv(EnvSeed))
+	override(*dataDir, *network, *nodeId, *seed)
+
+	return cfg, flags.Args(), nil
+}
+
+// ReadFile reads a JSON config file. Fields missing from it are left empty.
+func ReadFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// Validate reports settings a node cannot run without.
+func (c *Config) Validate() error {
+	if c.NodeID == "" {
+		return ErrNoNodeID
+	}
+	return nil
+}
+
+// NodeDir is the directory of this node on this network.
+func (c *Config) NodeDir() string {
+	return filepath.Join(c.DataDir, c.Network, c.NodeID)
+}
+
+// ChainDir is where the node's block database lives.
+func (c *Config) ChainDir() string {
+	return filepath.Join(c.NodeDir(), "blocks")
+}
+
+// WalletFile is the path of the node's wallet file.
+func (c *Config) WalletFile() string {
+	return filepath.Join(c.NodeDir(), "wallets.data")
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestLoadPrecedence checks that flags win over the environment, the
+// environment over the config file and the file over the defaults, and that
+// the config.json looked up is the one of the data directory in effect.
+func TestLoadPrecedence(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	defaultDir := filepath.Join(home, ".blockchainio")
+	flagDir, envDir := t.TempDir(), t.TempDir()
+	explicit := filepath.Join(t.TempDir(), "node.json")
+
+	writeConfig := func(path, content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(filepath.Join(flagDir, configFile), `{"network": "flagdir", "seed": "flagdir:1"}`)
+	writeConfig(filepath.Join(envDir, configFile), `{"network": "envdir", "nodeid": "4000"}`)
+	writeConfig(explicit, `{"datadir": "/srv/chain", "network": "test", "nodeid": "5000", "seed": "seed:1"}`)
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want Config
+	}{
+		{
+			name: "defaults",
+			want: Config{DataDir: defaultDir, Network: DefaultNetwork, Seed: DefaultSeed},
+		},
+		{
+			name: "config file given by flag",
+			args: []string{"-config", explicit},
+			want: Config{DataDir: "/srv/chain", Network: "test", NodeID: "5000", Seed: "seed:1"},
+		},
+		{
+			name: "config file given by environment",
+			env:  map[string]string{EnvConfig: explicit},
+			want: Config{DataDir: "/srv/chain", Network: "test", NodeID: "5000", Seed: "seed:1"},
+		},
+		{
+			name: "environment over file",
+			args: []string{"-config", explicit},
+			env:  map[string]string{EnvNetwork: "envnet", EnvNodeID: "3001"},
+			want: Config{DataDir: "/srv/chain", Network: "envnet", NodeID: "3001", Seed: "seed:1"},
+		},
+		{
+			name: "flags over environment and file",
+			args: []string{"-config", explicit, "-network", "flagnet", "-node", "3002", "-seed", "flag:1"},
+			env:  map[string]string{EnvNetwork: "envnet", EnvNodeID: "3001", EnvSeed: "env:1"},
+			want: Config{DataDir: "/srv/chain", Network: "flagnet", NodeID: "3002", Seed: "flag:1"},
+		},
+		{
+			name: "config.json of the data directory flag",
+			args: []string{"-datadir", flagDir},
+			env:  map[string]string{EnvDataDir: envDir},
+			want: Config{DataDir: flagDir, Network: "flagdir", Seed: "flagdir:1"},
+		},
+		{
+			name: "config.json of the data directory variable",
+			env:  map[string]string{EnvDataDir: envDir},
+			want: Config{DataDir: envDir, Network: "envdir", NodeID: "4000", Seed: DefaultSeed},
+		},
+		{
+			name: "explicit file over the data directory's",
+			args: []string{"-datadir", flagDir, "-config", explicit},
+			want: Config{DataDir: flagDir, Network: "test", NodeID: "5000", Seed: "seed:1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{EnvConfig, EnvDataDir, EnvNetwork, EnvNodeID, EnvSeed} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			cfg, rest, err := Load(append(tt.args, "send", "-amount", "1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*cfg, tt.want) {
+				t.Errorf("Load = %+v, want %+v", *cfg, tt.want)
+			}
+			if !reflect.DeepEqual(rest, []string{"send", "-amount", "1"}) {
+				t.Errorf("Load left %v", rest)
+			}
+		})
+	}
+}
+
+func TestLoadBadConfigFile(t *testing.T) {
+	t.Setenv(EnvConfig, "")
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	if _, _, err := Load([]string{"-config", path}); err == nil {
+		t.Error("Load succeeded with a missing config file")
+	}
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Load([]string{"-config", path}); err == nil {
+		t.Error("Load succeeded with a malformed config file")
+	}
+}
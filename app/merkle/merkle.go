@@ -0,0 +1,122 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// Leaves and inner nodes are hashed with different prefixes so that an inner
+// node can never be passed off as a leaf.
+const (
+	leafPrefix = byte(0x00)
+	nodePrefix = byte(0x01)
+)
+
+var ErrIndexOutOfRange = errors.New("leaf index is out of range")
+
+// Tree is a binary Merkle tree over a list of items. On a level with an odd
+// number of nodes the last node is paired with itself.
+type Tree struct {
+	leaves int
+	// levels[0] holds the leaf hashes, the last level holds the root.
+	levels [][][]byte
+}
+
+// Proof shows that an item is the leaf at Index of a tree. Hashes holds the
+// sibling of every node on the way from that leaf up to the root.
+type Proof struct {
+	Index  int
+	Hashes [][]byte
+}
+
+func hashLeaf(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{leafPrefix}, data...))
+
+	return hash[:]
+}
+
+func hashNode(left, right []byte) []byte {
+	data := append([]byte{nodePrefix}, left...)
+	data = append(data, right...)
+	hash := sha256.Sum256(data)
+
+	return hash[:]
+}
+
+func NewTree(data [][]byte) *Tree {
+	var leaves [][]byte
+
+	for _, item := range data {
+		leaves = append(leaves, hashLeaf(item))
+	}
+	if len(leaves) == 0 {
+		empty := sha256.Sum256(nil)
+		return &Tree{levels: [][][]byte{{empty[:]}}}
+	}
+
+	tree := &Tree{leaves: len(leaves), levels: [][][]byte{leaves}}
+	level := leaves
+
+	for len(level) > 1 {
+		var next [][]byte
+
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, hashNode(level[i], right))
+		}
+
+		tree.levels = append(tree.levels, next)
+		level = next
+	}
+
+	return tree
+}
+
+func (t *Tree) Root() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Proof returns the inclusion proof of the leaf at index.
+func (t *Tree) Proof(index int) (*Proof, error) {
+	if index < 0 || index >= t.leaves {
+		return nil, ErrIndexOutOfRange
+	}
+
+	proof := &Proof{Index: index}
+
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		proof.Hashes = append(proof.Hashes, level[sibling])
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// Verify checks that data is included in the tree with the given root.
+func Verify(root, data []byte, proof *Proof) bool {
+	if proof == nil || proof.Index < 0 {
+		return false
+	}
+
+	hash := hashLeaf(data)
+	index := proof.Index
+
+	for _, sibling := range proof.Hashes {
+		if index%2 == 0 {
+			hash = hashNode(hash, sibling)
+		} else {
+			hash = hashNode(sibling, hash)
+		}
+		index /= 2
+	}
+
+	return index == 0 && bytes.Equal(hash, root)
+}
@@ -0,0 +1,704 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	bc "github.com/serj1c/blockchainio/app/blockchain"
+)
+
+const (
+	protocol      = "tcp"
+	version       = 2
+	commandLength = 12
+
+	// A message is read in full before it is handled. The largest, a block,
+	// holds at most bc.MaxBlockSize bytes of transactions; anything longer or
+	// slower than readTimeout is dropped.
+	maxMessageSize = 2 * bc.MaxBlockSize
+	readTimeout    = 30 * time.Second
+	writeTimeout   = 30 * time.Second
+
+	// An inventory answering getblocks lists at most maxInvBlocks hashes,
+	// as in Bitcoin. A full one tells the peer to ask for more.
+	maxInvBlocks = 500
+)
+
+type Block struct {
+	AddrFrom string
+	Block    []byte
+}
+
+// GetBlocks asks for the hashes of the blocks following the first block of
+// Locator that is on the peer's main chain.
+type GetBlocks struct {
+	AddrFrom string
+	Locator  [][]byte
+}
+
+type GetData struct {
+	AddrFrom string
+	Type     string
+	Id       []byte
+}
+
+type Inv struct {
+	AddrFrom string
+	Type     string
+	Items    [][]byte
+}
+
+type Tx struct {
+	AddrFrom    string
+	Transaction []byte
+}
+
+// Version opens the exchange with a peer. Genesis is the hash of the first
+// block of the sender's chain: nodes of different networks, or of separate
+// chains on the same one, never share it and so do not sync with each other.
+type Version struct {
+	Version    int
+	BestHeight int
+	AddrFrom   string
+	Genesis    []byte
+}
+
+// Server is a single node of the network. It listens on Address, keeps the
+// list of peers it knows about and syncs blocks and transactions with them.
+// If MinerAddress is set the node mines pending transactions into new blocks.
+type Server struct {
+	Address      string
+	MinerAddress string
+	Chain        *bc.BlockChain
+
+	mu              sync.Mutex
+	knownNodes      []string
+	blocksInTransit map[string]*transit
+	// invBlocks is maxInvBlocks but for tests, which sync with fewer blocks.
+	invBlocks int
+	memPool   *bc.MemPool
+	genesis   []byte
+	listener  net.Listener
+	// stopMining aborts the block being mined, nil when the node is idle.
+	stopMining context.CancelFunc
+	// outbox holds the messages handlers send, delivered by flush once the
+	// lock is released so that a slow peer does not hold up the node.
+	outbox []message
+}
+
+type message struct {
+	addr string
+	data []byte
+}
+
+// transit is the download of the blocks a peer announced, one at a time so
+// that each block arrives after its parent.
+type transit struct {
+	// inFlight is the block asked for last, hashes those still to ask for,
+	// oldest first.
+	inFlight []byte
+	hashes   [][]byte
+	// next is the newest block of a full inventory, after which the peer
+	// has more blocks to announce.
+	next []byte
+}
+
+func NewServer(address, minerAddress string, chain *bc.BlockChain, peers []string) *Server {
+	s := &Server{
+		Address:      address,
+		MinerAddress: minerAddress,
+		Chain:        chain,
+		memPool:      bc.NewMemPool(chain, bc.DefaultMemPoolSize),
+
+		blocksInTransit: make(map[string]*transit),
+		invBlocks:       maxInvBlocks,
+	}
+
+	chain.OnReorg = func(disconnected, connected []*bc.Block) {
+		fmt.Printf("Reorganized: %d blocks disconnected, %d connected\n", len(disconnected), len(connected))
+		s.memPool.Reorganize(disconnected, connected)
+	}
+
+	for _, peer := range peers {
+		if peer != address {
+			s.knownNodes = append(s.knownNodes, peer)
+		}
+	}
+
+	return s
+}
+
+func CmdToBytes(cmd string) []byte {
+	var bytes [commandLength]byte
+
+	for i, c := range cmd {
+		bytes[i] = byte(c)
+	}
+
+	return bytes[:]
+}
+
+func BytesToCmd(bytes []byte) string {
+	var cmd []byte
+
+	for _, b := range bytes {
+		if b != 0x0 {
+			cmd = append(cmd, b)
+		}
+	}
+
+	return fmt.Sprintf("%s", cmd)
+}
+
+// GobEncode encodes a message payload. It panics if data is of a type gob
+// cannot encode, which only a programming error can cause.
+func GobEncode(data interface{}) []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// SendTx hands a transaction to the node listening on addr.
+func SendTx(addr string, tx *bc.Transaction) error {
+	data := Tx{"", tx.Serialize()}
+	payload := GobEncode(data)
+	request := append(CmdToBytes("tx"), payload...)
+
+	return sendData(addr, request)
+}
+
+func sendData(addr string, data []byte) error {
+	conn, err := net.DialTimeout(protocol, addr, writeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = io.Copy(conn, bytes.NewReader(data))
+
+	return err
+}
+
+// send queues a message to a peer until flush. It must be called with the
+// lock held.
+func (s *Server) send(addr string, data []byte) {
+	s.outbox = append(s.outbox, message{addr, data})
+}
+
+// flush delivers the queued messages and forgets the peers that are
+// unreachable. It must be called without the lock.
+func (s *Server) flush() {
+	s.mu.Lock()
+	outbox := s.outbox
+	s.outbox = nil
+	s.mu.Unlock()
+
+	for _, msg := range outbox {
+		if err := sendData(msg.addr, msg.data); err != nil {
+			fmt.Printf("%s is not available\n", msg.addr)
+
+			s.mu.Lock()
+			s.forget(msg.addr)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// forget removes a peer from the known nodes and stops downloading from it.
+func (s *Server) forget(addr string) {
+	var updatedNodes []string
+	for _, node := range s.knownNodes {
+		if node != addr {
+			updatedNodes = append(updatedNodes, node)
+		}
+	}
+	s.knownNodes = updatedNodes
+	delete(s.blocksInTransit, addr)
+}
+
+func (s *Server) sendBlock(addr string, b *bc.Block) {
+	data := Block{s.Address, b.Serialize()}
+	payload := GobEncode(data)
+	request := append(CmdToBytes("block"), payload...)
+
+	s.send(addr, request)
+}
+
+func (s *Server) sendInv(addr, kind string, items [][]byte) {
+	inventory := Inv{s.Address, kind, items}
+	payload := GobEncode(inventory)
+	request := append(CmdToBytes("inv"), payload...)
+
+	s.send(addr, request)
+}
+
+func (s *Server) sendTx(addr string, tnx *bc.Transaction) {
+	data := Tx{s.Address, tnx.Serialize()}
+	payload := GobEncode(data)
+	request := append(CmdToBytes("tx"), payload...)
+
+	s.send(addr, request)
+}
+
+func (s *Server) sendVersion(addr string) {
+	bestHeight, err := s.Chain.GetBestHeight()
+	if err != nil {
+		fmt.Printf("Reading the best height failed: %s\n", err)
+		return
+	}
+	payload := GobEncode(Version{version, bestHeight, s.Address, s.genesis})
+	request := append(CmdToBytes("version"), payload...)
+
+	s.send(addr, request)
+}
+
+// sendGetBlocks asks a peer for the blocks after from, on the peer's main
+// chain or after where it leaves the chain ending at from.
+func (s *Server) sendGetBlocks(addr string, from []byte) {
+	locator, err := s.Chain.BlockLocator(from)
+	if err != nil {
+		fmt.Printf("Building a block locator failed: %s\n", err)
+		return
+	}
+	payload := GobEncode(GetBlocks{s.Address, locator})
+	request := append(CmdToBytes("getblocks"), payload...)
+
+	s.send(addr, request)
+}
+
+func (s *Server) sendGetData(addr, kind string, id []byte) {
+	payload := GobEncode(GetData{s.Address, kind, id})
+	request := append(CmdToBytes("getdata"), payload...)
+
+	s.send(addr, request)
+}
+
+func (s *Server) handleBlock(request []byte) {
+	var payload Block
+	if err := decode(request, &payload); err != nil {
+		return
+	}
+
+	block, err := bc.Deserialize(payload.Block)
+	if err != nil {
+		fmt.Printf("Rejected block from %s: %s\n", payload.AddrFrom, err)
+		return
+	}
+
+	if !s.Chain.HasBlock(block.Hash) {
+		fmt.Printf("Received a new block %x\n", block.Hash)
+		if err := s.Chain.AddBlock(block); err != nil {
+			fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+			// The download from the peer stops; a block on an unknown
+			// branch starts a new one from where the chains part.
+			delete(s.blocksInTransit, payload.AddrFrom)
+			if errors.Is(err, bc.ErrUnknownParent) {
+				s.sendGetBlocks(payload.AddrFrom, s.Chain.Tip())
+			}
+			return
+		}
+		if bytes.Equal(s.Chain.Tip(), block.Hash) {
+			if s.stopMining != nil {
+				s.stopMining()
+			}
+			s.memPool.RemoveBlockTxs(block)
+		}
+		s.broadcastInv("block", [][]byte{block.Hash}, payload.AddrFrom)
+	}
+
+	if t := s.blocksInTransit[payload.AddrFrom]; t != nil && bytes.Equal(t.inFlight, block.Hash) {
+		s.requestBlock(payload.AddrFrom)
+	}
+}
+
+// requestBlock asks a peer for the next block of its transit that is still
+// missing. Once there are none left, it asks for the next inventory if the
+// last one was full.
+func (s *Server) requestBlock(addr string) {
+	t := s.blocksInTransit[addr]
+	if t == nil {
+		return
+	}
+
+	for len(t.hashes) > 0 {
+		hash := t.hashes[0]
+		t.hashes = t.hashes[1:]
+		if !s.Chain.HasBlock(hash) {
+			t.inFlight = hash
+			s.sendGetData(addr, "block", hash)
+			return
+		}
+	}
+
+	delete(s.blocksInTransit, addr)
+	if t.next != nil {
+		s.sendGetBlocks(addr, t.next)
+	}
+}
+
+func (s *Server) handleInv(request []byte) {
+	var payload Inv
+	if err := decode(request, &payload); err != nil {
+		return
+	}
+
+	fmt.Printf("Received inventory with %d %s\n", len(payload.Items), payload.Type)
+
+	if payload.Type == "block" {
+		// Inventories list blocks from the tip down, ask for the missing ones
+		// oldest first so that every block arrives after its parent.
+		t := &transit{}
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			if !s.Chain.HasBlock(payload.Items[i]) {
+				t.hashes = append(t.hashes, payload.Items[i])
+			}
+		}
+		if len(payload.Items) >= s.invBlocks {
+			t.next = payload.Items[0]
+		}
+		if len(t.hashes) == 0 && t.next == nil {
+			return
+		}
+
+		s.blocksInTransit[payload.AddrFrom] = t
+		s.requestBlock(payload.AddrFrom)
+	}
+
+	if payload.Type == "tx" {
+		for _, txId := range payload.Items {
+			if !s.memPool.Has(txId) {
+				s.sendGetData(payload.AddrFrom, "tx", txId)
+			}
+		}
+	}
+}
+
+func (s *Server) handleGetBlocks(request []byte) {
+	var payload GetBlocks
+	if err := decode(request, &payload); err != nil {
+		return
+	}
+
+	blocks, err := s.Chain.BlocksAfter(payload.Locator, s.invBlocks)
+	if err != nil {
+		fmt.Printf("Listing blocks failed: %s\n", err)
+		return
+	}
+	if len(blocks) > 0 {
+		s.sendInv(payload.AddrFrom, "block", blocks)
+	}
+}
+
+func (s *Server) handleGetData(request []byte) {
+	var payload GetData
+	if err := decode(request, &payload); err != nil {
+		return
+	}
+
+	if payload.Type == "block" {
+		block, err := s.Chain.GetBlock(payload.Id)
+		if err != nil {
+			return
+		}
+
+		s.sendBlock(payload.AddrFrom, &block)
+	}
+
+	if payload.Type == "tx" {
+		tx, ok := s.memPool.Get(payload.Id)
+		if !ok {
+			return
+		}
+
+		s.sendTx(payload.AddrFrom, tx)
+	}
+}
+
+func (s *Server) handleTx(request []byte) {
+	var payload Tx
+	if err := decode(request, &payload); err != nil {
+		return
+	}
+
+	tx, err := bc.DeserializeTransaction(payload.Transaction)
+	if err != nil {
+		fmt.Printf("Rejected transaction from %s: %s\n", payload.AddrFrom, err)
+		return
+	}
+	if err := s.acceptTx(&tx, payload.AddrFrom); err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.Id, err)
+	}
+}
+
+// SubmitTx adds a transaction created on this node to the memory pool and
+// announces it to the network.
+func (s *Server) SubmitTx(tx *bc.Transaction) error {
+	s.mu.Lock()
+	err := s.acceptTx(tx, "")
+	s.mu.Unlock()
+
+	s.flush()
+
+	return err
+}
+
+// acceptTx adds a transaction to the memory pool, relays it to every peer but
+// the one it came from and mines it if this node is a miner.
+func (s *Server) acceptTx(tx *bc.Transaction, from string) error {
+	if err := s.memPool.Add(tx); err != nil {
+		return err
+	}
+
+	s.broadcastInv("tx", [][]byte{tx.Id}, from)
+
+	if len(s.MinerAddress) > 0 {
+		s.mineTx()
+	}
+
+	return nil
+}
+
+// mineTx starts mining the pending transactions paying the best fee rates
+// into a new block in the background, unless a block is already being mined.
+func (s *Server) mineTx() {
+	if s.stopMining != nil {
+		return
+	}
+
+	txs := s.memPool.BlockTemplate()
+	if len(txs) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopMining = cancel
+
+	go s.mine(ctx, txs)
+}
+
+// mine runs the proof of work without holding the server lock so that a
+// competing block can still arrive and abort it. Once done it announces the
+// new block and carries on with whatever is left in the memory pool.
+func (s *Server) mine(ctx context.Context, txs []*bc.Transaction) {
+	newBlock, err := s.Chain.MineBlockContext(ctx, s.MinerAddress, txs)
+
+	s.mu.Lock()
+	defer s.flush()
+	defer s.mu.Unlock()
+
+	s.stopMining()
+	s.stopMining = nil
+
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Printf("Mining failed: %s\n", err)
+			s.evictFailed(txs, err)
+		} else {
+			fmt.Println("Mining aborted")
+		}
+	} else if !bytes.Equal(s.Chain.Tip(), newBlock.Hash) {
+		fmt.Println("Mined block is stale")
+	} else {
+		s.memPool.RemoveBlockTxs(newBlock)
+		fmt.Println("New Block mined")
+		s.broadcastInv("block", [][]byte{newBlock.Hash}, "")
+	}
+
+	if s.listener != nil {
+		s.mineTx()
+	}
+}
+
+// evictFailed drops the transaction a block template was rejected for from
+// the memory pool. Should the error not name one of the template's
+// transactions, the whole template goes, lest it be mined again and again.
+func (s *Server) evictFailed(txs []*bc.Transaction, err error) {
+	var blockErr *bc.BlockError
+	if errors.As(err, &blockErr) && s.memPool.Has(blockErr.TxId) {
+		s.memPool.Remove(blockErr.TxId)
+		return
+	}
+
+	for _, tx := range txs {
+		s.memPool.Remove(tx.Id)
+	}
+}
+
+// MemPool returns the node's pool of pending transactions.
+func (s *Server) MemPool() *bc.MemPool {
+	return s.memPool
+}
+
+func (s *Server) handleVersion(request []byte) {
+	var payload Version
+	if err := decode(request, &payload); err != nil {
+		return
+	}
+
+	if !bytes.Equal(payload.Genesis, s.genesis) {
+		fmt.Printf("Dropped %s, whose chain starts at block %x\n", payload.AddrFrom, payload.Genesis)
+		// A known peer answered our version and is forgotten. Any other
+		// gets our version back, so that it forgets this node in turn.
+		if s.nodeIsKnown(payload.AddrFrom) {
+			s.forget(payload.AddrFrom)
+		} else {
+			s.sendVersion(payload.AddrFrom)
+		}
+		return
+	}
+
+	bestHeight, err := s.Chain.GetBestHeight()
+	if err != nil {
+		fmt.Printf("Reading the best height failed: %s\n", err)
+		return
+	}
+	otherHeight := payload.BestHeight
+
+	if bestHeight < otherHeight {
+		s.sendGetBlocks(payload.AddrFrom, s.Chain.Tip())
+	} else if bestHeight > otherHeight {
+		s.sendVersion(payload.AddrFrom)
+	}
+
+	if !s.nodeIsKnown(payload.AddrFrom) {
+		s.knownNodes = append(s.knownNodes, payload.AddrFrom)
+	}
+}
+
+// broadcastInv announces items to every known node except the one they came
+// from.
+func (s *Server) broadcastInv(kind string, items [][]byte, except string) {
+	for _, node := range s.knownNodes {
+		if node != s.Address && node != except {
+			s.sendInv(node, kind, items)
+		}
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	req, err := ioutil.ReadAll(io.LimitReader(conn, maxMessageSize+1))
+	conn.Close()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(req) > maxMessageSize {
+		fmt.Printf("Dropped a message from %s larger than %d bytes\n", conn.RemoteAddr(), maxMessageSize)
+		return
+	}
+	if len(req) < commandLength {
+		return
+	}
+
+	command := BytesToCmd(req[:commandLength])
+	fmt.Printf("Received %s command\n", command)
+
+	s.mu.Lock()
+	defer s.flush()
+	defer s.mu.Unlock()
+
+	switch command {
+	case "block":
+		s.handleBlock(req[commandLength:])
+	case "inv":
+		s.handleInv(req[commandLength:])
+	case "getblocks":
+		s.handleGetBlocks(req[commandLength:])
+	case "getdata":
+		s.handleGetData(req[commandLength:])
+	case "tx":
+		s.handleTx(req[commandLength:])
+	case "version":
+		s.handleVersion(req[commandLength:])
+	default:
+		fmt.Println("Unknown command")
+	}
+}
+
+// Start listens for peers and announces this node to the known nodes. It
+// blocks until the server is closed.
+func (s *Server) Start() error {
+	genesis, err := s.Chain.GetBlockByHeight(0)
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen(protocol, s.Address)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.genesis = genesis.Hash
+	s.listener = ln
+	for _, node := range s.knownNodes {
+		s.sendVersion(node)
+	}
+	s.mu.Unlock()
+	s.flush()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopMining != nil {
+		s.stopMining()
+	}
+	if s.listener == nil {
+		return nil
+	}
+
+	err := s.listener.Close()
+	s.listener = nil
+
+	return err
+}
+
+func (s *Server) KnownNodes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.knownNodes...)
+}
+
+func (s *Server) nodeIsKnown(addr string) bool {
+	for _, node := range s.knownNodes {
+		if node == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+func decode(request []byte, payload interface{}) error {
+	dec := gob.NewDecoder(bytes.NewReader(request))
+
+	return dec.Decode(payload)
+}
@@ -0,0 +1,351 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bc "github.com/serj1c/blockchainio/app/blockchain"
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func copyDir(t *testing.T, from, to string) {
+	t.Helper()
+
+	err := filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+		_, err = io.Copy(dst, src)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openChain(t *testing.T, dir string) *bc.BlockChain {
+	t.Helper()
+
+	chain, err := bc.ContinueBlockChain(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+
+	return chain
+}
+
+// startNode runs a node and waits until it accepts connections.
+func startNode(t *testing.T, address, minerAddress string, chain *bc.BlockChain, peers []string) *Server {
+	t.Helper()
+
+	node := NewServer(address, minerAddress, chain, peers)
+	serve(t, node)
+
+	return node
+}
+
+// serve starts a node and waits until it accepts connections.
+func serve(t *testing.T, node *Server) {
+	t.Helper()
+
+	go node.Start()
+	t.Cleanup(func() { node.Close() })
+
+	waitFor(t, "node to listen", func() bool {
+		conn, err := net.Dial(protocol, node.Address)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestThreeNodesConverge starts a node two blocks ahead and two nodes at the
+// genesis block that only know about the first one. The two catch up, then a
+// transaction submitted to one of them is relayed through the first node to
+// the third, which mines it, and the new block reaches all three.
+func TestThreeNodesConverge(t *testing.T) {
+	miner, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payee, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	genesis, err := bc.InitBlockChain(string(miner.Address()), dirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis.Database.Close()
+	copyDir(t, dirs[0], dirs[1])
+	copyDir(t, dirs[0], dirs[2])
+
+	chains := []*bc.BlockChain{openChain(t, dirs[0]), openChain(t, dirs[1]), openChain(t, dirs[2])}
+	for i := 0; i < 2; i++ {
+		if _, err := chains[0].MineBlock(string(miner.Address()), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addrs := []string{freeAddr(t), freeAddr(t), freeAddr(t)}
+	hub := startNode(t, addrs[0], "", chains[0], nil)
+	relay := startNode(t, addrs[1], "", chains[1], []string{addrs[0]})
+	minerNode := startNode(t, addrs[2], string(miner.Address()), chains[2], []string{addrs[0]})
+	nodes := []*Server{hub, relay, minerNode}
+
+	converged := func(height int) func() bool {
+		return func() bool {
+			tip := nodes[0].Chain.Tip()
+			for _, node := range nodes {
+				best, err := node.Chain.GetBestHeight()
+				if err != nil || best != height || !bytes.Equal(node.Chain.Tip(), tip) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	waitFor(t, "the nodes to sync the first blocks", converged(2))
+
+	tx, err := bc.NewTransaction(miner, string(payee.Address()), 30, bc.Fee{Amount: 1}, nil, relay.Chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.SubmitTx(tx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the transaction to be mined everywhere", converged(3))
+
+	for i, node := range nodes {
+		block, err := node.Chain.FindTransactionBlock(tx.Id)
+		if err != nil {
+			t.Fatalf("node %d: %s", i, err)
+		}
+		if block.Height != 3 {
+			t.Errorf("node %d has the transaction at height %d, want 3", i, block.Height)
+		}
+
+		balance := 0
+		outs, err := node.Chain.FindUTxO(wallet.PublicKeyHash(payee.PublicKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, out := range outs {
+			balance += out.Value
+		}
+		if balance != 30 {
+			t.Errorf("node %d: payee has %d, want 30", i, balance)
+		}
+	}
+
+	waitFor(t, "the memory pools to empty", func() bool {
+		for _, node := range nodes {
+			node.mu.Lock()
+			size := node.memPool.Size()
+			node.mu.Unlock()
+			if size != 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// TestHandleInvWithoutItems checks that an empty inventory from a peer is
+// ignored rather than crashing the node.
+func TestHandleInvWithoutItems(t *testing.T) {
+	miner, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := bc.InitBlockChain(string(miner.Address()), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Database.Close()
+
+	node := NewServer(freeAddr(t), "", chain, nil)
+	for _, kind := range []string{"tx", "block"} {
+		node.handleInv(GobEncode(Inv{freeAddr(t), kind, nil}))
+	}
+}
+
+// TestOtherChainIsDropped starts a node on a chain of its own pointed at a
+// node ahead on another chain, and checks that the two forget each other
+// instead of syncing.
+func TestOtherChainIsDropped(t *testing.T) {
+	var miner *wallet.Wallet
+	var chains []*bc.BlockChain
+	for i := 0; i < 2; i++ {
+		var err error
+		if miner, err = wallet.NewWallet(); err != nil {
+			t.Fatal(err)
+		}
+		chain, err := bc.InitBlockChain(string(miner.Address()), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { chain.Database.Close() })
+		chains = append(chains, chain)
+	}
+	if _, err := chains[0].MineBlock(string(miner.Address()), nil); err != nil {
+		t.Fatal(err)
+	}
+	tip := chains[1].Tip()
+
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	seed := startNode(t, addrs[0], "", chains[0], nil)
+	node := startNode(t, addrs[1], "", chains[1], []string{addrs[0]})
+
+	waitFor(t, "the node to drop its seed", func() bool {
+		return len(node.KnownNodes()) == 0
+	})
+	// The seed may have written back before or after the node forgot it.
+	time.Sleep(200 * time.Millisecond)
+	if known := seed.KnownNodes(); len(known) != 0 {
+		t.Errorf("seed knows %v", known)
+	}
+	if !bytes.Equal(chains[1].Tip(), tip) {
+		t.Error("the node synced blocks of another chain")
+	}
+}
+
+// TestSyncInBatches checks that a node behind by more blocks than fit in an
+// inventory gets them all, one inventory after another, each paged by the
+// locator of what it already has.
+func TestSyncInBatches(t *testing.T) {
+	miner, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := []string{t.TempDir(), t.TempDir()}
+	genesis, err := bc.InitBlockChain(string(miner.Address()), dirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis.Database.Close()
+	copyDir(t, dirs[0], dirs[1])
+
+	chains := []*bc.BlockChain{openChain(t, dirs[0]), openChain(t, dirs[1])}
+	for i := 0; i < 7; i++ {
+		if _, err := chains[0].MineBlock(string(miner.Address()), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	hub := NewServer(addrs[0], "", chains[0], nil)
+	node := NewServer(addrs[1], "", chains[1], []string{addrs[0]})
+	for _, s := range []*Server{hub, node} {
+		s.invBlocks = 3
+		serve(t, s)
+	}
+
+	waitFor(t, "the node to sync", func() bool {
+		return bytes.Equal(chains[1].Tip(), chains[0].Tip())
+	})
+	waitFor(t, "the downloads to end", func() bool {
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		return len(node.blocksInTransit) == 0
+	})
+}
+
+// TestGetBlocksIsPaged checks that getblocks is answered with at most
+// maxInvBlocks hashes following the locator, and that the answer waits in
+// the outbox rather than being sent by the handler.
+func TestGetBlocksIsPaged(t *testing.T) {
+	miner, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := bc.InitBlockChain(string(miner.Address()), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Database.Close()
+	for i := 0; i < 5; i++ {
+		if _, err := chain.MineBlock(string(miner.Address()), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hashes, err := chain.GetBlockHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := NewServer(freeAddr(t), "", chain, nil)
+	node.invBlocks = 2
+	peer := freeAddr(t)
+	node.handleGetBlocks(GobEncode(GetBlocks{peer, [][]byte{hashes[4]}}))
+
+	if len(node.outbox) != 1 || node.outbox[0].addr != peer {
+		t.Fatalf("outbox holds %d messages, want an inventory for %s", len(node.outbox), peer)
+	}
+	data := node.outbox[0].data
+	if BytesToCmd(data[:commandLength]) != "inv" {
+		t.Fatalf("sent %s, want inv", BytesToCmd(data[:commandLength]))
+	}
+	var inv Inv
+	if err := decode(data[commandLength:], &inv); err != nil {
+		t.Fatal(err)
+	}
+	// hashes[4] is at height 1, the next two are at heights 3 and 2.
+	if len(inv.Items) != 2 || !bytes.Equal(inv.Items[0], hashes[2]) || !bytes.Equal(inv.Items[1], hashes[3]) {
+		t.Errorf("inventory %x, want %x", inv.Items, hashes[2:4])
+	}
+}
@@ -0,0 +1,357 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	bc "github.com/serj1c/blockchainio/app/blockchain"
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+type BlockResult struct {
+	Hash          string   `json:"hash"`
+	Height        int      `json:"height"`
+	Version       int32    `json:"version"`
+	PrevHash      string   `json:"prevhash"`
+	MerkleRoot    string   `json:"merkleroot"`
+	Timestamp     int64    `json:"timestamp"`
+	Difficulty    int      `json:"difficulty"`
+	Nonce         int      `json:"nonce"`
+	Confirmations int      `json:"confirmations"`
+	Transactions  []string `json:"tx"`
+}
+
+type InputResult struct {
+	TxId    string `json:"txid"`
+	Out     int    `json:"vout"`
+	Address string `json:"address"`
+}
+
+type OutputResult struct {
+	Value   int    `json:"value"`
+	Address string `json:"address"`
+}
+
+type TransactionResult struct {
+	Id       string         `json:"txid"`
+	Coinbase bool           `json:"coinbase"`
+	Inputs   []InputResult  `json:"vin"`
+	Outputs  []OutputResult `json:"vout"`
+	// The block fields are zero for transactions still in the memory pool.
+	BlockHash     string `json:"blockhash,omitempty"`
+	Height        int    `json:"height"`
+	Confirmations int    `json:"confirmations"`
+}
+
+type UnspentResult struct {
+	TxId    string `json:"txid"`
+	Out     int    `json:"vout"`
+	Value   int    `json:"value"`
+	Address string `json:"address"`
+}
+
+type BalanceResult struct {
+	Address string `json:"address"`
+	Balance int    `json:"balance"`
+}
+
+type ChainInfoResult struct {
+	Height        int    `json:"height"`
+	BestBlockHash string `json:"bestblockhash"`
+	Difficulty    int    `json:"difficulty"`
+	ChainWork     string `json:"chainwork"`
+	MemPoolSize   int    `json:"mempoolsize"`
+	Peers         int    `json:"peers"`
+}
+
+type SendResult struct {
+	TxId string `json:"txid"`
+}
+
+type addressParams struct {
+	Address string `json:"address"`
+}
+
+// pubKeyHash decodes the address parameter of a call.
+func (p addressParams) pubKeyHash() ([]byte, error) {
+	if p.Address == "" {
+		return nil, newError(CodeInvalidParams, "address is required")
+	}
+	pubKeyHash, err := wallet.DecodeAddress(p.Address)
+	if err != nil {
+		return nil, newError(CodeInvalidParams, "%s", err)
+	}
+	return pubKeyHash, nil
+}
+
+// decodeHex decodes a hex parameter, reporting a bad value as invalid params.
+func decodeHex(name, value string) ([]byte, error) {
+	if value == "" {
+		return nil, newError(CodeInvalidParams, "%s is required", name)
+	}
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, newError(CodeInvalidParams, "%s: %s", name, err)
+	}
+	return data, nil
+}
+
+func (s *Server) getBalance(params json.RawMessage) (interface{}, error) {
+	var p addressParams
+	if err := decodeParams(params, []string{"address"}, &p); err != nil {
+		return nil, err
+	}
+	pubKeyHash, err := p.pubKeyHash()
+	if err != nil {
+		return nil, err
+	}
+
+	UTXOs, err := s.Chain.FindUTxO(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	balance := 0
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+
+	return BalanceResult{Address: p.Address, Balance: balance}, nil
+}
+
+func (s *Server) listUnspent(params json.RawMessage) (interface{}, error) {
+	var p addressParams
+	if err := decodeParams(params, []string{"address"}, &p); err != nil {
+		return nil, err
+	}
+	pubKeyHash, err := p.pubKeyHash()
+	if err != nil {
+		return nil, err
+	}
+
+	unspent, err := s.Chain.ListUnspent(pubKeyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]UnspentResult, 0, len(unspent))
+	for _, u := range unspent {
+		address, _ := u.Output.ScriptPubKey.Address()
+		result = append(result, UnspentResult{
+			TxId:    hex.EncodeToString(u.TxId),
+			Out:     u.Index,
+			Value:   u.Output.Value,
+			Address: string(address),
+		})
+	}
+
+	return result, nil
+}
+
+func (s *Server) getBlock(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Hash string `json:"hash"`
+	}
+	if err := decodeParams(params, []string{"hash"}, &p); err != nil {
+		return nil, err
+	}
+	hash, err := decodeHex("hash", p.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := s.Chain.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.blockResult(&block)
+}
+
+func (s *Server) getBlockByHeight(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Height *int `json:"height"`
+	}
+	if err := decodeParams(params, []string{"height"}, &p); err != nil {
+		return nil, err
+	}
+	if p.Height == nil {
+		return nil, newError(CodeInvalidParams, "height is required")
+	}
+
+	block, err := s.Chain.GetBlockByHeight(*p.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.blockResult(&block)
+}
+
+func (s *Server) getTransaction(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		TxId string `json:"txid"`
+	}
+	if err := decodeParams(params, []string{"txid"}, &p); err != nil {
+		return nil, err
+	}
+	id, err := decodeHex("txid", p.TxId)
+	if err != nil {
+		return nil, err
+	}
+
+	if tx, ok := s.Node.MemPool().Get(id); ok {
+		return transactionResult(tx), nil
+	}
+
+	block, err := s.Chain.FindTransactionBlock(id)
+	if err != nil {
+		return nil, err
+	}
+	confirmations, err := s.confirmations(block)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range block.Transactions {
+		if bytes.Equal(tx.Id, id) {
+			result := transactionResult(tx)
+			result.BlockHash = hex.EncodeToString(block.Hash)
+			result.Height = block.Height
+			result.Confirmations = confirmations
+			return result, nil
+		}
+	}
+
+	return nil, bc.ErrTxNotFound
+}
+
+// sendTransaction takes the transaction either in its JSON form or as the
+// hex of its serialized form.
+func (s *Server) sendTransaction(params json.RawMessage) (interface{}, error) {
+	var p struct {
+		Tx json.RawMessage `json:"tx"`
+	}
+	if err := decodeParams(params, []string{"tx"}, &p); err != nil {
+		return nil, err
+	}
+
+	var tx bc.Transaction
+	switch raw := bytes.TrimSpace(p.Tx); {
+	case len(raw) > 0 && raw[0] == '{':
+		if err := json.Unmarshal(raw, &tx); err != nil {
+			return nil, newError(CodeInvalidParams, "tx: %s", err)
+		}
+	default:
+		var encoded string
+		if err := json.Unmarshal(raw, &encoded); len(raw) > 0 && err != nil {
+			return nil, newError(CodeInvalidParams, "tx must be a transaction object or a hex string")
+		}
+		data, err := decodeHex("tx", encoded)
+		if err != nil {
+			return nil, err
+		}
+		if tx, err = bc.DeserializeTransaction(data); err != nil {
+			return nil, newError(CodeInvalidParams, "%s", err)
+		}
+	}
+	if err := s.Node.SubmitTx(&tx); err != nil {
+		return nil, newError(CodeRejected, "%s", err)
+	}
+
+	return SendResult{TxId: hex.EncodeToString(tx.Id)}, nil
+}
+
+func (s *Server) getChainInfo(params json.RawMessage) (interface{}, error) {
+	tip, err := s.Chain.GetBlock(s.Chain.Tip())
+	if err != nil {
+		return nil, err
+	}
+	work, err := s.Chain.ChainWork(tip.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return ChainInfoResult{
+		Height:        tip.Height,
+		BestBlockHash: hex.EncodeToString(tip.Hash),
+		Difficulty:    tip.Difficulty,
+		ChainWork:     work.String(),
+		MemPoolSize:   s.Node.MemPool().Size(),
+		Peers:         len(s.Node.KnownNodes()),
+	}, nil
+}
+
+// confirmations is the number of blocks on the main chain from the given block
+// to the tip, counting both.
+func (s *Server) confirmations(block *bc.Block) (int, error) {
+	height, err := s.Chain.GetBestHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	return height - block.Height + 1, nil
+}
+
+func (s *Server) blockResult(block *bc.Block) (*BlockResult, error) {
+	confirmations := 0
+
+	// Blocks on a side branch have no confirmations.
+	mainBlock, err := s.Chain.GetBlockByHeight(block.Height)
+	if err != nil && !errors.Is(err, bc.ErrBlockNotFound) {
+		return nil, err
+	}
+	if err == nil && bytes.Equal(mainBlock.Hash, block.Hash) {
+		if confirmations, err = s.confirmations(block); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &BlockResult{
+		Hash:          hex.EncodeToString(block.Hash),
+		Height:        block.Height,
+		Version:       block.Version,
+		PrevHash:      hex.EncodeToString(block.PrevHash),
+		MerkleRoot:    hex.EncodeToString(block.MerkleRoot),
+		Timestamp:     block.Timestamp,
+		Difficulty:    block.Difficulty,
+		Nonce:         block.Nonce,
+		Confirmations: confirmations,
+		Transactions:  make([]string, 0, len(block.Transactions)),
+	}
+	for _, tx := range block.Transactions {
+		result.Transactions = append(result.Transactions, hex.EncodeToString(tx.Id))
+	}
+
+	return result, nil
+}
+
+func transactionResult(tx *bc.Transaction) *TransactionResult {
+	result := &TransactionResult{
+		Id:       hex.EncodeToString(tx.Id),
+		Coinbase: tx.IsCoinbase(),
+		Inputs:   make([]InputResult, 0, len(tx.Inputs)),
+		Outputs:  make([]OutputResult, 0, len(tx.Outputs)),
+	}
+
+	if !tx.IsCoinbase() {
+		for _, in := range tx.Inputs {
+			address, _ := in.Address()
+			result.Inputs = append(result.Inputs, InputResult{
+				TxId:    hex.EncodeToString(in.Id),
+				Out:     in.Out,
+				Address: string(address),
+			})
+		}
+	}
+	for _, out := range tx.Outputs {
+		address, _ := out.ScriptPubKey.Address()
+		result.Outputs = append(result.Outputs, OutputResult{
+			Value:   out.Value,
+			Address: string(address),
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,234 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	bc "github.com/serj1c/blockchainio/app/blockchain"
+	"github.com/serj1c/blockchainio/app/network"
+)
+
+const (
+	version        = "2.0"
+	maxRequestSize = 1 << 20
+)
+
+// Error codes of the JSON-RPC 2.0 specification, followed by those of this
+// server in the range reserved for implementations.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+
+	CodeNotFound = -32001
+	CodeRejected = -32002
+)
+
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+func newError(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type handler func(params json.RawMessage) (interface{}, error)
+
+// Server answers JSON-RPC 2.0 requests sent by HTTP POST about the chain and
+// memory pool of a running node. It is an http.Handler.
+type Server struct {
+	Chain *bc.BlockChain
+	Node  *network.Server
+
+	methods map[string]handler
+}
+
+func NewServer(node *network.Server) *Server {
+	s := &Server{
+		Chain: node.Chain,
+		Node:  node,
+	}
+	s.methods = map[string]handler{
+		"getbalance":       s.getBalance,
+		"getblock":         s.getBlock,
+		"getblockbyheight": s.getBlockByHeight,
+		"getchaininfo":     s.getChainInfo,
+		"gettransaction":   s.getTransaction,
+		"listunspent":      s.listUnspent,
+		"sendtransaction":  s.sendTransaction,
+	}
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "JSON-RPC requests must be sent with POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var reply interface{}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		reply = s.handleBatch(body)
+	} else {
+		// A single notification gets no reply at all.
+		if resp := s.handleMessage(body); resp != nil {
+			reply = resp
+		}
+	}
+
+	if reply == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// handleBatch answers an array of requests with an array of responses, leaving
+// out notifications.
+func (s *Server) handleBatch(body []byte) interface{} {
+	var messages []json.RawMessage
+	if err := json.Unmarshal(body, &messages); err != nil {
+		return errorResponse(nil, newError(CodeParseError, "%s", err))
+	}
+	if len(messages) == 0 {
+		return errorResponse(nil, newError(CodeInvalidRequest, "empty batch"))
+	}
+
+	var responses []*Response
+	for _, message := range messages {
+		if resp := s.handleMessage(message); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+
+	return responses
+}
+
+// handleMessage runs a single request. It returns nil for notifications,
+// which are requests without an id.
+func (s *Server) handleMessage(message []byte) *Response {
+	var req Request
+	if err := json.Unmarshal(message, &req); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return errorResponse(nil, newError(CodeParseError, "%s", err))
+		}
+		return errorResponse(nil, newError(CodeInvalidRequest, "%s", err))
+	}
+	if req.JSONRPC != version || req.Method == "" {
+		return errorResponse(req.ID, newError(CodeInvalidRequest, "not a JSON-RPC %s request", version))
+	}
+
+	result, err := s.call(req.Method, req.Params)
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		return errorResponse(req.ID, toError(err))
+	}
+
+	return &Response{JSONRPC: version, Result: result, ID: req.ID}
+}
+
+func (s *Server) call(method string, params json.RawMessage) (interface{}, error) {
+	h, ok := s.methods[method]
+	if !ok {
+		return nil, newError(CodeMethodNotFound, "method %q not found", method)
+	}
+
+	return h(params)
+}
+
+func errorResponse(id json.RawMessage, err *Error) *Response {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &Response{JSONRPC: version, Error: err, ID: id}
+}
+
+// toError turns an error returned by a method into its JSON-RPC error.
+func toError(err error) *Error {
+	var rpcErr *Error
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.Is(err, bc.ErrBlockNotFound), errors.Is(err, bc.ErrTxNotFound):
+		return newError(CodeNotFound, "%s", err)
+	default:
+		return newError(CodeInternalError, "%s", err)
+	}
+}
+
+// decodeParams reads the parameters of a call into dst, a pointer to a struct.
+// Parameters may be given by name as an object, or by position as an array
+// in which case names gives the JSON name of each position.
+func decodeParams(params json.RawMessage, names []string, dst interface{}) error {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return nil
+	}
+
+	if params[0] == '[' {
+		var values []json.RawMessage
+		if err := json.Unmarshal(params, &values); err != nil {
+			return newError(CodeInvalidParams, "%s", err)
+		}
+		if len(values) > len(names) {
+			return newError(CodeInvalidParams, "expected at most %d parameters, got %d", len(names), len(values))
+		}
+
+		named := make(map[string]json.RawMessage, len(values))
+		for i, value := range values {
+			named[names[i]] = value
+		}
+		var err error
+		if params, err = json.Marshal(named); err != nil {
+			return newError(CodeInvalidParams, "%s", err)
+		}
+	}
+
+	if err := json.Unmarshal(params, dst); err != nil {
+		return newError(CodeInvalidParams, "%s", err)
+	}
+	return nil
+}
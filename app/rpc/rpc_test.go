@@ -0,0 +1,354 @@
+package rpc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	bc "github.com/serj1c/blockchainio/app/blockchain"
+	"github.com/serj1c/blockchainio/app/network"
+	"github.com/serj1c/blockchainio/app/wallet"
+)
+
+// fixture is a chain of two blocks, the second of which pays 30 from miner to
+// payee, served by an RPC server on a node that does not mine.
+type fixture struct {
+	server *httptest.Server
+	chain  *bc.BlockChain
+	node   *network.Server
+	miner  *wallet.Wallet
+	payee  *wallet.Wallet
+	tx     *bc.Transaction
+	block  *bc.Block
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+
+	miner, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payee, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := bc.InitBlockChain(string(miner.Address()), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+
+	tx, err := bc.NewTransaction(miner, string(payee.Address()), 30, bc.Fee{}, nil, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := chain.MineBlock(string(miner.Address()), []*bc.Transaction{tx})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := network.NewServer("localhost:0", "", chain, nil)
+	server := httptest.NewServer(NewServer(node))
+	t.Cleanup(server.Close)
+
+	return &fixture{server, chain, node, miner, payee, tx, block}
+}
+
+// post sends body and returns the status code and the raw reply.
+func (f *fixture) post(t *testing.T, body string) (int, []byte) {
+	t.Helper()
+
+	resp, err := http.Post(f.server.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var reply json.RawMessage
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp.StatusCode, reply
+}
+
+// call runs method with params and decodes the result into result, unless the
+// call fails, in which case it returns the error.
+func (f *fixture) call(t *testing.T, method, params string, result interface{}) *Error {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"jsonrpc":"2.0","method":%q,"id":1}`, method)
+	if params != "" {
+		body = fmt.Sprintf(`{"jsonrpc":"2.0","method":%q,"params":%s,"id":1}`, method, params)
+	}
+	status, reply := f.post(t, body)
+	if status != http.StatusOK {
+		t.Fatalf("%s: status %d", method, status)
+	}
+
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *Error          `json:"error"`
+		ID     int             `json:"id"`
+	}
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != 1 {
+		t.Fatalf("%s: id %d, want 1", method, resp.ID)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return nil
+}
+
+func TestMethodErrors(t *testing.T) {
+	f := newFixture(t)
+	unknown := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		method string
+		params string
+		code   int
+	}{
+		{"getbalance", `{}`, CodeInvalidParams},
+		{"getbalance", `{"address":"zz"}`, CodeInvalidParams},
+		{"getbalance", `["a","b"]`, CodeInvalidParams},
+		{"listunspent", `{"address":1}`, CodeInvalidParams},
+		{"getblock", `{"hash":"zz"}`, CodeInvalidParams},
+		{"getblock", `[]`, CodeInvalidParams},
+		{"getblock", `["` + unknown + `"]`, CodeNotFound},
+		{"getblockbyheight", `{}`, CodeInvalidParams},
+		{"getblockbyheight", `[7]`, CodeNotFound},
+		{"gettransaction", `{"txid":"xyz"}`, CodeInvalidParams},
+		{"gettransaction", `["` + unknown + `"]`, CodeNotFound},
+		{"sendtransaction", `{}`, CodeInvalidParams},
+		{"sendtransaction", `["nothex"]`, CodeInvalidParams},
+		{"sendtransaction", `["abcd"]`, CodeInvalidParams},
+		{"sendtransaction", `[7]`, CodeInvalidParams},
+		{"sendtransaction", `[{"vin":"x"}]`, CodeInvalidParams},
+		{"nosuchmethod", ``, CodeMethodNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+tt.params, func(t *testing.T) {
+			err := f.call(t, tt.method, tt.params, nil)
+			if err == nil {
+				t.Fatalf("succeeded, want error %d", tt.code)
+			}
+			if err.Code != tt.code {
+				t.Errorf("code %d (%s), want %d", err.Code, err.Message, tt.code)
+			}
+		})
+	}
+}
+
+func TestGetBalanceAndListUnspent(t *testing.T) {
+	f := newFixture(t)
+	payee := string(f.payee.Address())
+
+	var balance BalanceResult
+	if err := f.call(t, "getbalance", `["`+payee+`"]`, &balance); err != nil {
+		t.Fatal(err)
+	}
+	if balance.Address != payee || balance.Balance != 30 {
+		t.Errorf("balance %+v, want 30 for %s", balance, payee)
+	}
+
+	var unspent []UnspentResult
+	if err := f.call(t, "listunspent", `{"address":"`+payee+`"}`, &unspent); err != nil {
+		t.Fatal(err)
+	}
+	if len(unspent) != 1 || unspent[0].Value != 30 || unspent[0].TxId != hex.EncodeToString(f.tx.Id) {
+		t.Errorf("unspent %+v, want output 30 of %x", unspent, f.tx.Id)
+	}
+}
+
+func TestGetBlock(t *testing.T) {
+	f := newFixture(t)
+
+	var byHash, byHeight BlockResult
+	if err := f.call(t, "getblock", `["`+hex.EncodeToString(f.block.Hash)+`"]`, &byHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.call(t, "getblockbyheight", `{"height":1}`, &byHeight); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, result := range []BlockResult{byHash, byHeight} {
+		if result.Hash != hex.EncodeToString(f.block.Hash) || result.Height != 1 || result.Confirmations != 1 {
+			t.Errorf("block %+v, want %x at height 1 with 1 confirmation", result, f.block.Hash)
+		}
+		if len(result.Transactions) != 2 || result.Transactions[1] != hex.EncodeToString(f.tx.Id) {
+			t.Errorf("block transactions %v, want coinbase and %x", result.Transactions, f.tx.Id)
+		}
+	}
+
+	var genesis BlockResult
+	if err := f.call(t, "getblockbyheight", `[0]`, &genesis); err != nil {
+		t.Fatal(err)
+	}
+	if genesis.Hash != byHash.PrevHash || genesis.Confirmations != 2 {
+		t.Errorf("genesis %+v, want %s with 2 confirmations", genesis, byHash.PrevHash)
+	}
+}
+
+func TestGetChainInfo(t *testing.T) {
+	f := newFixture(t)
+
+	var info ChainInfoResult
+	if err := f.call(t, "getchaininfo", "", &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Height != 1 || info.BestBlockHash != hex.EncodeToString(f.block.Hash) {
+		t.Errorf("chain info %+v, want tip %x at height 1", info, f.block.Hash)
+	}
+	if info.Difficulty != f.block.Difficulty || info.MemPoolSize != 0 || info.Peers != 0 {
+		t.Errorf("chain info %+v", info)
+	}
+}
+
+func TestSendAndGetTransaction(t *testing.T) {
+	f := newFixture(t)
+
+	var mined TransactionResult
+	if err := f.call(t, "gettransaction", `["`+hex.EncodeToString(f.tx.Id)+`"]`, &mined); err != nil {
+		t.Fatal(err)
+	}
+	if mined.BlockHash != hex.EncodeToString(f.block.Hash) || mined.Height != 1 || mined.Confirmations != 1 {
+		t.Errorf("mined transaction %+v, want it in %x", mined, f.block.Hash)
+	}
+	if len(mined.Outputs) != 2 || mined.Outputs[0].Value != 30 || mined.Outputs[0].Address != string(f.payee.Address()) {
+		t.Errorf("mined transaction outputs %+v", mined.Outputs)
+	}
+
+	byHex, err := bc.NewTransaction(f.payee, string(f.miner.Address()), 10, bc.Fee{}, nil, f.chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byJSON, err := bc.NewTransaction(f.miner, string(f.payee.Address()), 20, bc.Fee{}, nil, f.chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonTx, err := json.Marshal(byJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, params := range []string{
+		`["` + hex.EncodeToString(byHex.Serialize()) + `"]`,
+		`{"tx":` + string(jsonTx) + `}`,
+	} {
+		var sent SendResult
+		if err := f.call(t, "sendtransaction", params, &sent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !f.node.MemPool().Has(byHex.Id) || !f.node.MemPool().Has(byJSON.Id) {
+		t.Fatal("sent transactions are not in the mempool")
+	}
+
+	rpcErr := f.call(t, "sendtransaction", `{"tx":`+string(jsonTx)+`}`, nil)
+	if rpcErr == nil || rpcErr.Code != CodeRejected {
+		t.Errorf("sending twice: %v, want code %d", rpcErr, CodeRejected)
+	}
+
+	var pending TransactionResult
+	if err := f.call(t, "gettransaction", `{"txid":"`+hex.EncodeToString(byJSON.Id)+`"}`, &pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending.BlockHash != "" || pending.Confirmations != 0 || len(pending.Inputs) != 1 {
+		t.Errorf("pending transaction %+v", pending)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	f := newFixture(t)
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"parse error", `{"jsonrpc":`, CodeParseError},
+		{"not an object", `"hello"`, CodeInvalidRequest},
+		{"wrong version", `{"jsonrpc":"1.0","method":"getchaininfo","id":1}`, CodeInvalidRequest},
+		{"no method", `{"jsonrpc":"2.0","id":1}`, CodeInvalidRequest},
+		{"empty batch", `[]`, CodeInvalidRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reply := f.post(t, tt.body)
+			if status != http.StatusOK {
+				t.Fatalf("status %d", status)
+			}
+			var resp Response
+			if err := json.Unmarshal(reply, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error == nil || resp.Error.Code != tt.code {
+				t.Errorf("error %v, want code %d", resp.Error, tt.code)
+			}
+		})
+	}
+
+	if status, _ := f.post(t, `{"jsonrpc":"2.0","method":"getchaininfo"}`); status != http.StatusNoContent {
+		t.Errorf("notification: status %d, want %d", status, http.StatusNoContent)
+	}
+
+	resp, err := http.Get(f.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	f := newFixture(t)
+
+	status, reply := f.post(t, `[
+		{"jsonrpc":"2.0","method":"getchaininfo","id":1},
+		{"jsonrpc":"2.0","method":"getchaininfo"},
+		{"jsonrpc":"2.0","method":"nope","id":"two"}
+	]`)
+	if status != http.StatusOK {
+		t.Fatalf("status %d", status)
+	}
+
+	var responses []Response
+	if err := json.Unmarshal(reply, &responses); err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("got %d responses, want 2", len(responses))
+	}
+	if responses[0].Error != nil || string(responses[0].ID) != "1" {
+		t.Errorf("first response %+v", responses[0])
+	}
+	if responses[1].Error == nil || responses[1].Error.Code != CodeMethodNotFound || string(responses[1].ID) != `"two"` {
+		t.Errorf("second response %+v", responses[1])
+	}
+
+	if status, _ := f.post(t, `[{"jsonrpc":"2.0","method":"getchaininfo"}]`); status != http.StatusNoContent {
+		t.Errorf("batch of notifications: status %d, want %d", status, http.StatusNoContent)
+	}
+}
@@ -0,0 +1,91 @@
+package wallet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Cost parameters of scrypt for new passphrases, as recommended for
+// interactive logins.
+const (
+	scryptN    = 1 << 15
+	scryptR    = 8
+	scryptP    = 1
+	saltLength = 16
+	keyLength  = 32
+)
+
+var (
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	ErrEmptyPassphrase = errors.New("passphrase is empty")
+)
+
+// scryptParams says how the key encrypting the private keys is derived from
+// the passphrase.
+type scryptParams struct {
+	Salt    []byte
+	N, R, P int
+}
+
+func newScryptParams() (*scryptParams, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &scryptParams{Salt: salt, N: scryptN, R: scryptR, P: scryptP}, nil
+}
+
+func (p *scryptParams) deriveKey(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, ErrEmptyPassphrase
+	}
+
+	return scrypt.Key([]byte(passphrase), p.Salt, p.N, p.R, p.P, keyLength)
+}
+
+// seal encrypts plaintext with AES-256-GCM under key and returns the random
+// nonce along with the ciphertext. additionalData is not encrypted but open
+// fails unless it is given the same.
+func seal(key, plaintext, additionalData []byte) ([]byte, []byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return nonce, aead.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts what seal produced. A wrong key or changed additionalData
+// gives ErrWrongPassphrase.
+func open(key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
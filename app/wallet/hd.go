@@ -0,0 +1,153 @@
+package wallet
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+// Keys of HD wallets are derived from a seed as in BIP32, or its SLIP-10
+// variant for curves other than secp256k1. The seed comes from a BIP39
+// mnemonic that is all a user has to back up.
+
+const (
+	// HardenedOffset is added to an index for hardened derivation.
+	HardenedOffset = 0x80000000
+	// GapLimit is how many unused addresses in a row end a restore scan.
+	GapLimit = 20
+
+	mnemonicBits = 128
+)
+
+// AccountPath is the branch addresses are derived on: key i is m/44'/0'/0'/0/i.
+var AccountPath = []uint32{44 + HardenedOffset, HardenedOffset, HardenedOffset, 0}
+
+var ErrInvalidMnemonic = errors.New("mnemonic is not valid")
+
+// ExtendedKey is a private key of a scheme along with the chain code needed
+// to derive its children.
+type ExtendedKey struct {
+	Scheme    Scheme
+	Key       []byte
+	ChainCode []byte
+}
+
+// NewMnemonic returns a random 12 word mnemonic.
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicBits)
+	if err != nil {
+		return "", err
+	}
+
+	return bip39.NewMnemonic(entropy)
+}
+
+// MnemonicToSeed checks a mnemonic and turns it into the seed of the master
+// key.
+func MnemonicToSeed(mnemonic string) ([]byte, error) {
+	seed, err := bip39.NewSeedWithErrorChecking(normalizeMnemonic(mnemonic), "")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMnemonic, err)
+	}
+
+	return seed, nil
+}
+
+func normalizeMnemonic(mnemonic string) string {
+	return strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+}
+
+func NewMasterKey(scheme Scheme, seed []byte) *ExtendedKey {
+	n := scheme.Curve().Params().N
+	data := seed
+
+	for {
+		sum := hmacSHA512([]byte(scheme.MasterSecret()), data)
+
+		key := new(big.Int).SetBytes(sum[:32])
+		if key.Sign() != 0 && key.Cmp(n) < 0 {
+			return &ExtendedKey{Scheme: scheme, Key: sum[:32], ChainCode: sum[32:]}
+		}
+		data = sum
+	}
+}
+
+// Child derives the child key at index, hardened if index is at least
+// HardenedOffset.
+func (k *ExtendedKey) Child(index uint32) *ExtendedKey {
+	n := k.Scheme.Curve().Params().N
+
+	var data []byte
+	if index >= HardenedOffset {
+		data = append([]byte{0}, k.Key...)
+	} else {
+		private := privateKeyFromScalar(k.Scheme, k.Key)
+		data = k.Scheme.CompressPublicKey(&private.PublicKey)
+	}
+	data = appendIndex(data, index)
+
+	for {
+		sum := hmacSHA512(k.ChainCode, data)
+
+		tweak := new(big.Int).SetBytes(sum[:32])
+		child := new(big.Int).Add(tweak, new(big.Int).SetBytes(k.Key))
+		child.Mod(child, n)
+		if tweak.Cmp(n) < 0 && child.Sign() != 0 {
+			return &ExtendedKey{Scheme: k.Scheme, Key: child.FillBytes(make([]byte, 32)), ChainCode: sum[32:]}
+		}
+		// SLIP-10 retries with the right half of the hash when the key is
+		// out of range.
+		data = appendIndex(append([]byte{1}, sum[32:]...), index)
+	}
+}
+
+// Derive follows a path of child indexes from k.
+func (k *ExtendedKey) Derive(path []uint32) *ExtendedKey {
+	key := k
+	for _, index := range path {
+		key = key.Child(index)
+	}
+
+	return key
+}
+
+// Wallet returns the key pair of the extended key.
+func (k *ExtendedKey) Wallet() *Wallet {
+	private := privateKeyFromScalar(k.Scheme, k.Key)
+
+	return &Wallet{
+		PrivateKey: private,
+		PublicKey:  k.Scheme.EncodePublicKey(&private.PublicKey),
+	}
+}
+
+// accountKey returns the key of a scheme on AccountPath of the mnemonic, the
+// parent of every address key.
+func accountKey(scheme Scheme, mnemonic string) (*ExtendedKey, error) {
+	seed, err := MnemonicToSeed(mnemonic)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMasterKey(scheme, seed).Derive(AccountPath), nil
+}
+
+func appendIndex(data []byte, index uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], index)
+
+	return append(data, buf[:]...)
+}
+
+func hmacSHA512(key, data []byte) []byte {
+	mac := hmac.New(sha512.New, key)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,292 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secpecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// Address versions, which say what scheme the key behind an address uses or
+// that the address pays to a script.
+const (
+	VersionP256       = byte(0x00)
+	VersionSecp256k1  = byte(0x3f)
+	VersionScriptHash = byte(0x05)
+)
+
+// Scheme is a kind of signing key. Its Version is the first byte of the
+// addresses of its keys.
+type Scheme interface {
+	Name() string
+	Version() byte
+	Curve() elliptic.Curve
+	// MasterSecret is the HMAC key that turns a seed into an HD master key.
+	MasterSecret() string
+	GenerateKey() (*ecdsa.PrivateKey, error)
+	// EncodePublicKey returns the public key as it is put in transaction
+	// inputs and hashed into addresses.
+	EncodePublicKey(pub *ecdsa.PublicKey) []byte
+	DecodePublicKey(data []byte) (*ecdsa.PublicKey, bool)
+	// CompressPublicKey returns the public key as a compressed SEC1 point.
+	CompressPublicKey(pub *ecdsa.PublicKey) []byte
+	Sign(private *ecdsa.PrivateKey, hash []byte) ([]byte, error)
+	Verify(pub *ecdsa.PublicKey, hash, signature []byte) bool
+}
+
+var (
+	// P256 is the scheme of the first wallets. Its public keys are X followed
+	// by Y with no padding, kept as they were so old addresses stay valid.
+	P256 Scheme = p256Scheme{}
+	// Secp256k1 keys are encoded as their version followed by the compressed
+	// point.
+	Secp256k1 Scheme = secp256k1Scheme{}
+
+	// DefaultScheme is used for new keys.
+	DefaultScheme = Secp256k1
+)
+
+var schemes = map[byte]Scheme{}
+
+func init() {
+	RegisterScheme(P256)
+	RegisterScheme(Secp256k1)
+}
+
+// RegisterScheme makes keys of a scheme usable under its address version.
+func RegisterScheme(scheme Scheme) {
+	schemes[scheme.Version()] = scheme
+}
+
+// SchemeByVersion returns the scheme of an address version.
+func SchemeByVersion(version byte) (Scheme, bool) {
+	scheme, ok := schemes[version]
+
+	return scheme, ok
+}
+
+// SchemeByName returns the registered scheme called name.
+func SchemeByName(name string) (Scheme, bool) {
+	for _, scheme := range schemes {
+		if scheme.Name() == name {
+			return scheme, true
+		}
+	}
+
+	return nil, false
+}
+
+// SchemeOf returns the scheme an encoded public key belongs to.
+func SchemeOf(pubKey []byte) (Scheme, bool) {
+	if len(pubKey) == 0 {
+		return nil, false
+	}
+	// Keys start with the version of their scheme, except for P-256 ones.
+	if scheme, ok := schemes[pubKey[0]]; ok {
+		if _, ok := scheme.DecodePublicKey(pubKey); ok {
+			return scheme, true
+		}
+	}
+	if _, ok := P256.DecodePublicKey(pubKey); ok {
+		return P256, true
+	}
+
+	return nil, false
+}
+
+// SchemeOfKey returns the scheme of a private key by its curve.
+func SchemeOfKey(private *ecdsa.PrivateKey) (Scheme, bool) {
+	for _, scheme := range schemes {
+		if scheme.Curve() == private.Curve {
+			return scheme, true
+		}
+	}
+
+	return nil, false
+}
+
+// Sign signs hash with a private key of any registered scheme.
+func Sign(private *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	scheme, ok := SchemeOfKey(private)
+	if !ok {
+		return nil, ErrUnknownScheme
+	}
+
+	return scheme.Sign(private, hash)
+}
+
+// Verify checks a signature of hash against an encoded public key.
+func Verify(pubKey, hash, signature []byte) bool {
+	scheme, ok := SchemeOf(pubKey)
+	if !ok {
+		return false
+	}
+	pub, ok := scheme.DecodePublicKey(pubKey)
+	if !ok {
+		return false
+	}
+
+	return scheme.Verify(pub, hash, signature)
+}
+
+type p256Scheme struct{}
+
+func (p256Scheme) Name() string          { return "p256" }
+func (p256Scheme) Version() byte         { return VersionP256 }
+func (p256Scheme) Curve() elliptic.Curve { return elliptic.P256() }
+func (p256Scheme) MasterSecret() string  { return "Nist256p1 seed" }
+
+func (p256Scheme) GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func (p256Scheme) EncodePublicKey(pub *ecdsa.PublicKey) []byte {
+	return append(pub.X.Bytes(), pub.Y.Bytes()...)
+}
+
+// DecodePublicKey has to guess where X ends, since leading zero bytes of X
+// and Y were dropped. Only one split gives a point on the curve.
+func (p256Scheme) DecodePublicKey(data []byte) (*ecdsa.PublicKey, bool) {
+	curve := elliptic.P256()
+	size := (curve.Params().BitSize + 7) / 8
+	if len(data) < 2 || len(data) > 2*size {
+		return nil, false
+	}
+
+	for xLen := len(data) - size; xLen <= size; xLen++ {
+		if xLen < 1 || xLen >= len(data) {
+			continue
+		}
+		x := new(big.Int).SetBytes(data[:xLen])
+		y := new(big.Int).SetBytes(data[xLen:])
+		if curve.IsOnCurve(x, y) {
+			return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, true
+		}
+	}
+
+	return nil, false
+}
+
+func (p256Scheme) CompressPublicKey(pub *ecdsa.PublicKey) []byte {
+	return elliptic.MarshalCompressed(elliptic.P256(), pub.X, pub.Y)
+}
+
+func (p256Scheme) Sign(private *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, private, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeSignature(r, s), nil
+}
+
+func (p256Scheme) Verify(pub *ecdsa.PublicKey, hash, signature []byte) bool {
+	r, s, ok := decodeSignature(signature)
+	if !ok {
+		return false
+	}
+
+	return ecdsa.Verify(pub, hash, r, s)
+}
+
+type secp256k1Scheme struct{}
+
+func (secp256k1Scheme) Name() string          { return "secp256k1" }
+func (secp256k1Scheme) Version() byte         { return VersionSecp256k1 }
+func (secp256k1Scheme) Curve() elliptic.Curve { return secp256k1.S256() }
+func (secp256k1Scheme) MasterSecret() string  { return "Bitcoin seed" }
+
+func (secp256k1Scheme) GenerateKey() (*ecdsa.PrivateKey, error) {
+	private, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return private.ToECDSA(), nil
+}
+
+func (s secp256k1Scheme) EncodePublicKey(pub *ecdsa.PublicKey) []byte {
+	return append([]byte{VersionSecp256k1}, s.CompressPublicKey(pub)...)
+}
+
+func (secp256k1Scheme) DecodePublicKey(data []byte) (*ecdsa.PublicKey, bool) {
+	if len(data) != 1+secp256k1.PubKeyBytesLenCompressed || data[0] != VersionSecp256k1 {
+		return nil, false
+	}
+
+	pub, err := secp256k1.ParsePubKey(data[1:])
+	if err != nil {
+		return nil, false
+	}
+
+	return pub.ToECDSA(), true
+}
+
+func (secp256k1Scheme) CompressPublicKey(pub *ecdsa.PublicKey) []byte {
+	return toSecp256k1PublicKey(pub).SerializeCompressed()
+}
+
+// Sign makes a deterministic RFC 6979 signature with a low S.
+func (secp256k1Scheme) Sign(private *ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	key := secp256k1.PrivKeyFromBytes(private.D.FillBytes(make([]byte, 32)))
+	defer key.Zero()
+
+	signature := secpecdsa.Sign(key, hash)
+	r, s := signature.R(), signature.S()
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+
+	return append(rBytes[:], sBytes[:]...), nil
+}
+
+func (secp256k1Scheme) Verify(pub *ecdsa.PublicKey, hash, signature []byte) bool {
+	if len(signature) != 64 {
+		return false
+	}
+
+	var r, s secp256k1.ModNScalar
+	if r.SetByteSlice(signature[:32]) || s.SetByteSlice(signature[32:]) {
+		return false
+	}
+	if r.IsZero() || s.IsZero() {
+		return false
+	}
+
+	return secpecdsa.NewSignature(&r, &s).Verify(hash, toSecp256k1PublicKey(pub))
+}
+
+func toSecp256k1PublicKey(pub *ecdsa.PublicKey) *secp256k1.PublicKey {
+	var x, y secp256k1.FieldVal
+	x.SetByteSlice(pub.X.Bytes())
+	y.SetByteSlice(pub.Y.Bytes())
+
+	return secp256k1.NewPublicKey(&x, &y)
+}
+
+const p256SignatureLength = 64
+
+// encodeSignature puts r and s one after the other, each left-padded to the
+// byte length of the P-256 order.
+func encodeSignature(r, s *big.Int) []byte {
+	signature := make([]byte, p256SignatureLength)
+	half := len(signature) / 2
+
+	r.FillBytes(signature[:half])
+	s.FillBytes(signature[half:])
+
+	return signature
+}
+
+func decodeSignature(signature []byte) (*big.Int, *big.Int, bool) {
+	if len(signature) != p256SignatureLength {
+		return nil, nil, false
+	}
+	half := len(signature) / 2
+
+	r := new(big.Int).SetBytes(signature[:half])
+	s := new(big.Int).SetBytes(signature[half:])
+
+	return r, s, true
+}
@@ -3,18 +3,19 @@ package wallet
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"fmt"
-	"log"
+	"math/big"
 
 	"golang.org/x/crypto/ripemd160"
 )
 
-const (
-	checksumLength = 4
-	version        = byte(0x00)
+const checksumLength = 4
+
+var (
+	ErrInvalidAddress = errors.New("address is not valid")
+	ErrUnknownScheme  = errors.New("unknown key scheme")
 )
 
 type Wallet struct {
@@ -23,49 +24,83 @@ type Wallet struct {
 }
 
 func (w Wallet) Address() []byte {
-	pubHash := PublicKeyHash(w.PublicKey)
+	return PublicKeyAddress(w.PublicKey)
+}
 
+// PublicKeyAddress returns the address of an encoded public key, with the
+// version of its scheme.
+func PublicKeyAddress(pubKey []byte) []byte {
+	version := VersionP256
+	if scheme, ok := SchemeOf(pubKey); ok {
+		version = scheme.Version()
+	}
+
+	return HashToAddress(version, PublicKeyHash(pubKey))
+}
+
+// HashToAddress encodes a public key or script hash as an address of a
+// version, the reverse of ParseAddress.
+func HashToAddress(version byte, pubHash []byte) []byte {
 	versionedHash := append([]byte{version}, pubHash...)
 	checksum := Checksum(versionedHash)
 	fullHash := append(versionedHash, checksum...)
 	address := Base58Encode(fullHash)
 
-	fmt.Printf("pub key: %x\n", w.PublicKey)
-	fmt.Printf("pub hash: %x\n", pubHash)
-	fmt.Printf("address: %x\n", address)
-
 	return address
 }
 
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
-	curve := elliptic.P256()
-
-	private, err := ecdsa.GenerateKey(curve, rand.Reader)
+func NewKeyPair(scheme Scheme) (ecdsa.PrivateKey, []byte, error) {
+	private, err := scheme.GenerateKey()
 	if err != nil {
-		log.Panic(err)
+		return ecdsa.PrivateKey{}, nil, err
 	}
 
-	public := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
-	return *private, public
+	return *private, scheme.EncodePublicKey(&private.PublicKey), nil
 }
 
-func NewWallet() *Wallet {
-	private, public := NewKeyPair()
+// privateKeyFromScalar rebuilds a private key of a scheme from its secret
+// scalar.
+func privateKeyFromScalar(scheme Scheme, d []byte) ecdsa.PrivateKey {
+	curve := scheme.Curve()
+
+	private := ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(d)
+
+	return private
+}
+
+// NewWallet makes a random key of DefaultScheme.
+func NewWallet() (*Wallet, error) {
+	private, public, err := NewKeyPair(DefaultScheme)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Wallet{
 		PrivateKey: private,
 		PublicKey:  public,
-	}
+	}, nil
 }
 
 func PublicKeyHash(pubKey []byte) []byte {
-	pubHash := sha256.Sum256(pubKey)
+	return Hash160(pubKey)
+}
+
+// ScriptHashAddress returns the pay-to-script-hash address of a redeem
+// script.
+func ScriptHashAddress(script []byte) []byte {
+	return HashToAddress(VersionScriptHash, Hash160(script))
+}
+
+// Hash160 is the RIPEMD-160 of the SHA-256 of data, which addresses are made
+// of.
+func Hash160(data []byte) []byte {
+	sum := sha256.Sum256(data)
 
+	// Writing to a hash never returns an error.
 	hasher := ripemd160.New()
-	_, err := hasher.Write(pubHash[:])
-	if err != nil {
-		log.Panic(err)
-	}
+	hasher.Write(sum[:])
 
 	return hasher.Sum(nil)
 }
@@ -77,12 +112,41 @@ func Checksum(payload []byte) []byte {
 	return secondHash[:checksumLength]
 }
 
-func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
-	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
-	version := pubKeyHash[0]
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]
-	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
+// ParseAddress returns the version of an address and the public key or
+// script hash it pays to. It fails with ErrInvalidAddress if the address is
+// malformed, its checksum is wrong or its version is unknown.
+func ParseAddress(address string) (byte, []byte, error) {
+	decoded, err := Base58Decode([]byte(address))
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %s: %v", ErrInvalidAddress, address, err)
+	}
+	if len(decoded) != 1+ripemd160.Size+checksumLength {
+		return 0, nil, fmt.Errorf("%w: %s has the wrong length", ErrInvalidAddress, address)
+	}
+
+	actualChecksum := decoded[len(decoded)-checksumLength:]
+	versionedHash := decoded[:len(decoded)-checksumLength]
+	if !bytes.Equal(actualChecksum, Checksum(versionedHash)) {
+		return 0, nil, fmt.Errorf("%w: %s has a bad checksum", ErrInvalidAddress, address)
+	}
+
+	version := versionedHash[0]
+	if _, ok := SchemeByVersion(version); !ok && version != VersionScriptHash {
+		return 0, nil, fmt.Errorf("%w: %s has unknown version %d", ErrInvalidAddress, address, version)
+	}
+
+	return version, versionedHash[1:], nil
+}
+
+// DecodeAddress returns the public key or script hash an address pays to.
+func DecodeAddress(address string) ([]byte, error) {
+	_, hash, err := ParseAddress(address)
+
+	return hash, err
+}
+
+func ValidateAddress(address string) error {
+	_, err := DecodeAddress(address)
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	return err
 }
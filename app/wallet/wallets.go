@@ -2,51 +2,276 @@ package wallet
 
 import (
 	"bytes"
-	"crypto/elliptic"
+	"crypto/ecdsa"
+	"crypto/subtle"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math/big"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 )
 
-const walletFile = "./tmp/wallets.data"
+// Version 1 files hold only the private keys as secrets. Before version 3 the
+// encryption of the secrets did not cover the rest of the file.
+const fileVersion = 3
 
+var (
+	ErrWalletNotFound   = errors.New("wallet is not in the wallet file")
+	ErrWalletLocked     = errors.New("wallet is locked")
+	ErrNotEncrypted     = errors.New("wallet is not encrypted")
+	ErrAlreadyEncrypted = errors.New("wallet is already encrypted")
+	ErrAlreadyHD        = errors.New("wallet already has a mnemonic")
+	ErrNotHD            = errors.New("wallet has no mnemonic")
+	ErrScriptNotFound   = errors.New("script is not in the wallet file")
+)
+
+// walletFile is what is written to disk. The secrets are gob-encoded and, if
+// Scrypt is set, encrypted with AES-GCM under a key derived from the
+// passphrase, which also authenticates the header. HD wallets derive their next key at NextIndex with the scheme
+// of version Scheme, which is P-256 for files that predate the field.
+// Scripts are the redeem scripts of the pay-to-script-hash addresses the
+// wallet takes part in; they are public and never encrypted.
+type walletFile struct {
+	Version    int
+	PublicKeys [][]byte
+	Secrets    []byte
+	Scrypt     *scryptParams
+	Nonce      []byte
+	HD         bool
+	NextIndex  uint32
+	Scheme     byte
+	Scripts    [][]byte
+}
+
+// header returns every field of the file but the secrets and their nonce,
+// each with its length, for the encryption of the secrets to authenticate.
+func (f *walletFile) header() []byte {
+	var buffer bytes.Buffer
+	writeUint := func(n uint64) {
+		var data [8]byte
+		binary.BigEndian.PutUint64(data[:], n)
+		buffer.Write(data[:])
+	}
+	writeBytes := func(data []byte) {
+		writeUint(uint64(len(data)))
+		buffer.Write(data)
+	}
+
+	writeUint(uint64(f.Version))
+	writeUint(uint64(len(f.PublicKeys)))
+	for _, public := range f.PublicKeys {
+		writeBytes(public)
+	}
+	if f.Scrypt != nil {
+		writeBytes(f.Scrypt.Salt)
+		writeUint(uint64(f.Scrypt.N))
+		writeUint(uint64(f.Scrypt.R))
+		writeUint(uint64(f.Scrypt.P))
+	}
+	if f.HD {
+		writeUint(1)
+	} else {
+		writeUint(0)
+	}
+	writeUint(uint64(f.NextIndex))
+	buffer.WriteByte(f.Scheme)
+	writeUint(uint64(len(f.Scripts)))
+	for _, script := range f.Scripts {
+		writeBytes(script)
+	}
+
+	return buffer.Bytes()
+}
+
+// additionalData is what the secrets of the file are authenticated with.
+func (f *walletFile) additionalData() []byte {
+	if f.Version < 3 {
+		return nil
+	}
+
+	return f.header()
+}
+
+// legacyWallets is the format of the files written before walletFile: the
+// wallets gob-encoded as they are, with their curve. Only the secret scalars
+// and public keys are read back; the curve follows from the public key.
+type legacyWallets struct {
+	Wallets map[string]*struct {
+		PrivateKey struct {
+			D *big.Int
+		}
+		PublicKey []byte
+	}
+}
+
+// walletSecrets holds the private keys as their secret scalars in the order
+// of the public keys, and the mnemonic of HD wallets.
+type walletSecrets struct {
+	Scalars  [][]byte
+	Mnemonic string
+}
+
+// Wallets is the set of keys kept in a wallet file. An encrypted set starts
+// out locked: addresses can be listed but keys can only be used after Unlock.
 type Wallets struct {
 	Wallets map[string]*Wallet
+
+	mu sync.Mutex
+	// kdf is set for encrypted wallets and key while they are unlocked.
+	kdf *scryptParams
+	key []byte
+	// file is kept up to date for encrypted wallets so that they can be saved
+	// while locked.
+	file   *walletFile
+	relock *time.Timer
+	// HD wallets derive new keys from mnemonic, which is only known while
+	// they are unlocked.
+	hd        bool
+	scheme    Scheme
+	mnemonic  string
+	nextIndex uint32
+	// scripts holds redeem scripts by their address.
+	scripts map[string][]byte
 }
 
-func (ws *Wallets) SaveFile() {
+// SaveFile writes the wallets to the file at path, creating its directory if
+// needed. The file is replaced atomically and only readable by its owner.
+func (ws *Wallets) SaveFile(path string) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	file := ws.file
+	if ws.kdf == nil {
+		var err error
+		if file, err = ws.encodeFile(); err != nil {
+			return err
+		}
+	}
+
 	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(file); err != nil {
+		return err
+	}
 
-	gob.Register(elliptic.P256())
+	return writeFileAtomic(path, content.Bytes())
+}
 
-	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// over path, so that a crash never leaves a partly written file behind.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// encodeFile builds the file contents from the keys in memory, which must be
+// unlocked.
+func (ws *Wallets) encodeFile() (*walletFile, error) {
+	addresses := make([]string, 0, len(ws.Wallets))
+	for address := range ws.Wallets {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	file := &walletFile{
+		Version:   fileVersion,
+		Scrypt:    ws.kdf,
+		HD:        ws.hd,
+		NextIndex: ws.nextIndex,
+	}
+	if ws.hd {
+		file.Scheme = ws.scheme.Version()
+	}
+	file.Scripts = ws.scriptList()
+	secrets := walletSecrets{Mnemonic: ws.mnemonic}
+	for _, address := range addresses {
+		w := ws.Wallets[address]
+		file.PublicKeys = append(file.PublicKeys, w.PublicKey)
+		secrets.Scalars = append(secrets.Scalars, w.PrivateKey.D.Bytes())
+	}
+
+	var plaintext bytes.Buffer
+	if err := gob.NewEncoder(&plaintext).Encode(secrets); err != nil {
+		return nil, err
+	}
+
+	if ws.kdf == nil {
+		file.Secrets = plaintext.Bytes()
+		return file, nil
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	var err error
+	file.Nonce, file.Secrets, err = seal(ws.key, plaintext.Bytes(), file.additionalData())
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
+
+	return file, nil
 }
 
-func CreateWallets() (*Wallets, error) {
+// CreateWallets loads the wallets kept in the file at path. If the file does
+// not exist yet an error matching os.ErrNotExist is returned along with an
+// empty set of wallets.
+func CreateWallets(path string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.scripts = make(map[string][]byte)
 
-	err := wallets.LoadFile()
+	err := wallets.LoadFile(path)
 
 	return &wallets, err
 }
 
-func (ws *Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+func (ws *Wallets) GetWallet(address string) (Wallet, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return Wallet{}, fmt.Errorf("%w: %s", ErrWalletNotFound, address)
+	}
+	if ws.locked() {
+		return Wallet{}, ErrWalletLocked
+	}
+
+	return *wallet, nil
 }
 
 func (ws *Wallets) GetAllAddresses() []string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
 	addresses := make([]string, 0, len(ws.Wallets))
 
 	for adr := range ws.Wallets {
@@ -56,35 +281,474 @@ func (ws *Wallets) GetAllAddresses() []string {
 	return addresses
 }
 
-func (ws *Wallets) AddWallet() string {
-	wallet := NewWallet()
+// AddWallet creates a new key, the next one of the mnemonic for HD wallets
+// and a random one otherwise. Encrypted wallets have to be unlocked first.
+func (ws *Wallets) AddWallet() (string, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.locked() {
+		return "", ErrWalletLocked
+	}
+
+	if !ws.hd {
+		wallet, err := NewWallet()
+		if err != nil {
+			return "", err
+		}
+		return ws.add(wallet, ws.nextIndex)
+	}
+
+	account, err := accountKey(ws.scheme, ws.mnemonic)
+	if err != nil {
+		return "", err
+	}
+
+	return ws.add(account.Child(ws.nextIndex).Wallet(), ws.nextIndex+1)
+}
+
+// add stores a new key and moves on the index of the next derived key.
+func (ws *Wallets) add(wallet *Wallet, nextIndex uint32) (string, error) {
 	address := fmt.Sprintf("%s", wallet.Address())
+	oldIndex := ws.nextIndex
 
 	ws.Wallets[address] = wallet
+	ws.nextIndex = nextIndex
+
+	if err := ws.updateFile(); err != nil {
+		delete(ws.Wallets, address)
+		ws.nextIndex = oldIndex
+		return "", err
+	}
 
-	return address
+	return address, nil
 }
 
-func (ws *Wallets) LoadFile() error {
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+// updateFile re-encrypts the secrets of an encrypted wallet after a change.
+func (ws *Wallets) updateFile() error {
+	if ws.kdf == nil {
+		return nil
+	}
+
+	file, err := ws.encodeFile()
+	if err != nil {
 		return err
 	}
+	ws.file = file
+
+	return nil
+}
+
+// PublicKey returns the public key of an address in the wallet. Unlike
+// GetWallet it works while the wallet is locked.
+func (ws *Wallets) PublicKey(address string) ([]byte, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrWalletNotFound, address)
+	}
+
+	return wallet.PublicKey, nil
+}
+
+// AddScript keeps a redeem script so that its pay-to-script-hash address can
+// be spent from later, and returns the address. Encrypted wallets have to be
+// unlocked first, as the scripts are authenticated with the secrets.
+func (ws *Wallets) AddScript(script []byte) (string, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.locked() {
+		return "", ErrWalletLocked
+	}
+
+	address := string(ScriptHashAddress(script))
+	old, existed := ws.scripts[address]
+	ws.scripts[address] = script
+	if err := ws.updateFile(); err != nil {
+		if existed {
+			ws.scripts[address] = old
+		} else {
+			delete(ws.scripts, address)
+		}
+		return "", err
+	}
+
+	return address, nil
+}
+
+// GetScript returns the redeem script of a pay-to-script-hash address.
+func (ws *Wallets) GetScript(address string) ([]byte, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	script, ok := ws.scripts[address]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrScriptNotFound, address)
+	}
+
+	return script, nil
+}
+
+// scriptList returns the redeem scripts in the order of their addresses.
+func (ws *Wallets) scriptList() [][]byte {
+	addresses := make([]string, 0, len(ws.scripts))
+	for address := range ws.scripts {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	scripts := make([][]byte, 0, len(addresses))
+	for _, address := range addresses {
+		scripts = append(scripts, ws.scripts[address])
+	}
+
+	return scripts
+}
+
+// IsHD tells whether new keys are derived from a mnemonic.
+func (ws *Wallets) IsHD() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	return ws.hd
+}
 
-	var wallets Wallets
+// SetMnemonic makes the wallet derive its new keys of a scheme from the
+// mnemonic. Keys already in the wallet are kept but cannot be recovered from
+// the mnemonic.
+func (ws *Wallets) SetMnemonic(scheme Scheme, mnemonic string) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
 
-	fileContent, err := ioutil.ReadFile(walletFile)
+	if ws.hd {
+		return ErrAlreadyHD
+	}
+	if ws.locked() {
+		return ErrWalletLocked
+	}
+	if _, err := MnemonicToSeed(mnemonic); err != nil {
+		return err
+	}
+
+	ws.hd, ws.scheme, ws.mnemonic, ws.nextIndex = true, scheme, normalizeMnemonic(mnemonic), 0
+	if err := ws.updateFile(); err != nil {
+		ws.hd, ws.scheme, ws.mnemonic = false, nil, ""
+		return err
+	}
+
+	return nil
+}
+
+// Restore adds the keys of an HD wallet that have been used, as told by used
+// for the public key hash of each key. Keys are derived in order until
+// GapLimit of them in a row are unused; the first key is added even if it is
+// unused. It returns the number of keys added.
+func (ws *Wallets) Restore(used func(pubKeyHash []byte) bool) (int, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if !ws.hd {
+		return 0, ErrNotHD
+	}
+	if ws.locked() {
+		return 0, ErrWalletLocked
+	}
+
+	account, err := accountKey(ws.scheme, ws.mnemonic)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for index, gap := ws.nextIndex, 0; gap < GapLimit; index++ {
+		wallet := account.Child(index).Wallet()
+		if !used(PublicKeyHash(wallet.PublicKey)) && (index > 0 || added > 0) {
+			gap++
+			continue
+		}
+
+		// Every key up to a used one is added so that indexes stay in order.
+		for i := ws.nextIndex; i <= index; i++ {
+			if _, err := ws.add(account.Child(i).Wallet(), i+1); err != nil {
+				return added, err
+			}
+			added++
+		}
+		gap = 0
+	}
+
+	return added, nil
+}
+
+// LoadFile reads the wallets from the file at path. Files written before
+// walletFile are read too and written in the current format when saved.
+func (ws *Wallets) LoadFile(path string) error {
+	var file walletFile
+
+	fileContent, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
 
-	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&wallets)
+	err = decoder.Decode(&file)
+	if err != nil {
+		var legacy legacyWallets
+		if legacyErr := gob.NewDecoder(bytes.NewReader(fileContent)).Decode(&legacy); legacyErr != nil {
+			return err
+		}
+		return ws.loadLegacy(&legacy)
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	scheme, ok := SchemeByVersion(file.Scheme)
+	if file.HD && !ok {
+		return fmt.Errorf("%w: version %d", ErrUnknownScheme, file.Scheme)
+	}
+
+	ws.Wallets = make(map[string]*Wallet, len(file.PublicKeys))
+	for _, public := range file.PublicKeys {
+		w := &Wallet{PublicKey: public}
+		ws.Wallets[string(w.Address())] = w
+	}
+	ws.scripts = make(map[string][]byte, len(file.Scripts))
+	for _, script := range file.Scripts {
+		ws.scripts[string(ScriptHashAddress(script))] = script
+	}
+
+	ws.kdf = file.Scrypt
+	ws.key = nil
+	ws.hd = file.HD
+	ws.scheme = scheme
+	ws.nextIndex = file.NextIndex
+	if ws.kdf != nil {
+		ws.file = &file
+		return nil
+	}
+
+	return ws.setSecrets(&file, file.Secrets)
+}
+
+// loadLegacy takes the keys of a file in the format before walletFile, which
+// was never encrypted.
+func (ws *Wallets) loadLegacy(legacy *legacyWallets) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	file := &walletFile{Version: fileVersion}
+	var secrets walletSecrets
+	for _, w := range legacy.Wallets {
+		if w == nil || w.PrivateKey.D == nil {
+			return errors.New("wallet file has a key without its private part")
+		}
+		file.PublicKeys = append(file.PublicKeys, w.PublicKey)
+		secrets.Scalars = append(secrets.Scalars, w.PrivateKey.D.Bytes())
+	}
+
+	ws.Wallets = make(map[string]*Wallet, len(file.PublicKeys))
+	for _, public := range file.PublicKeys {
+		w := &Wallet{PublicKey: public}
+		ws.Wallets[string(w.Address())] = w
+	}
+	ws.scripts = make(map[string][]byte)
+	ws.kdf, ws.key, ws.file = nil, nil, nil
+	ws.hd, ws.scheme, ws.nextIndex = false, nil, 0
+
+	var plaintext bytes.Buffer
+	if err := gob.NewEncoder(&plaintext).Encode(secrets); err != nil {
+		return err
+	}
+
+	return ws.setSecrets(file, plaintext.Bytes())
+}
+
+// setSecrets fills in the private keys and mnemonic from the decrypted
+// secrets of a wallet file. Each has to belong to the public key next to it.
+func (ws *Wallets) setSecrets(file *walletFile, plaintext []byte) error {
+	var secrets walletSecrets
+
+	decoder := gob.NewDecoder(bytes.NewReader(plaintext))
+	var err error
+	if file.Version < 2 {
+		err = decoder.Decode(&secrets.Scalars)
+	} else {
+		err = decoder.Decode(&secrets)
+	}
 	if err != nil {
 		return err
 	}
+	if len(secrets.Scalars) != len(file.PublicKeys) {
+		return errors.New("wallet file has a different number of public and private keys")
+	}
+
+	privateKeys := make([]ecdsa.PrivateKey, len(file.PublicKeys))
+	for i, public := range file.PublicKeys {
+		scheme, ok := SchemeOf(public)
+		if !ok {
+			return fmt.Errorf("%w: public key %x", ErrUnknownScheme, public)
+		}
+		privateKeys[i] = privateKeyFromScalar(scheme, secrets.Scalars[i])
+		if !bytes.Equal(scheme.EncodePublicKey(&privateKeys[i].PublicKey), public) {
+			return fmt.Errorf("wallet file has a private key that does not match public key %x", public)
+		}
+	}
+	for i, public := range file.PublicKeys {
+		ws.Wallets[string(PublicKeyAddress(public))].PrivateKey = privateKeys[i]
+	}
+	ws.mnemonic = secrets.Mnemonic
+
+	return nil
+}
+
+// IsEncrypted tells whether the private keys are encrypted with a passphrase.
+func (ws *Wallets) IsEncrypted() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	return ws.kdf != nil
+}
+
+// IsLocked tells whether the private keys are encrypted and not unlocked.
+func (ws *Wallets) IsLocked() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	return ws.locked()
+}
 
-	ws.Wallets = wallets.Wallets
+func (ws *Wallets) locked() bool {
+	return ws.kdf != nil && ws.key == nil
+}
+
+// Unlock decrypts the private keys with the passphrase. They are locked again
+// after timeout, or only by Lock if timeout is zero.
+func (ws *Wallets) Unlock(passphrase string, timeout time.Duration) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.kdf == nil {
+		return ErrNotEncrypted
+	}
+
+	key, err := ws.kdf.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+	if ws.key != nil {
+		if subtle.ConstantTimeCompare(key, ws.key) != 1 {
+			return ErrWrongPassphrase
+		}
+	} else {
+		plaintext, err := open(key, ws.file.Nonce, ws.file.Secrets, ws.file.additionalData())
+		if err != nil {
+			return err
+		}
+		if err := ws.setSecrets(ws.file, plaintext); err != nil {
+			return err
+		}
+		ws.key = key
+	}
+
+	if ws.relock != nil {
+		ws.relock.Stop()
+		ws.relock = nil
+	}
+	if timeout > 0 {
+		ws.relock = time.AfterFunc(timeout, ws.Lock)
+	}
+
+	return nil
+}
+
+// Lock forgets the decrypted private keys of an encrypted wallet.
+func (ws *Wallets) Lock() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.lock()
+}
+
+func (ws *Wallets) lock() {
+	if ws.kdf == nil {
+		return
+	}
+
+	if ws.relock != nil {
+		ws.relock.Stop()
+		ws.relock = nil
+	}
+	for _, w := range ws.Wallets {
+		w.PrivateKey = ecdsa.PrivateKey{}
+	}
+	ws.key = nil
+	ws.mnemonic = ""
+}
+
+// Encrypt encrypts the private keys with a passphrase and locks the wallet.
+// Save the file afterwards for it to take effect.
+func (ws *Wallets) Encrypt(passphrase string) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.kdf != nil {
+		return ErrAlreadyEncrypted
+	}
+
+	return ws.setPassphrase(passphrase)
+}
+
+// ChangePassphrase encrypts the private keys with a new passphrase. The
+// wallet is locked afterwards.
+func (ws *Wallets) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.kdf == nil {
+		return ErrNotEncrypted
+	}
+
+	key, err := ws.kdf.deriveKey(oldPassphrase)
+	if err != nil {
+		return err
+	}
+	plaintext, err := open(key, ws.file.Nonce, ws.file.Secrets, ws.file.additionalData())
+	if err != nil {
+		return err
+	}
+	if err := ws.setSecrets(ws.file, plaintext); err != nil {
+		return err
+	}
+
+	return ws.setPassphrase(newPassphrase)
+}
+
+// setPassphrase encrypts the keys in memory under a new passphrase and locks
+// the wallet.
+func (ws *Wallets) setPassphrase(passphrase string) error {
+	kdf, err := newScryptParams()
+	if err != nil {
+		return err
+	}
+	key, err := kdf.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+
+	oldKdf, oldKey := ws.kdf, ws.key
+	ws.kdf, ws.key = kdf, key
+
+	file, err := ws.encodeFile()
+	if err != nil {
+		ws.kdf, ws.key = oldKdf, oldKey
+		return err
+	}
+	ws.file = file
+	ws.lock()
 
 	return nil
 }
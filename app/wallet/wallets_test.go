@@ -0,0 +1,238 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// baselineCurve stands in for the P-256 curve the first wallet files were
+// written with, which gob stored by the name of its type along with its
+// parameters.
+type baselineCurve struct {
+	*elliptic.CurveParams
+}
+
+// baselineWallets is the format of the first wallet files.
+type baselineWallets struct {
+	Wallets map[string]*Wallet
+}
+
+func readFile(t *testing.T, path string) *walletFile {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file walletFile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&file); err != nil {
+		t.Fatal(err)
+	}
+
+	return &file
+}
+
+func writeFile(t *testing.T, path string, file *walletFile) {
+	t.Helper()
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, content.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadBaselineFile(t *testing.T) {
+	gob.RegisterName("crypto/elliptic.p256Curve", baselineCurve{})
+
+	baseline := baselineWallets{Wallets: make(map[string]*Wallet)}
+	want := make(map[string][]byte)
+	for i := 0; i < 3; i++ {
+		private, public, err := NewKeyPair(P256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		private.Curve = baselineCurve{elliptic.P256().Params()}
+		w := &Wallet{PrivateKey: private, PublicKey: public}
+		baseline.Wallets[string(w.Address())] = w
+		want[string(w.Address())] = private.D.Bytes()
+	}
+
+	path := filepath.Join(t.TempDir(), "wallets.data")
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(baseline); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, content.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(wallets *Wallets) {
+		t.Helper()
+
+		if len(wallets.GetAllAddresses()) != len(want) {
+			t.Fatalf("loaded %d addresses, want %d", len(wallets.GetAllAddresses()), len(want))
+		}
+		for address, d := range want {
+			w, err := wallets.GetWallet(address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(w.PrivateKey.D.Bytes(), d) || w.PrivateKey.Curve != elliptic.P256() {
+				t.Errorf("%s has the wrong private key", address)
+			}
+		}
+	}
+
+	wallets, err := CreateWallets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(wallets)
+
+	if err := wallets.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if version := readFile(t, path).Version; version != fileVersion {
+		t.Errorf("saved version %d, want %d", version, fileVersion)
+	}
+	wallets, err = CreateWallets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(wallets)
+}
+
+func newTestWallets(t *testing.T, keys int) (*Wallets, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "wallets.data")
+	wallets, err := CreateWallets(path)
+	if err == nil {
+		t.Fatal("wallet file exists already")
+	}
+	for i := 0; i < keys; i++ {
+		if _, err := wallets.AddWallet(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wallets.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	return wallets, path
+}
+
+func TestLoadMismatchedPublicKey(t *testing.T) {
+	_, path := newTestWallets(t, 2)
+
+	file := readFile(t, path)
+	_, other, err := NewKeyPair(DefaultScheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.PublicKeys[0] = other
+	writeFile(t, path, file)
+
+	if _, err := CreateWallets(path); err == nil {
+		t.Error("loaded a file whose public key does not match its private key")
+	}
+}
+
+func TestEncryptedHeaderIsAuthenticated(t *testing.T) {
+	const passphrase = "correct horse"
+
+	wallets, path := newTestWallets(t, 2)
+	if err := wallets.Encrypt(passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if err := wallets.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	_, other, err := NewKeyPair(DefaultScheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(file *walletFile)
+	}{
+		{"untouched", func(file *walletFile) {}},
+		{"public key replaced", func(file *walletFile) { file.PublicKeys[1] = other }},
+		{"public key added", func(file *walletFile) { file.PublicKeys = append(file.PublicKeys, other) }},
+		{"made HD", func(file *walletFile) { file.HD, file.Scheme = true, DefaultScheme.Version() }},
+		{"next index changed", func(file *walletFile) { file.NextIndex = 7 }},
+		{"script added", func(file *walletFile) { file.Scripts = append(file.Scripts, []byte{0x51}) }},
+		{"version lowered", func(file *walletFile) { file.Version = 2 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := readFile(t, path)
+			tt.tamper(file)
+			tampered := filepath.Join(t.TempDir(), "wallets.data")
+			writeFile(t, tampered, file)
+
+			wallets, err := CreateWallets(tampered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = wallets.Unlock(passphrase, 0)
+			if tt.name == "untouched" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrWrongPassphrase) {
+				t.Errorf("Unlock = %v, want %v", err, ErrWrongPassphrase)
+			}
+		})
+	}
+}
+
+func TestAddScriptNeedsUnlock(t *testing.T) {
+	const passphrase = "correct horse"
+
+	wallets, path := newTestWallets(t, 1)
+	if err := wallets.Encrypt(passphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	script := []byte{0x51}
+	if _, err := wallets.AddScript(script); !errors.Is(err, ErrWalletLocked) {
+		t.Fatalf("AddScript = %v, want %v", err, ErrWalletLocked)
+	}
+
+	if err := wallets.Unlock(passphrase, 0); err != nil {
+		t.Fatal(err)
+	}
+	address, err := wallets.AddScript(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallets.Lock()
+	if err := wallets.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := CreateWallets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Unlock(passphrase, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := loaded.GetScript(address); err != nil || !bytes.Equal(got, script) {
+		t.Errorf("GetScript = %x, %v, want %x", got, err, script)
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/serj1c/blockchainio/app/cli"
 )
 
 func main() {
-	defer os.Exit(0)
-
 	commandLine := cli.CommandLine{}
-	commandLine.Run()
+
+	err := commandLine.Run()
+
+	code := cli.ExitCode(err)
+	if code != 0 {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+	}
+	os.Exit(code)
 }
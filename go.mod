@@ -3,9 +3,12 @@ module github.com/serj1c/blockchainio
 go 1.17
 
 require (
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.3.0
 	github.com/dgraph-io/badger v1.6.2
 	github.com/mr-tron/base58 v1.2.0
+	github.com/tyler-smith/go-bip39 v1.1.0
 	golang.org/x/crypto v0.0.0-20220507011949-2cf3adece122
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
 )
 
 require (